@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+)
+
+// Limit arbitration
+//
+// The aggregate limits and the grid connection point control both write
+// limits to the same devices. Their requests are combined per device and use
+// case, the device gets the lowest active requested limit and is released
+// once no source requests a limit anymore.
+
+const (
+	limitSourceAggregate   = "aggregate"
+	limitSourceGridControl = "gridcontrol"
+)
+
+// requestedLimit is an active limit requested by a source, end is zero without duration
+type requestedLimit struct {
+	value float64
+	end   time.Time
+}
+
+type limitArbiter struct {
+	// requested limits by SKI/use case and source
+	requests map[string]map[string]requestedLimit
+
+	mutex sync.Mutex
+}
+
+func newLimitArbiter() *limitArbiter {
+	return &limitArbiter{
+		requests: map[string]map[string]requestedLimit{},
+	}
+}
+
+// lowestLimit returns the lowest requested limit which has not ended, or an inactive limit
+func lowestLimit(requests map[string]requestedLimit, now time.Time) ucapi.LoadLimit {
+	lowest := ucapi.LoadLimit{IsActive: false, DeleteDuration: true}
+	for _, source := range slices.Sorted(maps.Keys(requests)) {
+		request := requests[source]
+		if !request.end.IsZero() && !now.Before(request.end) {
+			continue
+		}
+		if lowest.IsActive && lowest.Value <= request.value {
+			continue
+		}
+		lowest = ucapi.LoadLimit{IsActive: true, Value: request.value}
+		if !request.end.IsZero() {
+			lowest.Duration = request.end.Sub(now).Round(time.Second)
+		}
+	}
+	return lowest
+}
+
+// requestLimit replaces the limit a source requests for a device, an inactive
+// limit withdraws the request, and writes the lowest of all requested limits.
+// The error of a rejected write is returned.
+func (h *controlbox) requestLimit(source, useCase, ski string, limit ucapi.LoadLimit, origin writeOrigin) error {
+	now := time.Now()
+	key := ski + "/" + useCase
+
+	h.arbiter.mutex.Lock()
+	requests := h.arbiter.requests[key]
+	if requests == nil {
+		requests = map[string]requestedLimit{}
+		h.arbiter.requests[key] = requests
+	}
+	if limit.IsActive {
+		request := requestedLimit{value: limit.Value}
+		if limit.Duration > 0 {
+			request.end = now.Add(limit.Duration)
+		}
+		requests[source] = request
+	} else {
+		delete(requests, source)
+	}
+	lowest := lowestLimit(requests, now)
+	h.arbiter.mutex.Unlock()
+
+	var err error
+	if useCase == "LPP" {
+		err = h.setProductionLimit(ski, lowest, origin)
+	} else {
+		err = h.setConsumptionLimit(ski, lowest, origin)
+	}
+	if err != nil {
+		slog.Warn("Limit rejected", "ski", ski, "usecase", useCase, "source", source, "error", err)
+	}
+	return err
+}
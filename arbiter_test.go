@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLowestLimit(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		requests     map[string]requestedLimit
+		wantActive   bool
+		wantValue    float64
+		wantDuration time.Duration
+	}{
+		{"no request", nil, false, 0, 0},
+		{"single", map[string]requestedLimit{limitSourceAggregate: {value: 4000}}, true, 4000, 0},
+		{"lowest wins", map[string]requestedLimit{
+			limitSourceAggregate:   {value: 4000, end: now.Add(time.Hour)},
+			limitSourceGridControl: {value: 3000},
+		}, true, 3000, 0},
+		{"remaining duration", map[string]requestedLimit{
+			limitSourceAggregate:   {value: 2000, end: now.Add(time.Hour)},
+			limitSourceGridControl: {value: 3000},
+		}, true, 2000, time.Hour},
+		{"ended request ignored", map[string]requestedLimit{
+			limitSourceAggregate:   {value: 2000, end: now},
+			limitSourceGridControl: {value: 3000},
+		}, true, 3000, 0},
+		{"only ended requests", map[string]requestedLimit{
+			limitSourceAggregate: {value: 2000, end: now.Add(-time.Second)},
+		}, false, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit := lowestLimit(tt.requests, now)
+			if limit.IsActive != tt.wantActive || limit.Value != tt.wantValue || limit.Duration != tt.wantDuration {
+				t.Errorf("got %+v, want active %v value %v duration %v", limit, tt.wantActive, tt.wantValue, tt.wantDuration)
+			}
+			if !limit.IsActive && !limit.DeleteDuration {
+				t.Errorf("inactive limit does not delete the duration")
+			}
+		})
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"controlbox/client"
+)
+
+// Command line interface
+//
+// serve runs ControlBox, the cert and ski commands manage the local
+// certificate, and devices and limit talk to the HTTP API of a running
+// instance, given by --api or CONTROLBOX_API.
+
+const (
+	defaultEEBUSPort = 4712
+	defaultHTTPAddr  = ":7080"
+	defaultAPIURL    = "http://localhost:7080"
+)
+
+// errUsage is returned by commands with invalid arguments, the usage has already been printed
+var errUsage = errors.New("invalid usage")
+
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"serve", "run the EEBUS service, the web frontend and the HTTP API", cmdServe},
+	{"cert", "show, generate or import the certificate", cmdCert},
+	{"ski", "print the local SKI", cmdSKI},
+	{"devices", "list the devices of a running instance", cmdDevices},
+	{"limit", "set an LPC or LPP limit of a running instance", cmdLimit},
+}
+
+// runCommand runs the command given by the arguments and returns the exit code
+func runCommand(args []string) int {
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+
+	// controlbox <port>
+	if _, err := strconv.Atoi(args[0]); err == nil && len(args) == 1 {
+		args = []string{"serve", "--eebus-port", args[0]}
+	}
+
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		if len(args) == 1 {
+			usage()
+			return 0
+		}
+		args = []string{args[1], "-h"}
+	}
+
+	for _, cmd := range commands {
+		if cmd.name != args[0] {
+			continue
+		}
+		err := cmd.run(args[1:])
+		switch {
+		case err == nil, errors.Is(err, flag.ErrHelp):
+			return 0
+		case errors.Is(err, errUsage):
+			return 2
+		default:
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "Unknown command:", args[0])
+	usage()
+	return 2
+}
+
+// newFlagSet creates the flags of a command with its help text
+func newFlagSet(name, synopsis, description string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintln(out, "Usage: controlbox", synopsis)
+		fmt.Fprintln(out)
+		fmt.Fprintln(out, description)
+
+		hasFlags := false
+		fs.VisitAll(func(*flag.Flag) { hasFlags = true })
+		if hasFlags {
+			fmt.Fprintln(out)
+			fmt.Fprintln(out, "Options:")
+			fs.PrintDefaults()
+		}
+	}
+	return fs
+}
+
+// parseFlags parses the arguments of a command, which takes no positional arguments
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return errUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintln(fs.Output(), "Unexpected argument:", fs.Arg(0))
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// runSubcommand runs one of the subcommands of a command
+func runSubcommand(name string, subcommands []command, args []string) error {
+	printUsage := func() {
+		fmt.Printf("Usage: controlbox %s <command> [options]\n", name)
+		fmt.Println()
+		fmt.Println("Commands:")
+		for _, cmd := range subcommands {
+			fmt.Printf("  %-12s %s\n", cmd.name, cmd.summary)
+		}
+	}
+
+	if len(args) == 0 {
+		printUsage()
+		return errUsage
+	}
+	for _, cmd := range subcommands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+	if args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		printUsage()
+		return flag.ErrHelp
+	}
+
+	fmt.Fprintln(os.Stderr, "Unknown command:", name, args[0])
+	printUsage()
+	return errUsage
+}
+
+func cmdServe(args []string) error {
+	fs := newFlagSet("serve", "serve [options]", strings.Join([]string{
+		"Runs the EEBUS service, the web frontend and the HTTP API.",
+		"",
+		"Certificate configuration via .env file:",
+		"  CERT_PEM + KEY_PEM   inline PEM content",
+		"  (auto-generated and persisted on first run if absent)",
+		"",
+		"Limits and registered SKIs are persisted to state.json,",
+		"use STATE_FILE to change the location.",
+		"",
+		"TRUSTED_SKIS and DENIED_SKIS take comma separated SKIs which are",
+		"trusted or denied upfront, other devices have to be approved.",
+	}, "\n"))
+	eebusPort := fs.Int("eebus-port", defaultEEBUSPort, "port of the EEBUS service")
+	httpAddr := fs.String("http-addr", defaultHTTPAddr, "listen address of the web frontend, the HTTP API and the metrics")
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML file with the device identity, heartbeat timeout, mDNS settings and use cases, defaults to CONFIG_FILE")
+	logLevel := fs.String("log-level", envString("LOG_LEVEL", "info"), "trace, debug, info, warn or error, defaults to LOG_LEVEL")
+	logFormat := fs.String("log-format", envString("LOG_FORMAT", "text"), "text or json, defaults to LOG_FORMAT")
+	spineLogFile := fs.String("spine-log", os.Getenv("SPINE_LOG"), "file to append the decoded SPINE datagrams to, defaults to SPINE_LOG")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	if err := setupLogging(*logLevel, *logFormat, *spineLogFile); err != nil {
+		return err
+	}
+
+	config, err := loadDeviceConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	serve(*eebusPort, *httpAddr, config)
+	return nil
+}
+
+func cmdCert(args []string) error {
+	return runSubcommand("cert", []command{
+		{"show", "show the configured certificate", cmdCertShow},
+		{"generate", "generate a new self-signed certificate", cmdCertGenerate},
+		{"import", "import a certificate and key from PEM files", cmdCertImport},
+	}, args)
+}
+
+func cmdCertShow(args []string) error {
+	fs := newFlagSet("cert show", "cert show", "Shows the certificate configured in CERT_PEM / KEY_PEM.")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	certTLS, err := loadCertificate()
+	if err != nil {
+		return err
+	}
+	leaf, ski, err := certificateSKI(certTLS)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Subject:   ", leaf.Subject)
+	fmt.Println("Issuer:    ", leaf.Issuer)
+	fmt.Println("Serial:    ", leaf.SerialNumber)
+	fmt.Println("SKI:       ", ski)
+	fmt.Println("Not before:", leaf.NotBefore.Local().Format(time.RFC3339))
+	fmt.Println("Not after: ", leaf.NotAfter.Local().Format(time.RFC3339))
+	if time.Now().After(leaf.NotAfter) {
+		fmt.Println("The certificate has expired")
+	}
+	return nil
+}
+
+func cmdCertGenerate(args []string) error {
+	fs := newFlagSet("cert generate", "cert generate [options]",
+		"Generates a self-signed certificate for the configured device identity\n"+
+			"and stores it as CERT_PEM / KEY_PEM.\n"+
+			"Paired devices have to be paired again, as the SKI changes.")
+	envFile := fs.String("env", certEnvFile, "file to store the certificate in")
+	force := fs.Bool("force", false, "replace a configured certificate")
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML file with the device identity used in the certificate, defaults to CONFIG_FILE")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	config, err := loadDeviceConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	if _, err := loadCertificate(); !*force {
+		switch {
+		case err == nil:
+			return errors.New("a certificate is already configured, use --force to replace it")
+		case !errors.Is(err, errNoCertificate):
+			return fmt.Errorf("the configured certificate cannot be loaded, use --force to replace it: %w", err)
+		}
+	}
+
+	certTLS, err := newCertificate(config)
+	if err != nil {
+		return err
+	}
+	return storeCertificate(certTLS, *envFile)
+}
+
+func cmdCertImport(args []string) error {
+	fs := newFlagSet("cert import", "cert import --cert <file> --key <file> [options]",
+		"Imports an ECDSA certificate and its private key from PEM files\n"+
+			"and stores them as CERT_PEM / KEY_PEM.")
+	certFile := fs.String("cert", "", "PEM file of the certificate")
+	keyFile := fs.String("key", "", "PEM file of the private key")
+	envFile := fs.String("env", certEnvFile, "file to store the certificate in")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *certFile == "" || *keyFile == "" {
+		fmt.Fprintln(fs.Output(), "--cert and --key are required")
+		fs.Usage()
+		return errUsage
+	}
+
+	certPEM, err := os.ReadFile(*certFile)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := os.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	certTLS, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+
+	return storeCertificate(certTLS, *envFile)
+}
+
+// storeCertificate checks the SKI of a certificate and persists it
+func storeCertificate(certTLS tls.Certificate, envFile string) error {
+	_, ski, err := certificateSKI(certTLS)
+	if err != nil {
+		return err
+	}
+	if err := persistCertificate(certTLS, envFile); err != nil {
+		return err
+	}
+
+	fmt.Println("Certificate stored in", envFile)
+	fmt.Println("SKI:", ski)
+	return nil
+}
+
+func cmdSKI(args []string) error {
+	fs := newFlagSet("ski", "ski", "Prints the SKI of the certificate configured in CERT_PEM / KEY_PEM.")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	certTLS, err := loadCertificate()
+	if errors.Is(err, errNoCertificate) {
+		return fmt.Errorf("%w, run controlbox cert generate first", err)
+	}
+	if err != nil {
+		return err
+	}
+	_, ski, err := certificateSKI(certTLS)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(ski)
+	return nil
+}
+
+// apiFlag adds the --api flag of the commands using the HTTP API
+func apiFlag(fs *flag.FlagSet) *string {
+	def := os.Getenv("CONTROLBOX_API")
+	if def == "" {
+		def = defaultAPIURL
+	}
+	return fs.String("api", def, "URL of the running instance, defaults to CONTROLBOX_API")
+}
+
+func cmdDevices(args []string) error {
+	fs := newFlagSet("devices", "devices [options]", "Lists the devices known to a running instance.")
+	api := apiFlag(fs)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	devices, err := client.New(*api).Devices(context.Background())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SKI\tCONNECTED\tBRAND\tMODEL\tUSE CASES")
+	for _, device := range devices {
+		fmt.Fprintf(w, "%s\t%t\t%s\t%s\t%s\n", device.SKI, device.Connected, device.Brand, device.Model, strings.Join(device.UseCases, ","))
+	}
+	return w.Flush()
+}
+
+func cmdLimit(args []string) error {
+	return runSubcommand("limit", []command{
+		{"set", "set the LPC or LPP limit of a device", cmdLimitSet},
+	}, args)
+}
+
+func cmdLimitSet(args []string) error {
+	fs := newFlagSet("limit set", "limit set --ski <ski> --value <W> [options]",
+		"Sets the LPC or LPP limit of a device of a running instance.\n"+
+			"The limit is rejected if it violates the validation rules, unless --override is given.")
+	api := apiFlag(fs)
+	ski := fs.String("ski", "", "SKI of the device")
+	useCase := fs.String("usecase", "lpc", "use case, lpc or lpp")
+	value := fs.Float64("value", 0, "limit in W")
+	duration := fs.Duration("duration", 0, "duration of the limit, e.g. 1h, 0 for no duration")
+	inactive := fs.Bool("inactive", false, "deactivate the limit")
+	override := fs.Bool("override", false, "send the limit even if it violates the validation rules")
+	id := fs.String("id", "", "correlation ID of the write, see GET /api/writes/{id}")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *ski == "" {
+		fmt.Fprintln(fs.Output(), "--ski is required")
+		fs.Usage()
+		return errUsage
+	}
+
+	ctx := context.Background()
+	if *override {
+		ctx = client.WithValidationOverride(ctx)
+	}
+	if *id != "" {
+		ctx = client.WithCorrelationID(ctx, *id)
+	}
+
+	limit := client.LoadLimit{
+		IsActive: !*inactive,
+		Value:    *value,
+		Duration: int64(duration.Seconds()),
+	}
+
+	c := client.New(*api)
+	var state client.LimitState
+	var err error
+	switch strings.ToUpper(*useCase) {
+	case "LPC":
+		state, err = c.SetConsumptionLimit(ctx, *ski, limit)
+	case "LPP":
+		state, err = c.SetProductionLimit(ctx, *ski, limit)
+	default:
+		fmt.Fprintln(fs.Output(), "--usecase must be lpc or lpp")
+		fs.Usage()
+		return errUsage
+	}
+
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) {
+		for _, violation := range apiErr.Violations {
+			fmt.Fprintln(os.Stderr, violation.Message)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s limit of %s: active %t, value %g W, duration %d s\n",
+		strings.ToUpper(*useCase), *ski, state.Limit.IsActive, state.Limit.Value, state.Limit.Duration)
+	return nil
+}
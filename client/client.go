@@ -0,0 +1,362 @@
+// Package client implements a typed client for the ControlBox HTTP API
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client talks to the HTTP API of a running ControlBox
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// Error is returned when the API responds with an error status,
+// Violations lists the violated rules of an invalid limit
+type Error struct {
+	StatusCode int
+	Message    string
+	Violations []ValidationError
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// New creates a client for the API at baseURL, e.g. http://localhost:7080
+func New(baseURL string) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// SetHTTPClient replaces the HTTP client used for requests
+func (c *Client) SetHTTPClient(httpClient *http.Client) {
+	c.httpClient = httpClient
+}
+
+type correlationIDKey struct{}
+
+type overrideKey struct{}
+
+// WithCorrelationID returns a context whose limit writes carry the given
+// correlation ID, their results can be queried with WriteResults
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// WithValidationOverride returns a context whose limits are sent even if
+// they violate the validation rules, e.g. for conformance tests
+func WithValidationOverride(ctx context.Context) context.Context {
+	return context.WithValue(ctx, overrideKey{}, true)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, result any) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	if override, _ := ctx.Value(overrideKey{}).(bool); override {
+		separator := "?"
+		if strings.Contains(path, "?") {
+			separator = "&"
+		}
+		path += separator + "override=true"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if id, ok := ctx.Value(correlationIDKey{}).(string); ok {
+		req.Header.Set("X-Correlation-ID", id)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var e errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+			e.Error = err.Error()
+		}
+		return &Error{StatusCode: resp.StatusCode, Message: e.Error, Violations: e.Violations}
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func devicePath(ski string, parts ...string) string {
+	return "/api/devices/" + url.PathEscape(ski) + strings.Join(parts, "")
+}
+
+// Devices returns all visible, connected or registered devices
+func (c *Client) Devices(ctx context.Context) ([]Device, error) {
+	var res []Device
+	err := c.do(ctx, http.MethodGet, "/api/devices", nil, &res)
+	return res, err
+}
+
+// Device returns a device including its use cases and entities
+func (c *Client) Device(ctx context.Context, ski string) (DeviceDetails, error) {
+	var res DeviceDetails
+	err := c.do(ctx, http.MethodGet, devicePath(ski), nil, &res)
+	return res, err
+}
+
+// ConsumptionLimits returns the LPC limit state of a device
+func (c *Client) ConsumptionLimits(ctx context.Context, ski string) (LimitState, error) {
+	var res LimitState
+	err := c.do(ctx, http.MethodGet, devicePath(ski, "/lpc"), nil, &res)
+	return res, err
+}
+
+// SetConsumptionLimit sends a new LPC limit to a device
+func (c *Client) SetConsumptionLimit(ctx context.Context, ski string, limit LoadLimit) (LimitState, error) {
+	var res LimitState
+	err := c.do(ctx, http.MethodPut, devicePath(ski, "/lpc/limit"), limit, &res)
+	return res, err
+}
+
+// SetConsumptionFailsafeValue sends a new LPC failsafe limit in W to a device
+func (c *Client) SetConsumptionFailsafeValue(ctx context.Context, ski string, value float64) (LimitState, error) {
+	var res LimitState
+	err := c.do(ctx, http.MethodPut, devicePath(ski, "/lpc/failsafe/value"), valueRequest{Value: value}, &res)
+	return res, err
+}
+
+// SetConsumptionFailsafeDuration sends a new LPC failsafe duration minimum to a device
+func (c *Client) SetConsumptionFailsafeDuration(ctx context.Context, ski string, duration time.Duration) (LimitState, error) {
+	var res LimitState
+	err := c.do(ctx, http.MethodPut, devicePath(ski, "/lpc/failsafe/duration"), valueRequest{Value: duration.Seconds()}, &res)
+	return res, err
+}
+
+// ProductionLimits returns the LPP limit state of a device
+func (c *Client) ProductionLimits(ctx context.Context, ski string) (LimitState, error) {
+	var res LimitState
+	err := c.do(ctx, http.MethodGet, devicePath(ski, "/lpp"), nil, &res)
+	return res, err
+}
+
+// SetProductionLimit sends a new LPP limit to a device
+func (c *Client) SetProductionLimit(ctx context.Context, ski string, limit LoadLimit) (LimitState, error) {
+	var res LimitState
+	err := c.do(ctx, http.MethodPut, devicePath(ski, "/lpp/limit"), limit, &res)
+	return res, err
+}
+
+// SetProductionFailsafeValue sends a new LPP failsafe limit in W to a device
+func (c *Client) SetProductionFailsafeValue(ctx context.Context, ski string, value float64) (LimitState, error) {
+	var res LimitState
+	err := c.do(ctx, http.MethodPut, devicePath(ski, "/lpp/failsafe/value"), valueRequest{Value: value}, &res)
+	return res, err
+}
+
+// SetProductionFailsafeDuration sends a new LPP failsafe duration minimum to a device
+func (c *Client) SetProductionFailsafeDuration(ctx context.Context, ski string, duration time.Duration) (LimitState, error) {
+	var res LimitState
+	err := c.do(ctx, http.MethodPut, devicePath(ski, "/lpp/failsafe/duration"), valueRequest{Value: duration.Seconds()}, &res)
+	return res, err
+}
+
+// MPC returns the MPC measurements of a device
+func (c *Client) MPC(ctx context.Context, ski string) (Measurements, error) {
+	var res Measurements
+	err := c.do(ctx, http.MethodGet, devicePath(ski, "/mpc"), nil, &res)
+	return res, err
+}
+
+// MGCP returns the MGCP measurements of a device
+func (c *Client) MGCP(ctx context.Context, ski string) (Measurements, error) {
+	var res Measurements
+	err := c.do(ctx, http.MethodGet, devicePath(ski, "/mgcp"), nil, &res)
+	return res, err
+}
+
+// Trust returns the trusted and denied SKIs and pending pairing requests
+func (c *Client) Trust(ctx context.Context) (TrustInfo, error) {
+	var res TrustInfo
+	err := c.do(ctx, http.MethodGet, "/api/trust", nil, &res)
+	return res, err
+}
+
+// SetTrust trusts and pairs a device, or denies it and removes an existing pairing
+func (c *Client) SetTrust(ctx context.Context, ski string, trusted bool) (TrustInfo, error) {
+	var res TrustInfo
+	err := c.do(ctx, http.MethodPut, "/api/trust/"+url.PathEscape(ski), trustRequest{Trusted: trusted}, &res)
+	return res, err
+}
+
+// ForgetTrust removes a device from the trusted and denied SKIs
+func (c *Client) ForgetTrust(ctx context.Context, ski string) (TrustInfo, error) {
+	var res TrustInfo
+	err := c.do(ctx, http.MethodDelete, "/api/trust/"+url.PathEscape(ski), nil, &res)
+	return res, err
+}
+
+// PairingStates returns the pairing state of all devices which reported one
+func (c *Client) PairingStates(ctx context.Context) ([]PairingStatus, error) {
+	var res []PairingStatus
+	err := c.do(ctx, http.MethodGet, "/api/pairing", nil, &res)
+	return res, err
+}
+
+// PairingState returns the pairing state of a device including its recent transitions
+func (c *Client) PairingState(ctx context.Context, ski string) (PairingStatus, error) {
+	var res PairingStatus
+	err := c.do(ctx, http.MethodGet, "/api/pairing/"+url.PathEscape(ski), nil, &res)
+	return res, err
+}
+
+// Heartbeat returns the state of the own heartbeat and of all remote heartbeats
+func (c *Client) Heartbeat(ctx context.Context) (HeartbeatInfo, error) {
+	var res HeartbeatInfo
+	err := c.do(ctx, http.MethodGet, "/api/heartbeat", nil, &res)
+	return res, err
+}
+
+// SetHeartbeat starts or stops the own heartbeat of a use case, LPC and LPP share a single heartbeat
+func (c *Client) SetHeartbeat(ctx context.Context, useCase string, sending bool) (HeartbeatInfo, error) {
+	var res HeartbeatInfo
+	err := c.do(ctx, http.MethodPut, "/api/heartbeat/"+url.PathEscape(strings.ToLower(useCase)), heartbeatRequest{Sending: sending}, &res)
+	return res, err
+}
+
+// FailsafeStates returns the derived failsafe state of all LPC and LPP entities
+func (c *Client) FailsafeStates(ctx context.Context) ([]FailsafeStatus, error) {
+	var res []FailsafeStatus
+	err := c.do(ctx, http.MethodGet, "/api/failsafe", nil, &res)
+	return res, err
+}
+
+// DeviceFailsafeStates returns the derived failsafe state of the LPC and LPP entities of a device
+func (c *Client) DeviceFailsafeStates(ctx context.Context, ski string) ([]FailsafeStatus, error) {
+	var res []FailsafeStatus
+	err := c.do(ctx, http.MethodGet, devicePath(ski, "/failsafe"), nil, &res)
+	return res, err
+}
+
+// WriteResults returns the msgCounter and result of the writes with the given correlation ID
+func (c *Client) WriteResults(ctx context.Context, id string) ([]WriteResult, error) {
+	var res []WriteResult
+	err := c.do(ctx, http.MethodGet, "/api/writes/"+url.PathEscape(id), nil, &res)
+	return res, err
+}
+
+// ReconcileStates returns the desired and reported limits tracked by the limit reconciliation
+func (c *Client) ReconcileStates(ctx context.Context) ([]ReconcileStatus, error) {
+	var res []ReconcileStatus
+	err := c.do(ctx, http.MethodGet, "/api/reconcile", nil, &res)
+	return res, err
+}
+
+// Schedules returns all limit schedules
+func (c *Client) Schedules(ctx context.Context) ([]Schedule, error) {
+	var res []Schedule
+	err := c.do(ctx, http.MethodGet, "/api/schedules", nil, &res)
+	return res, err
+}
+
+// Schedule returns a limit schedule
+func (c *Client) Schedule(ctx context.Context, id string) (Schedule, error) {
+	var res Schedule
+	err := c.do(ctx, http.MethodGet, "/api/schedules/"+url.PathEscape(id), nil, &res)
+	return res, err
+}
+
+// CreateSchedule creates a limit schedule, the ID is assigned by the server
+func (c *Client) CreateSchedule(ctx context.Context, schedule Schedule) (Schedule, error) {
+	var res Schedule
+	err := c.do(ctx, http.MethodPost, "/api/schedules", schedule, &res)
+	return res, err
+}
+
+// UpdateSchedule replaces the limit schedule with the ID of the given schedule
+func (c *Client) UpdateSchedule(ctx context.Context, schedule Schedule) (Schedule, error) {
+	var res Schedule
+	err := c.do(ctx, http.MethodPut, "/api/schedules/"+url.PathEscape(schedule.ID), schedule, &res)
+	return res, err
+}
+
+// DeleteSchedule removes a limit schedule
+func (c *Client) DeleteSchedule(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/schedules/"+url.PathEscape(id), nil, nil)
+}
+
+// GridControl returns the configuration and last decision of the grid connection point controller
+func (c *Client) GridControl(ctx context.Context) (GridControlStatus, error) {
+	var res GridControlStatus
+	err := c.do(ctx, http.MethodGet, "/api/gridcontrol", nil, &res)
+	return res, err
+}
+
+// AggregateLimits returns the aggregate limits and their shares per device
+func (c *Client) AggregateLimits(ctx context.Context) ([]AggregateLimit, error) {
+	var res []AggregateLimit
+	err := c.do(ctx, http.MethodGet, "/api/aggregate", nil, &res)
+	return res, err
+}
+
+// SetAggregateLimit sets a limit for all devices of a use case (LPC or LPP),
+// which is split across the connected devices
+func (c *Client) SetAggregateLimit(ctx context.Context, useCase string, limit AggregateLimit) ([]AggregateLimit, error) {
+	var res []AggregateLimit
+	err := c.do(ctx, http.MethodPut, "/api/aggregate/"+url.PathEscape(useCase), limit, &res)
+	return res, err
+}
+
+// History returns the recorded measurement series of a device
+func (c *Client) History(ctx context.Context, ski string) ([]HistoryInfo, error) {
+	var res []HistoryInfo
+	err := c.do(ctx, http.MethodGet, devicePath(ski, "/history"), nil, &res)
+	return res, err
+}
+
+// HistorySeries returns the measurements of a metric of a device between from and to,
+// zero times are unbounded. A positive interval averages the samples per interval.
+func (c *Client) HistorySeries(ctx context.Context, ski, useCase, metric string, from, to time.Time, interval time.Duration) (HistorySeries, error) {
+	query := url.Values{}
+	if !from.IsZero() {
+		query.Set("from", from.Format(time.RFC3339))
+	}
+	if !to.IsZero() {
+		query.Set("to", to.Format(time.RFC3339))
+	}
+	if interval > 0 {
+		query.Set("interval", interval.String())
+	}
+
+	path := devicePath(ski, "/history/", url.PathEscape(useCase), "/", url.PathEscape(metric))
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var res HistorySeries
+	err := c.do(ctx, http.MethodGet, path, nil, &res)
+	return res, err
+}
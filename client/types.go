@@ -0,0 +1,270 @@
+package client
+
+import "time"
+
+// Types of the ControlBox API as described in openapi.json
+
+// Device is a remote EEBUS device
+type Device struct {
+	SKI        string
+	Name       string
+	Identifier string
+	Brand      string
+	Type       string
+	Model      string
+	Serial     string
+	Connected  bool
+	UseCases   []string
+}
+
+// DeviceDetails is a remote EEBUS device including its use cases and entities
+type DeviceDetails struct {
+	Device
+	UseCaseInfos []UseCaseInfo
+	EntityInfos  []EntityInfo
+}
+
+// UseCaseInfo lists the use cases supported by an actor of the remote device
+type UseCaseInfo struct {
+	Actor string
+	Names []string
+}
+
+// EntityInfo describes an entity of the remote device
+type EntityInfo struct {
+	Address  string
+	Name     string
+	SKI      string
+	Type     string
+	Features []string
+}
+
+// LoadLimit is an LPC or LPP limit, the duration is given in seconds
+type LoadLimit struct {
+	IsActive       bool
+	Value          float64
+	Duration       int64
+	IsChangeable   bool
+	DeleteDuration bool
+}
+
+// LimitState is the LPC or LPP limit state of a device or of one of its
+// entities. The state of a device is that of its first entity, Entities
+// lists the state of every entity.
+type LimitState struct {
+	Entity           string `json:",omitempty"`
+	Limit            LoadLimit
+	FailsafeValue    float64      // W
+	FailsafeDuration float64      // seconds
+	NominalMax       float64      // W
+	Entities         []LimitState `json:",omitempty"`
+}
+
+// Measurements holds the MPC or MGCP values of a device, unavailable values are nil
+type Measurements struct {
+	PowerLimitationFactor *float64
+	Power                 *float64
+	PowerPerPhase         []float64
+	EnergyFeedIn          *float64
+	EnergyConsumed        *float64
+	CurrentPerPhase       []float64
+	VoltagePerPhase       []float64
+	Frequency             *float64
+}
+
+// PendingTrust is a pairing request waiting for an operator decision
+type PendingTrust struct {
+	SKI   string
+	Since time.Time
+}
+
+// TrustInfo lists the trusted and denied SKIs and pending pairing requests
+type TrustInfo struct {
+	Trusted []string
+	Denied  []string
+	Pending []PendingTrust
+}
+
+// PairingTransition is a single change of the SHIP pairing state
+type PairingTransition struct {
+	State     string
+	ShipState string
+	Error     string
+	Time      time.Time
+}
+
+// PairingStatus is the pairing state of a device, State is one of none,
+// queued, initiated, received-trust, trusted, denied or error
+type PairingStatus struct {
+	SKI            string
+	ShipID         string
+	State          string
+	ShipState      string
+	Error          string
+	LastTransition time.Time
+	History        []PairingTransition
+}
+
+// HeartbeatStatus is the heartbeat received from a device for a use case
+type HeartbeatStatus struct {
+	SKI          string
+	UseCase      string
+	LastReceived time.Time
+	Lost         bool
+}
+
+// HeartbeatInfo is the state of the own heartbeat per use case and of all remote heartbeats
+type HeartbeatInfo struct {
+	Sending map[string]bool
+	Remote  []HeartbeatStatus
+}
+
+// FailsafeTransition is a single change of the derived failsafe state
+type FailsafeTransition struct {
+	State string
+	Time  time.Time
+}
+
+// FailsafeStatus is the derived state of an LPC or LPP entity, State is one
+// of init, limited, unlimited or failsafe
+type FailsafeStatus struct {
+	SKI     string
+	Entity  string
+	UseCase string
+	State   string
+	Since   time.Time
+	History []FailsafeTransition
+}
+
+// WriteResult is the state of a write to a single entity, Status is one of
+// pending, accepted, rejected, timeout or failed
+type WriteResult struct {
+	ID          string
+	SKI         string
+	Entity      string
+	UseCase     string
+	Field       string
+	MsgCounter  uint64
+	Status      string
+	ErrorNumber uint
+	Description string
+	Time        time.Time
+}
+
+// ReconcileStatus compares the desired and the reported limit of a device,
+// State is one of pending, retrying, in-sync or exhausted
+type ReconcileStatus struct {
+	SKI         string
+	UseCase     string
+	Desired     LoadLimit
+	Reported    *LoadLimit
+	State       string
+	Attempts    int
+	MaxAttempts int
+	NextAttempt time.Time
+	Since       time.Time
+}
+
+// Strategies to split an aggregate limit across devices
+const (
+	StrategyEqual        = "equal"
+	StrategyProportional = "proportional"
+	StrategyPriority     = "priority"
+)
+
+// AggregateLimit is a limit for all devices of a use case and its share per device
+type AggregateLimit struct {
+	UseCase  string
+	IsActive bool
+	Value    float64 // W
+	Duration int64   // s
+	Strategy string
+	Priority []string           `json:",omitempty"` // SKIs in descending priority
+	Since    time.Time          `json:",omitempty"`
+	Shares   map[string]float64 `json:",omitempty"` // W per SKI
+}
+
+// GridControlStatus is the configuration and last decision of the grid connection point controller
+type GridControlStatus struct {
+	Enabled    bool
+	DryRun     bool
+	SKI        string
+	Threshold  float64 // W
+	Hysteresis float64 // W
+	HoldTime   int64   // s
+	MinLimit   float64 // W
+
+	Power      float64 // W
+	Active     bool
+	Limit      float64 // W
+	LastChange time.Time
+	Decision   string
+}
+
+// Schedule is a time based LPC or LPP limit of a device. Either Weekdays
+// (sun, mon, ...) with Start and End as HH:MM in the local time of the
+// server, or From and To for a one-off window are required.
+type Schedule struct {
+	ID      string
+	SKI     string
+	UseCase string
+	Value   float64 // W
+	Enabled bool
+
+	Weekdays []string   `json:",omitempty"`
+	Start    string     `json:",omitempty"`
+	End      string     `json:",omitempty"`
+	From     *time.Time `json:",omitempty"`
+	To       *time.Time `json:",omitempty"`
+}
+
+type heartbeatRequest struct {
+	Sending bool
+}
+
+type trustRequest struct {
+	Trusted bool
+}
+
+type valueRequest struct {
+	Value float64
+}
+
+// Sample is a measurement at a point in time, values per phase for the per phase metrics
+type Sample struct {
+	Time   time.Time
+	Values []float64
+}
+
+// HistorySeries is the history of a metric, optionally averaged over intervals
+type HistorySeries struct {
+	SKI      string
+	UseCase  string
+	Metric   string
+	Interval int64 // s
+	Samples  []Sample
+}
+
+// HistoryInfo describes an available measurement series of a device
+type HistoryInfo struct {
+	UseCase string
+	Metric  string
+	Samples int
+	From    time.Time
+	To      time.Time
+}
+
+// ValidationError is a violated rule of a limit or failsafe value
+type ValidationError struct {
+	Field   string
+	Rule    string
+	Value   float64
+	Bound   float64
+	SKI     string
+	Message string
+}
+
+type errorResponse struct {
+	Error      string
+	Violations []ValidationError
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"controlbox/client"
+
+	shipapi "github.com/enbility/ship-go/api"
+)
+
+// apiRecorder records the routes the client requests and the last response body
+type apiRecorder struct {
+	patterns map[string]bool
+	body     []byte
+
+	mutex sync.Mutex
+}
+
+type bodyRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bodyRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (a *apiRecorder) handler(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &bodyRecorder{ResponseWriter: w}
+		// the mux sets the matched pattern on the request
+		mux.ServeHTTP(recorder, r)
+
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		a.patterns[r.Pattern] = true
+		a.body = recorder.body.Bytes()
+	})
+}
+
+// strict decodes the last response into the type of a client result, fields the
+// client does not know fail the test
+func strict[T any](t *testing.T, a *apiRecorder, _ T) {
+	t.Helper()
+	a.mutex.Lock()
+	body := a.body
+	a.mutex.Unlock()
+
+	var v T
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&v); err != nil {
+		t.Errorf("response %s does not match %T: %v", body, v, err)
+	}
+}
+
+// statusCode returns the status code of a client error, 0 for no error
+func statusCode(err error) int {
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
+// newTestClient returns a client for the API of a ControlBox serving LPC and
+// LPP, knowing the device ski with a nominal maximum of 5000 W for both
+func newTestClient(t *testing.T) (*controlbox, *client.Client, *apiRecorder) {
+	h := newHeartbeatTestControlbox(t, "LPC", "LPP")
+	h.isConnected = map[string]bool{"ski": true}
+	h.failsafe = map[string]FailsafeStatus{}
+	h.limits = newLimitStore()
+	h.writeResults = newWriteResultStore()
+	h.reconciler = newReconciler()
+	h.schedules = newScheduleStore()
+	h.gridControl = newGridController()
+	h.aggregates = newAggregateStore()
+	h.arbiter = newLimitArbiter()
+	h.history = newHistoryStore()
+
+	h.limits.update(limitKey{SKI: "ski", Entity: "[1]"}, func(limits *entityLimits) {
+		limits.ConsumptionNominalMax = 5000
+		limits.ProductionNominalMax = 5000
+	})
+
+	recorder := &apiRecorder{patterns: map[string]bool{}}
+	mux := http.NewServeMux()
+	setupApiRoutes(h, mux)
+	server := httptest.NewServer(recorder.handler(mux))
+	t.Cleanup(server.Close)
+
+	return h, client.New(server.URL), recorder
+}
+
+// TestClientRoundTrip runs every client call against the handlers of the API,
+// the responses must decode into the client types and the requested routes
+// must be the operations of openapi.json
+func TestClientRoundTrip(t *testing.T) {
+	h, c, recorder := newTestClient(t)
+	ctx := context.Background()
+
+	t.Run("devices", func(t *testing.T) {
+		devices, err := c.Devices(ctx)
+		if err != nil || len(devices) != 1 || devices[0].SKI != "ski" || !devices[0].Connected {
+			t.Errorf("got %+v and %v, want the connected device", devices, err)
+		}
+		strict(t, recorder, devices)
+
+		device, err := c.Device(ctx, "ski")
+		if err != nil || device.SKI != "ski" {
+			t.Errorf("got %+v and %v, want the device", device, err)
+		}
+		strict(t, recorder, device)
+
+		if _, err := c.Device(ctx, "other"); statusCode(err) != http.StatusNotFound {
+			t.Errorf("unknown device: got %v, want 404", err)
+		}
+		strict(t, recorder, struct{ Error string }{})
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		tests := []struct {
+			useCase     string
+			setLimit    func(context.Context, string, client.LoadLimit) (client.LimitState, error)
+			setValue    func(context.Context, string, float64) (client.LimitState, error)
+			setDuration func(context.Context, string, time.Duration) (client.LimitState, error)
+			get         func(context.Context, string) (client.LimitState, error)
+		}{
+			{"LPC", c.SetConsumptionLimit, c.SetConsumptionFailsafeValue, c.SetConsumptionFailsafeDuration, c.ConsumptionLimits},
+			{"LPP", c.SetProductionLimit, c.SetProductionFailsafeValue, c.SetProductionFailsafeDuration, c.ProductionLimits},
+		}
+
+		for _, tt := range tests {
+			state, err := tt.setLimit(client.WithCorrelationID(ctx, "id-"+tt.useCase), "ski", client.LoadLimit{IsActive: true, Value: 3000, Duration: 60})
+			if err != nil || !state.Limit.IsActive || state.Limit.Value != 3000 || state.Limit.Duration != 60 {
+				t.Errorf("%s limit: got %+v and %v, want 3000 W for 60 s", tt.useCase, state.Limit, err)
+			}
+			strict(t, recorder, state)
+
+			state, err = tt.setValue(ctx, "ski", 4000)
+			if err != nil || state.FailsafeValue != 4000 {
+				t.Errorf("%s failsafe value: got %v and %v, want 4000 W", tt.useCase, state.FailsafeValue, err)
+			}
+			strict(t, recorder, state)
+
+			state, err = tt.setDuration(ctx, "ski", 2*time.Hour)
+			if err != nil || state.FailsafeDuration != 7200 {
+				t.Errorf("%s failsafe duration: got %v and %v, want 7200 s", tt.useCase, state.FailsafeDuration, err)
+			}
+			strict(t, recorder, state)
+
+			state, err = tt.get(ctx, "ski")
+			if err != nil || state.Limit.Value != 3000 || state.NominalMax != 5000 {
+				t.Errorf("%s state: got %+v and %v, want the limit and nominal maximum", tt.useCase, state, err)
+			}
+			strict(t, recorder, state)
+
+			_, err = tt.setLimit(ctx, "ski", client.LoadLimit{IsActive: true, Value: 6000})
+			var apiErr *client.Error
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnprocessableEntity ||
+				len(apiErr.Violations) != 1 || apiErr.Violations[0].Rule != ruleNominalMax || apiErr.Violations[0].Bound != 5000 {
+				t.Errorf("%s invalid limit: got %v, want the nominal maximum violated", tt.useCase, err)
+			}
+			strict(t, recorder, struct {
+				Error      string
+				Violations []client.ValidationError
+			}{})
+
+			if _, err := tt.setLimit(client.WithValidationOverride(ctx), "ski", client.LoadLimit{IsActive: true, Value: 6000}); err != nil {
+				t.Errorf("%s override: got %v", tt.useCase, err)
+			}
+		}
+	})
+
+	t.Run("measurements", func(t *testing.T) {
+		// the device does not offer MPC and MGCP
+		if _, err := c.MPC(ctx, "ski"); statusCode(err) != http.StatusNotFound {
+			t.Errorf("MPC: got %v, want 404", err)
+		}
+		if _, err := c.MGCP(ctx, "ski"); statusCode(err) != http.StatusNotFound {
+			t.Errorf("MGCP: got %v, want 404", err)
+		}
+	})
+
+	t.Run("history", func(t *testing.T) {
+		h.history.record("ski", "MPC", "Power", 1200)
+
+		list, err := c.History(ctx, "ski")
+		if err != nil || len(list) != 1 || list[0].Metric != "Power" || list[0].Samples != 1 {
+			t.Errorf("got %+v and %v, want the power series", list, err)
+		}
+		strict(t, recorder, list)
+
+		series, err := c.HistorySeries(ctx, "ski", "MPC", "Power", time.Now().Add(-time.Hour), time.Now().Add(time.Minute), time.Minute)
+		if err != nil || len(series.Samples) != 1 || series.Samples[0].Values[0] != 1200 || series.Interval != 60 {
+			t.Errorf("got %+v and %v, want the averaged sample", series, err)
+		}
+		strict(t, recorder, series)
+	})
+
+	t.Run("failsafe", func(t *testing.T) {
+		h.mutex.Lock()
+		h.failsafe["ski/LPC/[1]"] = FailsafeStatus{SKI: "ski", Entity: "[1]", UseCase: "LPC", State: "limited", Since: time.Now()}
+		h.mutex.Unlock()
+
+		states, err := c.FailsafeStates(ctx)
+		if err != nil || len(states) != 1 || states[0].State != "limited" {
+			t.Errorf("got %+v and %v, want the limited entity", states, err)
+		}
+		strict(t, recorder, states)
+
+		states, err = c.DeviceFailsafeStates(ctx, "ski")
+		if err != nil || len(states) != 1 {
+			t.Errorf("device: got %+v and %v, want the limited entity", states, err)
+		}
+		strict(t, recorder, states)
+	})
+
+	t.Run("trust", func(t *testing.T) {
+		info, err := c.SetTrust(ctx, "ski", true)
+		if err != nil || !slices.Equal(info.Trusted, []string{"ski"}) {
+			t.Errorf("trust: got %+v and %v, want the device trusted", info, err)
+		}
+		strict(t, recorder, info)
+
+		info, err = c.SetTrust(ctx, "ski", false)
+		if err != nil || !slices.Equal(info.Denied, []string{"ski"}) {
+			t.Errorf("deny: got %+v and %v, want the device denied", info, err)
+		}
+
+		info, err = c.ForgetTrust(ctx, "ski")
+		if err != nil || len(info.Trusted) != 0 || len(info.Denied) != 0 {
+			t.Errorf("forget: got %+v and %v, want no decision", info, err)
+		}
+		strict(t, recorder, info)
+
+		info, err = c.Trust(ctx)
+		if err != nil || len(info.Denied) != 0 {
+			t.Errorf("got %+v and %v, want no decision", info, err)
+		}
+		strict(t, recorder, info)
+	})
+
+	t.Run("pairing", func(t *testing.T) {
+		h.updatePairingStatus("ski", shipapi.NewConnectionStateDetail(shipapi.ConnectionStateQueued, nil))
+
+		states, err := c.PairingStates(ctx)
+		if err != nil || len(states) != 1 || states[0].State != pairingStateQueued {
+			t.Errorf("got %+v and %v, want the queued pairing", states, err)
+		}
+		strict(t, recorder, states)
+
+		state, err := c.PairingState(ctx, "ski")
+		if err != nil || state.State != pairingStateQueued || len(state.History) == 0 {
+			t.Errorf("got %+v and %v, want the queued pairing", state, err)
+		}
+		strict(t, recorder, state)
+	})
+
+	t.Run("heartbeat", func(t *testing.T) {
+		info, err := c.SetHeartbeat(ctx, "LPC", true)
+		if err != nil || !info.Sending["LPC"] {
+			t.Errorf("got %+v and %v, want the heartbeat sent", info, err)
+		}
+		strict(t, recorder, info)
+
+		info, err = c.Heartbeat(ctx)
+		if err != nil || !info.Sending["LPP"] {
+			t.Errorf("got %+v and %v, want the shared heartbeat sent", info, err)
+		}
+		strict(t, recorder, info)
+
+		if _, err := c.SetHeartbeat(ctx, "MPC", true); statusCode(err) != http.StatusNotFound {
+			t.Errorf("unknown use case: got %v, want 404", err)
+		}
+	})
+
+	t.Run("writes", func(t *testing.T) {
+		// the device has no entities to write to
+		if _, err := c.WriteResults(ctx, "unknown"); statusCode(err) != http.StatusNotFound {
+			t.Errorf("got %v, want 404", err)
+		}
+
+		states, err := c.ReconcileStates(ctx)
+		if err != nil {
+			t.Errorf("reconcile: got %v", err)
+		}
+		strict(t, recorder, states)
+	})
+
+	t.Run("aggregate", func(t *testing.T) {
+		limits, err := c.SetAggregateLimit(ctx, "lpc", client.AggregateLimit{IsActive: true, Value: 8000, Duration: 60, Strategy: client.StrategyProportional})
+		if err != nil || len(limits) != 1 || limits[0].UseCase != "LPC" || limits[0].Duration != 60 || limits[0].Strategy != client.StrategyProportional {
+			t.Errorf("got %+v and %v, want the LPC limit for 60 s", limits, err)
+		}
+		strict(t, recorder, limits)
+
+		limits, err = c.AggregateLimits(ctx)
+		if err != nil || len(limits) != 1 || limits[0].Value != 8000 {
+			t.Errorf("got %+v and %v, want the LPC limit", limits, err)
+		}
+		strict(t, recorder, limits)
+
+		if _, err := c.SetAggregateLimit(ctx, "mpc", client.AggregateLimit{IsActive: true}); statusCode(err) != http.StatusNotFound {
+			t.Errorf("unknown use case: got %v, want 404", err)
+		}
+	})
+
+	t.Run("gridcontrol", func(t *testing.T) {
+		grid, err := c.GridControl(ctx)
+		if err != nil || grid.HoldTime != 60 {
+			t.Errorf("got %+v and %v, want the hold time in seconds", grid, err)
+		}
+		strict(t, recorder, grid)
+	})
+
+	t.Run("schedules", func(t *testing.T) {
+		schedule := client.Schedule{SKI: "ski", UseCase: "LPC", Value: 4000, Weekdays: []string{"mon"}, Start: "17:00", End: "20:00"}
+		created, err := c.CreateSchedule(ctx, schedule)
+		if err != nil || created.ID == "" || created.Start != "17:00" {
+			t.Fatalf("create: got %+v and %v, want the schedule with an ID", created, err)
+		}
+		strict(t, recorder, created)
+
+		created.Value = 3000
+		updated, err := c.UpdateSchedule(ctx, created)
+		if err != nil || updated.Value != 3000 {
+			t.Errorf("update: got %+v and %v, want 3000 W", updated, err)
+		}
+
+		got, err := c.Schedule(ctx, created.ID)
+		if err != nil || got.Value != 3000 || !slices.Equal(got.Weekdays, []string{"mon"}) {
+			t.Errorf("get: got %+v and %v, want the updated schedule", got, err)
+		}
+		strict(t, recorder, got)
+
+		list, err := c.Schedules(ctx)
+		if err != nil || len(list) != 1 {
+			t.Errorf("list: got %+v and %v, want one schedule", list, err)
+		}
+		strict(t, recorder, list)
+
+		schedule.Value = 6000
+		if _, err := c.CreateSchedule(ctx, schedule); statusCode(err) != http.StatusUnprocessableEntity {
+			t.Errorf("above the nominal maximum: got %v, want 422", err)
+		}
+
+		if err := c.DeleteSchedule(ctx, created.ID); err != nil {
+			t.Errorf("delete: got %v", err)
+		}
+		if _, err := c.Schedule(ctx, created.ID); statusCode(err) != http.StatusNotFound {
+			t.Errorf("deleted: got %v, want 404", err)
+		}
+	})
+
+	t.Run("spec", func(t *testing.T) {
+		var spec struct {
+			Paths map[string]map[string]json.RawMessage
+		}
+		if err := json.Unmarshal(openapiSpec, &spec); err != nil {
+			t.Fatal(err)
+		}
+		operations := []string{}
+		for path, item := range spec.Paths {
+			for method := range item {
+				if method != "parameters" {
+					operations = append(operations, strings.ToUpper(method)+" "+path)
+				}
+			}
+		}
+		slices.Sort(operations)
+
+		recorder.mutex.Lock()
+		requested := []string{}
+		for pattern := range recorder.patterns {
+			requested = append(requested, pattern)
+		}
+		recorder.mutex.Unlock()
+		slices.Sort(requested)
+
+		if !slices.Equal(requested, operations) {
+			t.Errorf("client requested\n%s\nopenapi.json describes\n%s", strings.Join(requested, "\n"), strings.Join(operations, "\n"))
+		}
+	})
+}
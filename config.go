@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	shipapi "github.com/enbility/ship-go/api"
+	"github.com/enbility/ship-go/mdns"
+	"github.com/enbility/spine-go/model"
+	"gopkg.in/yaml.v3"
+)
+
+// Device configuration
+//
+// The SHIP/SPINE identity, the heartbeat timeout, the mDNS settings and the
+// enabled use cases are read from the YAML file given by --config or
+// CONFIG_FILE, so ControlBox can impersonate different control boxes in
+// interoperability tests. Environment variables override the file, values
+// set in neither keep the defaults of the demo ControlBox.
+
+var useCaseNames = []string{"LPC", "LPP", "MGCP", "MPC"}
+
+var deviceCategories = map[string]shipapi.DeviceCategoryType{
+	"GridConnectionHub":      shipapi.DeviceCategoryTypeGridConnectionHub,
+	"EnergyManagementSystem": shipapi.DeviceCategoryTypeEnergyManagementSystem,
+	"EMobility":              shipapi.DeviceCategoryTypeEMobility,
+	"HVAC":                   shipapi.DeviceCategoryTypeHVAC,
+	"Inverter":               shipapi.DeviceCategoryTypeInverter,
+	"DomesticAppliance":      shipapi.DeviceCategoryTypeDomesticAppliance,
+	"Metering":               shipapi.DeviceCategoryTypeMetering,
+}
+
+// SPINE device types
+var deviceTypes = []model.DeviceTypeType{
+	model.DeviceTypeTypeDishwasher,
+	model.DeviceTypeTypeDryer,
+	model.DeviceTypeTypeEnvironmentSensor,
+	model.DeviceTypeTypeGeneric,
+	model.DeviceTypeTypeHeatgenerationSystem,
+	model.DeviceTypeTypeHeatsinkSystem,
+	model.DeviceTypeTypeHeatstorageSystem,
+	model.DeviceTypeTypeHVACController,
+	model.DeviceTypeTypeSubmeter,
+	model.DeviceTypeTypeWasher,
+	model.DeviceTypeTypeElectricitySupplySystem,
+	model.DeviceTypeTypeEnergyManagementSystem,
+	model.DeviceTypeTypeInverter,
+	model.DeviceTypeTypeChargingStation,
+}
+
+// SPINE entity types, except DeviceInformation which every device has already
+var entityTypes = []model.EntityTypeType{
+	model.EntityTypeTypeBattery,
+	model.EntityTypeTypeCompressor,
+	model.EntityTypeTypeDHWCircuit,
+	model.EntityTypeTypeDHWStorage,
+	model.EntityTypeTypeDishwasher,
+	model.EntityTypeTypeDryer,
+	model.EntityTypeTypeElectricalImmersionHeater,
+	model.EntityTypeTypeFan,
+	model.EntityTypeTypeGasHeatingAppliance,
+	model.EntityTypeTypeGeneric,
+	model.EntityTypeTypeHeatingBufferStorage,
+	model.EntityTypeTypeHeatingCircuit,
+	model.EntityTypeTypeHeatingObject,
+	model.EntityTypeTypeHeatingZone,
+	model.EntityTypeTypeHeatPumpAppliance,
+	model.EntityTypeTypeHeatSinkCircuit,
+	model.EntityTypeTypeHeatSourceCircuit,
+	model.EntityTypeTypeHeatSourceUnit,
+	model.EntityTypeTypeHvacController,
+	model.EntityTypeTypeHvacRoom,
+	model.EntityTypeTypeInstantDHWheater,
+	model.EntityTypeTypeInverter,
+	model.EntityTypeTypeOilHeatingAppliance,
+	model.EntityTypeTypePump,
+	model.EntityTypeTypeRefrigerantCircuit,
+	model.EntityTypeTypeSmartEnergyAppliance,
+	model.EntityTypeTypeSolarDHWStorage,
+	model.EntityTypeTypeSolarThermalCircuit,
+	model.EntityTypeTypeSubMeterElectricity,
+	model.EntityTypeTypeTemperatureSensor,
+	model.EntityTypeTypeWasher,
+	model.EntityTypeTypeBatterySystem,
+	model.EntityTypeTypeElectricityGenerationSystem,
+	model.EntityTypeTypeElectricityStorageSystem,
+	model.EntityTypeTypeGridConnectionPointOfPremises,
+	model.EntityTypeTypeHousehold,
+	model.EntityTypeTypePVSystem,
+	model.EntityTypeTypeEV,
+	model.EntityTypeTypeEVSE,
+	model.EntityTypeTypeChargingOutlet,
+	model.EntityTypeTypeCEM,
+	model.EntityTypeTypePV,
+	model.EntityTypeTypePVESHybrid,
+	model.EntityTypeTypeElectricalStorage,
+	model.EntityTypeTypePVString,
+	model.EntityTypeTypeGridGuard,
+	model.EntityTypeTypeControllableSystem,
+}
+
+var mdnsProviders = map[string]mdns.MdnsProviderSelection{
+	"all":      mdns.MdnsProviderSelectionAll,
+	"avahi":    mdns.MdnsProviderSelectionAvahiOnly,
+	"zeroconf": mdns.MdnsProviderSelectionGoZeroConfOnly,
+}
+
+// deviceConfig is the config file, keys are matched case-insensitively
+type deviceConfig struct {
+	Device struct {
+		Vendor              string
+		Brand               string
+		Model               string
+		Serial              string
+		AlternateIdentifier string
+		Categories          []string
+		Type                string
+		EntityType          string
+	}
+
+	// timeout announced with the own heartbeat
+	HeartbeatTimeout string
+
+	MDNS struct {
+		// network interfaces to announce the service on, all if empty
+		Interfaces []string
+		// all, avahi or zeroconf
+		Provider string
+	}
+
+	UseCases []string
+
+	// parsed values
+	heartbeatTimeout time.Duration
+	categories       []shipapi.DeviceCategoryType
+	mdnsProvider     mdns.MdnsProviderSelection
+}
+
+func defaultDeviceConfig() *deviceConfig {
+	c := &deviceConfig{}
+	c.Device.Vendor = "Demo"
+	c.Device.Brand = "Demo"
+	c.Device.Model = "ControlBox"
+	c.Device.Serial = "123456789"
+	c.Device.Categories = []string{"GridConnectionHub"}
+	c.Device.Type = string(model.DeviceTypeTypeElectricitySupplySystem)
+	c.Device.EntityType = string(model.EntityTypeTypeGridGuard)
+	c.HeartbeatTimeout = "10s"
+	c.MDNS.Provider = "all"
+	c.UseCases = slices.Clone(useCaseNames)
+	return c
+}
+
+// loadDeviceConfig reads the config file, if any, and applies the environment overrides
+func loadDeviceConfig(path string) (*deviceConfig, error) {
+	c := defaultDeviceConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var document yaml.Node
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		values, err := yamlValue(&document)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		// the parsed YAML is decoded like JSON to reuse the struct mapping
+		encoded, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(encoded))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(c); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	c.applyEnv()
+	if err := c.validate(); err != nil {
+		if path != "" {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// yamlValue converts a YAML node to maps, lists and strings. All config values
+// are strings, so scalars are kept as written, e.g. an unquoted serial number.
+func yamlValue(node *yaml.Node) (any, error) {
+	switch node.Kind {
+	case 0:
+		// empty document
+		return nil, nil
+	case yaml.DocumentNode:
+		return yamlValue(node.Content[0])
+	case yaml.AliasNode:
+		return yamlValue(node.Alias)
+	case yaml.SequenceNode:
+		list := []any{}
+		for _, item := range node.Content {
+			value, err := yamlValue(item)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case yaml.MappingNode:
+		values := map[string]any{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, item := node.Content[i], node.Content[i+1]
+			if key.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: keys must be scalars", key.Line)
+			}
+			value, err := yamlValue(item)
+			if err != nil {
+				return nil, err
+			}
+			values[key.Value] = value
+		}
+		return values, nil
+	default:
+		if node.ShortTag() == "!!null" {
+			return nil, nil
+		}
+		return node.Value, nil
+	}
+}
+
+func (c *deviceConfig) applyEnv() {
+	override := func(name string, value *string) {
+		if env := os.Getenv(name); env != "" {
+			*value = env
+		}
+	}
+	overrideList := func(name string, value *[]string) {
+		if env := os.Getenv(name); env != "" {
+			*value = splitList(env)
+		}
+	}
+
+	override("DEVICE_VENDOR", &c.Device.Vendor)
+	override("DEVICE_BRAND", &c.Device.Brand)
+	override("DEVICE_MODEL", &c.Device.Model)
+	override("DEVICE_SERIAL", &c.Device.Serial)
+	override("DEVICE_ALTERNATE_IDENTIFIER", &c.Device.AlternateIdentifier)
+	overrideList("DEVICE_CATEGORIES", &c.Device.Categories)
+	override("DEVICE_TYPE", &c.Device.Type)
+	override("DEVICE_ENTITY_TYPE", &c.Device.EntityType)
+	override("HEARTBEAT_TIMEOUT", &c.HeartbeatTimeout)
+	overrideList("MDNS_INTERFACES", &c.MDNS.Interfaces)
+	override("MDNS_PROVIDER", &c.MDNS.Provider)
+	overrideList("USE_CASES", &c.UseCases)
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (c *deviceConfig) validate() error {
+	if c.Device.AlternateIdentifier == "" {
+		c.Device.AlternateIdentifier = "ControlBox Simulator SN-" + c.Device.Serial
+	}
+
+	c.categories = nil
+	for _, name := range c.Device.Categories {
+		category, ok := deviceCategories[name]
+		if !ok {
+			return fmt.Errorf("unknown device category %s", name)
+		}
+		c.categories = append(c.categories, category)
+	}
+	if !slices.Contains(deviceTypes, model.DeviceTypeType(c.Device.Type)) {
+		return fmt.Errorf("unknown device type %q, supported are %s", c.Device.Type, joinTypes(deviceTypes))
+	}
+	if !slices.Contains(entityTypes, c.entityType()) {
+		return fmt.Errorf("unknown entity type %q, supported are %s", c.Device.EntityType, joinTypes(entityTypes))
+	}
+
+	timeout, err := time.ParseDuration(c.HeartbeatTimeout)
+	if err != nil || timeout <= 0 {
+		return fmt.Errorf("invalid heartbeat timeout %s", c.HeartbeatTimeout)
+	}
+	c.heartbeatTimeout = timeout
+
+	provider, ok := mdnsProviders[strings.ToLower(c.MDNS.Provider)]
+	if !ok {
+		return fmt.Errorf("mDNS provider must be all, avahi or zeroconf")
+	}
+	c.mdnsProvider = provider
+
+	for i, useCase := range c.UseCases {
+		c.UseCases[i] = strings.ToUpper(useCase)
+		if !slices.Contains(useCaseNames, c.UseCases[i]) {
+			return fmt.Errorf("unknown use case %s, supported are %s", useCase, strings.Join(useCaseNames, ", "))
+		}
+	}
+
+	return nil
+}
+
+func joinTypes[T ~string](types []T) string {
+	names := make([]string, len(types))
+	for i, name := range types {
+		names[i] = string(name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (c *deviceConfig) useCaseEnabled(useCase string) bool {
+	return slices.Contains(c.UseCases, useCase)
+}
+
+func (c *deviceConfig) entityType() model.EntityTypeType {
+	return model.EntityTypeType(c.Device.EntityType)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLoadDeviceConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		env     map[string]string
+		check   func(t *testing.T, c *deviceConfig)
+		wantErr bool
+	}{
+		{
+			name:    "empty file keeps the defaults",
+			content: "# nothing configured\n",
+			check: func(t *testing.T, c *deviceConfig) {
+				if c.Device.Model != "ControlBox" || c.heartbeatTimeout != 10*time.Second {
+					t.Errorf("got model %s and timeout %v, want the defaults", c.Device.Model, c.heartbeatTimeout)
+				}
+				if c.Device.AlternateIdentifier != "ControlBox Simulator SN-123456789" {
+					t.Errorf("got alternate identifier %q", c.Device.AlternateIdentifier)
+				}
+			},
+		},
+		{
+			name: "identity",
+			content: `
+device:
+  vendor: ACME
+  model: Box
+  serial: 987654321   # unquoted number
+  categories: [EnergyManagementSystem, Metering]
+  type: EnergyManagementSystem
+  entityType: CEM
+heartbeatTimeout: 30s
+mdns:
+  interfaces:
+    - eth0
+  provider: Avahi
+useCases:
+  - lpc
+  - MPC
+`,
+			check: func(t *testing.T, c *deviceConfig) {
+				if c.Device.Vendor != "ACME" || c.Device.Serial != "987654321" || c.Device.EntityType != "CEM" {
+					t.Errorf("got device %+v", c.Device)
+				}
+				if len(c.categories) != 2 || c.heartbeatTimeout != 30*time.Second {
+					t.Errorf("got categories %v and timeout %v", c.categories, c.heartbeatTimeout)
+				}
+				if !slices.Equal(c.MDNS.Interfaces, []string{"eth0"}) || c.mdnsProvider != mdnsProviders["avahi"] {
+					t.Errorf("got mDNS %+v", c.MDNS)
+				}
+				if !slices.Equal(c.UseCases, []string{"LPC", "MPC"}) {
+					t.Errorf("got use cases %v", c.UseCases)
+				}
+			},
+		},
+		{
+			name:    "keys are case-insensitive",
+			content: "Device:\n  Vendor: ACME\nUSECASES: [LPP]\n",
+			check: func(t *testing.T, c *deviceConfig) {
+				if c.Device.Vendor != "ACME" || !slices.Equal(c.UseCases, []string{"LPP"}) {
+					t.Errorf("got vendor %s and use cases %v", c.Device.Vendor, c.UseCases)
+				}
+			},
+		},
+		{
+			name:    "environment overrides the file",
+			content: "device:\n  type: Inverter\n  entityType: Inverter\n",
+			env:     map[string]string{"DEVICE_TYPE": "ChargingStation", "DEVICE_ENTITY_TYPE": "EVSE", "USE_CASES": "lpc, lpp"},
+			check: func(t *testing.T, c *deviceConfig) {
+				if c.Device.Type != "ChargingStation" || c.entityType() != "EVSE" {
+					t.Errorf("got type %s and entity type %s", c.Device.Type, c.Device.EntityType)
+				}
+				if !slices.Equal(c.UseCases, []string{"LPC", "LPP"}) {
+					t.Errorf("got use cases %v", c.UseCases)
+				}
+			},
+		},
+		{name: "unknown key", content: "device:\n  colour: red\n", wantErr: true},
+		{name: "unknown device type", content: "device:\n  type: ElectricitySupplySytem\n", wantErr: true},
+		{name: "unknown entity type", content: "device:\n  entityType: GridGaurd\n", wantErr: true},
+		{name: "device information entity type", content: "device:\n  entityType: DeviceInformation\n", wantErr: true},
+		{name: "unknown category", content: "device:\n  categories: [Grid]\n", wantErr: true},
+		{name: "unknown use case", content: "useCases: [LPC, VABD]\n", wantErr: true},
+		{name: "invalid heartbeat timeout", content: "heartbeatTimeout: 0s\n", wantErr: true},
+		{name: "unknown mDNS provider", content: "mdns:\n  provider: bonjour\n", wantErr: true},
+		{name: "list instead of a mapping", content: "device: [a, b]\n", wantErr: true},
+		{name: "syntax error", content: "device:\n  vendor: [ACME\n", wantErr: true},
+		{name: "tab indentation", content: "device:\n\tvendor: ACME\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"DEVICE_TYPE", "DEVICE_ENTITY_TYPE", "USE_CASES"} {
+				t.Setenv(name, tt.env[name])
+			}
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := loadDeviceConfig(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && tt.check != nil {
+				tt.check(t, c)
+			}
+		})
+	}
+}
+
+func TestLoadDeviceConfigExample(t *testing.T) {
+	c, err := loadDeviceConfig("config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := defaultDeviceConfig()
+	if err := want.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Device.Serial != want.Device.Serial || c.Device.Type != want.Device.Type || c.Device.EntityType != want.Device.EntityType {
+		t.Errorf("got device %+v, want the defaults %+v", c.Device, want.Device)
+	}
+	if !slices.Equal(c.UseCases, useCaseNames) {
+		t.Errorf("got use cases %v, want %v", c.UseCases, useCaseNames)
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"maps"
 	"os"
 	"slices"
-	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,11 +31,6 @@ import (
 	"github.com/enbility/spine-go/model"
 )
 
-type failsafeLimits struct {
-	Value    float64
-	Duration time.Duration
-}
-
 type controlbox struct {
 	myService *service.Service
 
@@ -41,28 +39,50 @@ type controlbox struct {
 	ucmgcp ucapi.MaMGCPInterface
 	ucmpc  ucapi.MaMPCInterface
 
-	isConnected map[string]bool
+	isConnected    map[string]bool
+	registeredSkis map[string]bool
+	deniedSkis     map[string]bool
+	pendingTrust   map[string]time.Time
+	shipIDs        map[string]string
+	pairingStatus  map[string]PairingStatus
+	heartbeats     map[string]HeartbeatStatus
+	failsafe       map[string]FailsafeStatus
+
+	// use cases whose own heartbeat was stopped
+	heartbeatStopped map[string]bool
 
 	remoteInfos  map[string]RemoteInfo
 	useCaseInfos map[string][]UseCaseInfo
 
-	consumptionLimits         ucapi.LoadLimit
-	productionLimits          ucapi.LoadLimit
-	consumptionFailsafeLimits failsafeLimits
-	productionFailsafeLimits  failsafeLimits
-	consumptionNominalMax     float64
-	productionNominalMax      float64
+	limits          *limitStore
+	writeResults    *writeResultStore
+	failsafeResults *resultDispatcher
+	reconciler      *reconciler
+	schedules       *scheduleStore
+	gridControl     *gridController
+	aggregates      *aggregateStore
+	arbiter         *limitArbiter
+	history         *historyStore
+
+	writeCounters *writeCounters
+	mqtt          *mqttBridge
+
+	config *deviceConfig
+
+	stateFile  string
+	persistC   chan struct{}
+	stateMutex sync.Mutex
 
 	currentRemoteServices []shipapi.RemoteService
 
 	mutex sync.Mutex
 }
 
-// resolveCertificate loads a TLS certificate from CERT_PEM / KEY_PEM.
+var errNoCertificate = errors.New("no certificate configured in CERT_PEM / KEY_PEM")
+
+// loadCertificate loads a TLS certificate from CERT_PEM / KEY_PEM.
 // OS environment variables are checked first; .env fills in any gaps.
-// If neither source provides values a self-signed certificate is generated,
-// persisted and returned so it is usable in the current run too.
-func resolveCertificate() (tls.Certificate, error) {
+func loadCertificate() (tls.Certificate, error) {
 	certPEM := os.Getenv("CERT_PEM")
 	keyPEM := os.Getenv("KEY_PEM")
 	if certPEM != "" && keyPEM != "" {
@@ -72,172 +92,351 @@ func resolveCertificate() (tls.Certificate, error) {
 		return tls.Certificate{}, fmt.Errorf(
 			"both CERT_PEM and KEY_PEM must be set together (only one is present)")
 	}
-
-	// Nothing configured — generate and persist.
-	return generateAndPersistCertificate()
+	return tls.Certificate{}, errNoCertificate
 }
 
-// generateAndPersistCertificate creates a self-signed certificate, encodes it
-// as inline PEM, appends CERT_PEM / KEY_PEM to .env for future runs, and
-// returns the certificate directly so it is usable in the current run too.
-func generateAndPersistCertificate() (tls.Certificate, error) {
-	const envPath = ".env"
-	log.Printf("No certificate configured — generating self-signed certificate")
+// resolveCertificate loads the configured certificate. If neither source
+// provides values a self-signed certificate is generated, persisted and
+// returned so it is usable in the current run too.
+func resolveCertificate(config *deviceConfig) (tls.Certificate, error) {
+	certificate, err := loadCertificate()
+	if errors.Is(err, errNoCertificate) {
+		// Nothing configured — generate and persist.
+		return generateAndPersistCertificate(config)
+	}
+	return certificate, err
+}
 
-	certTLS, err := cert.CreateCertificate("Demo", "Demo", "DE", "Demo-Unit-01")
+// newCertificate creates a self-signed certificate for the SHIP connections
+// with the brand, vendor, model and serial of the configured device
+func newCertificate(config *deviceConfig) (tls.Certificate, error) {
+	device := config.Device
+	certTLS, err := cert.CreateCertificate(device.Brand, device.Vendor, "DE", device.Model+"-"+device.Serial)
 	if err != nil {
 		return tls.Certificate{}, fmt.Errorf("generate certificate: %w", err)
 	}
+	return certTLS, nil
+}
+
+// certificateSKI returns the parsed leaf certificate and its SKI
+func certificateSKI(certTLS tls.Certificate) (*x509.Certificate, string, error) {
+	leaf, err := x509.ParseCertificate(certTLS.Certificate[0])
+	if err != nil {
+		return nil, "", fmt.Errorf("parse certificate: %w", err)
+	}
+	ski, err := cert.SkiFromCertificate(leaf)
+	if err != nil {
+		return nil, "", err
+	}
+	return leaf, ski, nil
+}
+
+// generateAndPersistCertificate creates a self-signed certificate, stores it
+// as inline PEM in CERT_PEM / KEY_PEM of .env for future runs, and returns
+// the certificate directly so it is usable in the current run too.
+func generateAndPersistCertificate(config *deviceConfig) (tls.Certificate, error) {
+	slog.Info("No certificate configured, generating a self-signed certificate")
 
-	// Encode certificate PEM
-	certPEMBytes := pem.EncodeToMemory(&pem.Block{
+	certTLS, err := newCertificate(config)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if err := persistCertificate(certTLS, certEnvFile); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	slog.Info("Certificate generated and persisted as CERT_PEM / KEY_PEM", "file", certEnvFile)
+	return certTLS, nil
+}
+
+// certEnvFile is the file the certificate is persisted to
+const certEnvFile = ".env"
+
+// encodeCertificate returns the certificate and its private key as PEM
+func encodeCertificate(certTLS tls.Certificate) (certPEM, keyPEM []byte, err error) {
+	certPEM = pem.EncodeToMemory(&pem.Block{
 		Type:  "CERTIFICATE",
 		Bytes: certTLS.Certificate[0],
 	})
 
-	// Encode private key PEM
 	privKey, ok := certTLS.PrivateKey.(*ecdsa.PrivateKey)
 	if !ok {
-		return tls.Certificate{}, fmt.Errorf("unexpected private key type")
+		return nil, nil, fmt.Errorf("unexpected private key type")
 	}
 	keyBytes, err := x509.MarshalECPrivateKey(privKey)
 	if err != nil {
-		return tls.Certificate{}, fmt.Errorf("marshal private key: %w", err)
+		return nil, nil, fmt.Errorf("marshal private key: %w", err)
 	}
-	keyPEMBytes := pem.EncodeToMemory(&pem.Block{
+	keyPEM = pem.EncodeToMemory(&pem.Block{
 		Type:  "EC PRIVATE KEY",
 		Bytes: keyBytes,
 	})
 
-	// Write CERT_PEM / KEY_PEM to .env — if we got here they were absent.
-	// godotenv.Write handles quoting/escaping; multi-line PEM is stored as-is.
-	if err := godotenv.Write(map[string]string{
-		"CERT_PEM": string(certPEMBytes),
-		"KEY_PEM":  string(keyPEMBytes),
-	}, envPath); err != nil {
-		return tls.Certificate{}, fmt.Errorf("write %s: %w", envPath, err)
-	}
-
-	log.Printf("Certificate generated and persisted to %s as CERT_PEM / KEY_PEM", envPath)
-	return certTLS, nil
+	return certPEM, keyPEM, nil
 }
 
-func (h *controlbox) run() {
-	port, err := strconv.Atoi(os.Args[1])
+// persistCertificate writes CERT_PEM / KEY_PEM to the given env file, other
+// settings of the file are kept. godotenv.Write handles quoting/escaping;
+// multi-line PEM is stored as-is.
+func persistCertificate(certTLS tls.Certificate, envPath string) error {
+	certPEM, keyPEM, err := encodeCertificate(certTLS)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	certificate, err := resolveCertificate()
+	env, err := godotenv.Read(envPath)
+	if errors.Is(err, os.ErrNotExist) {
+		env = map[string]string{}
+	} else if err != nil {
+		return fmt.Errorf("read %s: %w", envPath, err)
+	}
+	env["CERT_PEM"] = string(certPEM)
+	env["KEY_PEM"] = string(keyPEM)
+
+	if err := godotenv.Write(env, envPath); err != nil {
+		return fmt.Errorf("write %s: %w", envPath, err)
+	}
+	return nil
+}
+
+func (h *controlbox) run(port int, config *deviceConfig) {
+	certificate, err := resolveCertificate(config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	vendorCode := "Demo"
-	deviceBrand := "Demo"
-	deviceModel := "ControlBox"
-	serialNumber := "123456789"
-	altIdentifier := "ControlBox Simulator SN-" + serialNumber
-
+	h.config = config
 	h.isConnected = map[string]bool{}
-
+	h.registeredSkis = map[string]bool{}
+	h.deniedSkis = map[string]bool{}
+	h.pendingTrust = map[string]time.Time{}
+	h.shipIDs = map[string]string{}
+	h.pairingStatus = map[string]PairingStatus{}
+	h.heartbeats = map[string]HeartbeatStatus{}
+	h.heartbeatStopped = map[string]bool{}
+	h.failsafe = map[string]FailsafeStatus{}
+	h.limits = newLimitStore()
+	h.writeResults = newWriteResultStore()
+	h.failsafeResults = newResultDispatcher()
+	h.reconciler = newReconciler()
+	h.schedules = newScheduleStore()
+	h.gridControl = newGridController()
+	h.aggregates = newAggregateStore()
+	h.arbiter = newLimitArbiter()
+	h.history = newHistoryStore()
+	h.writeCounters = newWriteCounters()
+	h.mqtt = h.newMQTTBridge()
+	h.stateFile = stateFile()
+	h.persistC = make(chan struct{}, 1)
+
+	device := config.Device
 	configuration, err := api.NewConfiguration(
-		vendorCode, deviceBrand, deviceModel, serialNumber,
-		[]shipapi.DeviceCategoryType{shipapi.DeviceCategoryTypeGridConnectionHub},
-		model.DeviceTypeTypeElectricitySupplySystem,
-		[]model.EntityTypeType{model.EntityTypeTypeGridGuard},
-		port, certificate, time.Second*10)
+		device.Vendor, device.Brand, device.Model, device.Serial,
+		config.categories,
+		model.DeviceTypeType(device.Type),
+		[]model.EntityTypeType{config.entityType()},
+		port, certificate, config.heartbeatTimeout)
 	if err != nil {
 		log.Fatal(err)
 	}
-	configuration.SetAlternateIdentifier(altIdentifier)
+	configuration.SetAlternateIdentifier(device.AlternateIdentifier)
+	configuration.SetInterfaces(config.MDNS.Interfaces)
+	configuration.SetMdnsProviderSelection(config.mdnsProvider)
+
+	slog.Info("Device", "brand", device.Brand, "model", device.Model, "serial", device.Serial, "usecases", strings.Join(config.UseCases, ","))
 
 	h.myService = service.NewService(configuration, h)
 	h.myService.SetLogging(h)
 
 	if err = h.myService.Setup(); err != nil {
-		fmt.Println(err)
+		slog.Error("Service setup failed", "error", err)
 		return
 	}
 
-	localEntity := h.myService.LocalDevice().EntityForType(model.EntityTypeTypeGridGuard)
-	h.uclpc = lpc.NewLPC(localEntity, h.OnLPCEvent)
-	h.myService.AddUseCase(h.uclpc)
-
-	h.uclpp = lpp.NewLPP(localEntity, h.OnLPPEvent)
-	h.myService.AddUseCase(h.uclpp)
-
-	h.ucmgcp = mgcp.NewMGCP(localEntity, h.OnMGCPEvent)
-	h.myService.AddUseCase(h.ucmgcp)
+	localEntity := h.myService.LocalDevice().EntityForType(config.entityType())
+	// disabled use cases are not created, so they are neither announced nor
+	// bound to remote devices and their fields stay nil
+	if config.useCaseEnabled("LPC") {
+		h.uclpc = lpc.NewLPC(localEntity, h.OnLPCEvent)
+		h.myService.AddUseCase(h.uclpc)
+	}
+	if config.useCaseEnabled("LPP") {
+		h.uclpp = lpp.NewLPP(localEntity, h.OnLPPEvent)
+		h.myService.AddUseCase(h.uclpp)
+	}
+	if config.useCaseEnabled("MGCP") {
+		h.ucmgcp = mgcp.NewMGCP(localEntity, h.OnMGCPEvent)
+		h.myService.AddUseCase(h.ucmgcp)
+	}
+	if config.useCaseEnabled("MPC") {
+		h.ucmpc = mpc.NewMPC(localEntity, h.OnMPCEvent)
+		h.myService.AddUseCase(h.ucmpc)
+	}
+	for _, name := range useCaseNames {
+		if !config.useCaseEnabled(name) {
+			slog.Info("Use case disabled", "usecase", name)
+		}
+	}
 
-	h.ucmpc = mpc.NewMPC(localEntity, h.OnMPCEvent)
-	h.myService.AddUseCase(h.ucmpc)
+	// the failsafe writes of LPC and LPP are answered to this feature
+	h.failsafeResults.register(localEntity.FeatureOfTypeAndRole(model.FeatureTypeTypeDeviceConfiguration, model.RoleTypeClient))
 
 	h.remoteInfos = map[string]RemoteInfo{}
 	h.useCaseInfos = map[string][]UseCaseInfo{}
 
+	h.restoreState()
+	h.applyTrustConfig()
+	h.myService.UserIsAbleToApproveOrCancelPairingRequests(true)
+	h.limits.onChange = h.limitsChanged
+	go h.runPersistence()
+	go h.runHeartbeatMonitor()
+	go h.runReconciliation()
+	go h.runScheduler()
+	go h.runDistribution()
+	h.startGridControl()
+	h.mqtt.start()
+
 	h.myService.Start()
 }
 
 // EEBUSServiceHandler
 
 func (h *controlbox) RemoteSKIConnected(service api.ServiceInterface, ski string) {
-	remoteSki = ski
-	fmt.Println("RemoteSKIConnected: " + ski)
+	slog.Info("Remote device connected", "ski", ski)
+
+	h.mutex.Lock()
 	h.isConnected[ski] = true
+	h.mutex.Unlock()
+
+	h.mqtt.publish(ski+"/Connected", true, true)
 
-	frontend.sendText(SelectService, ski)
+	frontend.suggestService(ski)
 }
 
 func (h *controlbox) RemoteSKIDisconnected(service api.ServiceInterface, ski string) {
-	fmt.Println("RemoteSKIDisconnected: " + ski)
+	slog.Info("Remote device disconnected", "ski", ski)
+
+	h.mutex.Lock()
 	h.isConnected[ski] = false
+	h.mutex.Unlock()
+
+	h.mqtt.publish(ski+"/Connected", false, true)
+
+	// the share of the device is redistributed
+	go h.distributeAggregates(false)
 
 	frontend.sendNotification("", ServiceListChanged, "")
 }
 
 func (h *controlbox) VisibleRemoteServicesUpdated(service api.ServiceInterface, entries []shipapi.RemoteService) {
-	fmt.Print("VisibleRemoteServicesUpdated, count: ")
-	fmt.Println(len(entries))
+	slog.Debug("Visible remote services updated", "count", len(entries))
 
 	for _, element := range entries {
-		fmt.Println("Remote SKI: " + element.Ski)
-		service := h.myService.RemoteServiceForSKI(element.Ski)
-		service.SetTrusted(true)
+		slog.Debug("Visible remote service", "ski", element.Ski)
 	}
 
+	h.mutex.Lock()
 	h.currentRemoteServices = entries
+	h.mutex.Unlock()
 
 	frontend.sendNotification("", ServiceListChanged, "")
 }
 
+// remoteServices returns a copy of the visible remote services
+func (h *controlbox) remoteServices() []shipapi.RemoteService {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return slices.Clone(h.currentRemoteServices)
+}
+
 func (h *controlbox) ServiceShipIDUpdate(ski string, shipdID string) {
+	h.mutex.Lock()
+	h.shipIDs[ski] = shipdID
+	h.mutex.Unlock()
+
+	h.updatePairingShipID(ski, shipdID)
+	h.persist()
 }
 
 func (h *controlbox) ServicePairingDetailUpdate(ski string, detail *shipapi.ConnectionStateDetail) {
-	if ski == remoteSki && detail.State() == shipapi.ConnectionStateRemoteDeniedTrust {
-		fmt.Println("The remote service denied trust. Exiting.")
-		h.myService.CancelPairingWithSKI(ski)
-		h.myService.UnregisterRemoteSKI(ski)
-		h.myService.Shutdown()
-		os.Exit(1)
+	h.updatePairingStatus(ski, detail)
+
+	if detail.State() == shipapi.ConnectionStateRemoteDeniedTrust {
+		h.remoteDeniedTrust(ski)
+	}
+
+	if detail.State() == shipapi.ConnectionStateReceivedPairingRequest {
+		h.handlePairingRequest(ski)
+	} else {
+		h.clearPendingTrust(ski, detail.State())
 	}
 
 	frontend.sendNotification("", ServiceListChanged, "")
 }
 
 func (h *controlbox) AllowWaitingForTrust(ski string) bool {
-	//return ski == remoteSki
-	fmt.Println("AllowWaitingForTrust: " + ski)
+	slog.Debug("Allow waiting for trust", "ski", ski)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.trustPolicyForSKI(ski) != trustDenied
+}
+
+// selectService reads the current data of a remote device again. Selecting a
+// device is a pure view filter of the frontend, it neither restricts which
+// devices are served nor does it pair the device, see trustService.
+func (h *controlbox) selectService(ski string) {
+	if ski == "" {
+		return
+	}
+
+	h.mutex.Lock()
+	info, exists := h.remoteInfos[ski]
+	useCases := slices.Clone(info.UseCases)
+	h.mutex.Unlock()
+
+	if exists && info.Device != nil {
+		for _, entity := range info.Device.Entities() {
+			readData(h, entity, useCases)
+		}
+	}
+}
+
+// eventReceived records the device and use case of an event and sends the
+// changed infos to the frontend. Events of devices which are not connected
+// are ignored. The frontend is written to without holding the mutex, so a
+// slow client does not block the events of other devices.
+func (h *controlbox) eventReceived(ski string, device spineapi.DeviceRemoteInterface, uc string) bool {
+	h.mutex.Lock()
+	if !h.isConnected[ski] {
+		h.mutex.Unlock()
+		slog.Debug("Event ignored, device not connected", "ski", ski, "usecase", uc)
+		return false
+	}
+
+	h.updateEntityInfos(ski, device, uc)
+	h.updateUseCaseInfos(ski, device)
+	remoteInfos := maps.Clone(h.remoteInfos)
+	useCaseInfos := maps.Clone(h.useCaseInfos)
+	h.mutex.Unlock()
+
+	frontend.sendEntityInfo(GetEntityInfos, remoteInfos)
+	frontend.sendUseCaseInfo(GetUseCaseInfos, useCaseInfos)
 	return true
 }
 
 func (h *controlbox) updateEntityInfos(ski string, device spineapi.DeviceRemoteInterface, uc string) {
 	info, exists := h.remoteInfos[ski]
 	if !exists {
-		indx := slices.IndexFunc(h.currentRemoteServices, func(v shipapi.RemoteService) bool { return v.Ski == ski })
+		service := shipapi.RemoteService{Ski: ski}
+		if indx := slices.IndexFunc(h.currentRemoteServices, func(v shipapi.RemoteService) bool { return v.Ski == ski }); indx >= 0 {
+			service = h.currentRemoteServices[indx]
+		}
 		h.remoteInfos[ski] = RemoteInfo{
-			Service:  h.currentRemoteServices[indx],
+			Service:  service,
 			Device:   device,
 			UseCases: []string{uc},
 		}
@@ -272,115 +471,110 @@ func (h *controlbox) updateUseCaseInfos(ski string, device spineapi.DeviceRemote
 
 // LPC Event Handler
 
-func (h *controlbox) sendConsumptionLimit(entity spineapi.EntityRemoteInterface) {
-	resultCB := func(msg model.ResultDataType) {
-		if *msg.ErrorNumber == model.ErrorNumberTypeNoError {
-			fmt.Println("Consumption limit accepted.")
-		} else {
-			fmt.Println("Consumption limit rejected. Code", *msg.ErrorNumber, "Description", *msg.Description)
-		}
-	}
-	msgCounter, err := h.uclpc.WriteConsumptionLimit(entity, h.consumptionLimits, resultCB)
-	if err != nil {
-		fmt.Println("Failed to send consumption limit", err)
-		return
-	}
-	fmt.Println("Sent consumption limit to", entity.Device().Ski(), "with msgCounter", msgCounter)
+func (h *controlbox) sendConsumptionLimit(entity spineapi.EntityRemoteInterface, origin writeOrigin) {
+	h.writeConsumptionLimit(entity, h.limits.get(entityKey(entity)).ConsumptionLimits, origin)
 }
 
-func (h *controlbox) sendConsumptionFailsafeLimit(entity spineapi.EntityRemoteInterface) {
-	msgCounter, err := h.uclpc.WriteFailsafeConsumptionActivePowerLimit(entity, h.consumptionFailsafeLimits.Value)
-	if err != nil {
-		fmt.Println("Failed to send consumption failsafe limit", err)
-		return
-	}
-	fmt.Println("Sent consumption failsafe limit to", entity.Device().Ski(), "with msgCounter", msgCounter)
+func (h *controlbox) writeConsumptionLimit(entity spineapi.EntityRemoteInterface, limit ucapi.LoadLimit, origin writeOrigin) {
+	h.trackWrite(origin, WriteResult{
+		SKI:     entity.Device().Ski(),
+		Entity:  entity.Address().String(),
+		UseCase: "LPC",
+		Field:   "Limit",
+	}, func(resultCB func(model.ResultDataType)) (*model.MsgCounterType, error) {
+		return h.uclpc.WriteConsumptionLimit(entity, limit, resultCB)
+	})
 }
 
-func (h *controlbox) sendConsumptionFailsafeDuration(entity spineapi.EntityRemoteInterface) {
-	msgCounter, err := h.uclpc.WriteFailsafeDurationMinimum(entity, h.consumptionFailsafeLimits.Duration)
-	if err != nil {
-		fmt.Println("Failed to send consumption failsafe duration", err)
-		return
-	}
-	fmt.Println("Sent consumption failsafe duration to", entity.Device().Ski(), "with msgCounter", msgCounter)
+func (h *controlbox) sendConsumptionFailsafeLimit(entity spineapi.EntityRemoteInterface, origin writeOrigin) {
+	limits := h.limits.get(entityKey(entity))
+	h.trackWrite(origin, WriteResult{
+		SKI:     entity.Device().Ski(),
+		Entity:  entity.Address().String(),
+		UseCase: "LPC",
+		Field:   "FailsafeValue",
+	}, func(resultCB func(model.ResultDataType)) (*model.MsgCounterType, error) {
+		msgCounter, err := h.uclpc.WriteFailsafeConsumptionActivePowerLimit(entity, limits.ConsumptionFailsafeLimits.Value)
+		h.failsafeResults.await(entity.Device().Ski(), msgCounter, resultCB)
+		return msgCounter, err
+	})
+}
+
+func (h *controlbox) sendConsumptionFailsafeDuration(entity spineapi.EntityRemoteInterface, origin writeOrigin) {
+	limits := h.limits.get(entityKey(entity))
+	h.trackWrite(origin, WriteResult{
+		SKI:     entity.Device().Ski(),
+		Entity:  entity.Address().String(),
+		UseCase: "LPC",
+		Field:   "FailsafeDuration",
+	}, func(resultCB func(model.ResultDataType)) (*model.MsgCounterType, error) {
+		msgCounter, err := h.uclpc.WriteFailsafeDurationMinimum(entity, limits.ConsumptionFailsafeLimits.Duration)
+		h.failsafeResults.await(entity.Device().Ski(), msgCounter, resultCB)
+		return msgCounter, err
+	})
 }
 
 func (h *controlbox) readConsumptionNominalMax(entity spineapi.EntityRemoteInterface) {
 	nominal, err := h.uclpc.ConsumptionNominalMax(entity)
 
 	if err != nil {
-		fmt.Println("Failed to get consumption nominal max", err)
+		slog.Error("Failed to get consumption nominal max", "ski", entity.Device().Ski(), "usecase", "LPC", "error", err)
 		return
 	}
 
+	h.limits.update(entityKey(entity), func(limits *entityLimits) {
+		limits.ConsumptionNominalMax = nominal
+	})
+
 	frontend.sendValue(entity.Device().Ski(), GetConsumptionNominalMax, "LPC", nominal)
 }
 
 func (h *controlbox) OnLPCEvent(ski string, device spineapi.DeviceRemoteInterface, entity spineapi.EntityRemoteInterface, event api.EventType) {
-	fmt.Println("--> LPC Event: " + string(event) + " from " + ski)
-	connected, exists := h.isConnected[ski]
-	if !exists || !connected {
-		fmt.Println("--> but not connected")
+	slog.Debug("Event", "ski", ski, "usecase", "LPC", "event", event)
+	if !h.eventReceived(ski, device, "LPC") {
 		return
 	}
 
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
-
-	h.updateEntityInfos(ski, device, "LPC")
-	frontend.sendEntityInfo(GetEntityInfos, h.remoteInfos)
-	h.updateUseCaseInfos(ski, device)
-	frontend.sendUseCaseInfo(GetUseCaseInfos, h.useCaseInfos)
-
 	switch event {
 	case lpc.UseCaseSupportUpdate:
 		readData(h, entity, []string{"LPC"})
+		go h.distributeAggregates(false)
 
 	case lpc.DataUpdateLimit:
 		if currentLimit, err := h.uclpc.ConsumptionLimit(entity); err == nil {
-			if ski == remoteSki {
-				fmt.Println("Event lpc.DataUpdateLimit", ski, currentLimit.Value)
-
-				h.consumptionLimits = currentLimit
-
-				if currentLimit.IsActive {
-					fmt.Println("New consumption limit received: active,", currentLimit.Value, "W,", currentLimit.Duration)
-				} else {
-					fmt.Println("New consumption limit received: inactive,", currentLimit.Value, "W,", currentLimit.Duration)
-				}
-				frontend.sendLimit(ski, GetConsumptionLimit, "LPC", ucapi.LoadLimit{
-					IsActive: currentLimit.IsActive,
-					Duration: currentLimit.Duration / time.Second,
-					Value:    currentLimit.Value})
-			}
+			h.limits.update(entityKey(entity), func(limits *entityLimits) {
+				limits.ConsumptionLimits = currentLimit
+			})
+
+			slog.Info("Limit received", "ski", ski, "usecase", "LPC", "active", currentLimit.IsActive, "value", currentLimit.Value, "duration", currentLimit.Duration)
+			frontend.sendLimit(ski, GetConsumptionLimit, "LPC", ucapi.LoadLimit{
+				IsActive: currentLimit.IsActive,
+				Duration: currentLimit.Duration / time.Second,
+				Value:    currentLimit.Value})
 		}
 	case lpc.DataUpdateFailsafeConsumptionActivePowerLimit:
 		if limit, err := h.uclpc.FailsafeConsumptionActivePowerLimit(entity); err == nil {
-			if ski == remoteSki {
-				fmt.Println("Event lpc.DataUpdateFailsafeConsumptionActivePowerLimit", ski, limit)
+			slog.Info("Failsafe value received", "ski", ski, "usecase", "LPC", "value", limit)
 
-				h.consumptionFailsafeLimits.Value = limit
+			h.limits.update(entityKey(entity), func(limits *entityLimits) {
+				limits.ConsumptionFailsafeLimits.Value = limit
+			})
 
-				frontend.sendValue(ski, GetConsumptionFailsafeValue, "LPC", limit)
-			}
+			frontend.sendValue(ski, GetConsumptionFailsafeValue, "LPC", limit)
 		}
 	case lpc.DataUpdateFailsafeDurationMinimum:
 		if duration, err := h.uclpc.FailsafeDurationMinimum(entity); err == nil {
-			if ski == remoteSki {
-				fmt.Println("Event lpc.DataUpdateFailsafeDurationMinimum", ski, duration)
+			slog.Info("Failsafe duration received", "ski", ski, "usecase", "LPC", "duration", duration)
 
-				h.consumptionFailsafeLimits.Duration = duration
+			h.limits.update(entityKey(entity), func(limits *entityLimits) {
+				limits.ConsumptionFailsafeLimits.Duration = duration
+			})
 
-				frontend.sendValue(ski, GetConsumptionFailsafeDuration, "LPC", float64(duration/time.Second))
-			}
+			frontend.sendValue(ski, GetConsumptionFailsafeDuration, "LPC", float64(duration/time.Second))
 		}
-		// TODO
-	// case lpc.DataUpdateHeartbeat:
-	// 	if ski == remoteSki {
-	// 		h.readConsumptionNominalMax(entity)
-	// 		frontend.sendNotification(ski, GetConsumptionHeartbeat, "LPC")
-	// 	}
+	case lpc.DataUpdateHeartbeat:
+		h.heartbeatReceived(ski, "LPC")
+		frontend.sendNotification(ski, GetConsumptionHeartbeat, "LPC")
 	default:
 		return
 	}
@@ -388,137 +582,122 @@ func (h *controlbox) OnLPCEvent(ski string, device spineapi.DeviceRemoteInterfac
 
 // LPP Event Handler
 
-func (h *controlbox) sendProductionLimit(entity spineapi.EntityRemoteInterface) {
-	resultCB := func(msg model.ResultDataType) {
-		if *msg.ErrorNumber == model.ErrorNumberTypeNoError {
-			fmt.Println("Production limit accepted.")
-		} else {
-			fmt.Println("Production limit rejected. Code", *msg.ErrorNumber, "Description", *msg.Description)
-		}
-	}
-	msgCounter, err := h.uclpp.WriteProductionLimit(entity, h.productionLimits, resultCB)
-	if err != nil {
-		fmt.Println("Failed to send production limit", err)
-		return
-	}
-	fmt.Println("Sent production limit to", entity.Device().Ski(), "with msgCounter", msgCounter)
+func (h *controlbox) sendProductionLimit(entity spineapi.EntityRemoteInterface, origin writeOrigin) {
+	h.writeProductionLimit(entity, h.limits.get(entityKey(entity)).ProductionLimits, origin)
 }
 
-func (h *controlbox) sendProductionFailsafeLimit(entity spineapi.EntityRemoteInterface) {
-	msgCounter, err := h.uclpp.WriteFailsafeProductionActivePowerLimit(entity, h.productionFailsafeLimits.Value)
-	if err != nil {
-		fmt.Println("Failed to send production failsafe limit", err)
-		return
-	}
-	fmt.Println("Sent production failsafe limit to", entity.Device().Ski(), "with msgCounter", msgCounter)
+func (h *controlbox) writeProductionLimit(entity spineapi.EntityRemoteInterface, limit ucapi.LoadLimit, origin writeOrigin) {
+	h.trackWrite(origin, WriteResult{
+		SKI:     entity.Device().Ski(),
+		Entity:  entity.Address().String(),
+		UseCase: "LPP",
+		Field:   "Limit",
+	}, func(resultCB func(model.ResultDataType)) (*model.MsgCounterType, error) {
+		return h.uclpp.WriteProductionLimit(entity, limit, resultCB)
+	})
 }
 
-func (h *controlbox) sendProductionFailsafeDuration(entity spineapi.EntityRemoteInterface) {
-	msgCounter, err := h.uclpp.WriteFailsafeDurationMinimum(entity, h.productionFailsafeLimits.Duration)
-	if err != nil {
-		fmt.Println("Failed to send production failsafe duration", err)
-		return
-	}
-	fmt.Println("Sent production failsafe duration to", entity.Device().Ski(), "with msgCounter", msgCounter)
+func (h *controlbox) sendProductionFailsafeLimit(entity spineapi.EntityRemoteInterface, origin writeOrigin) {
+	limits := h.limits.get(entityKey(entity))
+	h.trackWrite(origin, WriteResult{
+		SKI:     entity.Device().Ski(),
+		Entity:  entity.Address().String(),
+		UseCase: "LPP",
+		Field:   "FailsafeValue",
+	}, func(resultCB func(model.ResultDataType)) (*model.MsgCounterType, error) {
+		msgCounter, err := h.uclpp.WriteFailsafeProductionActivePowerLimit(entity, limits.ProductionFailsafeLimits.Value)
+		h.failsafeResults.await(entity.Device().Ski(), msgCounter, resultCB)
+		return msgCounter, err
+	})
+}
+
+func (h *controlbox) sendProductionFailsafeDuration(entity spineapi.EntityRemoteInterface, origin writeOrigin) {
+	limits := h.limits.get(entityKey(entity))
+	h.trackWrite(origin, WriteResult{
+		SKI:     entity.Device().Ski(),
+		Entity:  entity.Address().String(),
+		UseCase: "LPP",
+		Field:   "FailsafeDuration",
+	}, func(resultCB func(model.ResultDataType)) (*model.MsgCounterType, error) {
+		msgCounter, err := h.uclpp.WriteFailsafeDurationMinimum(entity, limits.ProductionFailsafeLimits.Duration)
+		h.failsafeResults.await(entity.Device().Ski(), msgCounter, resultCB)
+		return msgCounter, err
+	})
 }
 
 func (h *controlbox) readProductionNominalMax(entity spineapi.EntityRemoteInterface) {
 	nominal, err := h.uclpp.ProductionNominalMax(entity)
 
 	if err != nil {
-		fmt.Println("Failed to get production nominal max", err)
+		slog.Error("Failed to get production nominal max", "ski", entity.Device().Ski(), "usecase", "LPP", "error", err)
 		return
 	}
 
+	h.limits.update(entityKey(entity), func(limits *entityLimits) {
+		limits.ProductionNominalMax = nominal
+	})
+
 	frontend.sendValue(entity.Device().Ski(), GetProductionNominalMax, "LPP", nominal)
 }
 
 func (h *controlbox) OnLPPEvent(ski string, device spineapi.DeviceRemoteInterface, entity spineapi.EntityRemoteInterface, event api.EventType) {
-	fmt.Println("--> LPP Event: " + string(event) + " from " + ski)
-	connected, exists := h.isConnected[ski]
-	if !exists || !connected {
-		fmt.Println("--> but not connected")
+	slog.Debug("Event", "ski", ski, "usecase", "LPP", "event", event)
+	if !h.eventReceived(ski, device, "LPP") {
 		return
 	}
 
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
-
-	h.updateEntityInfos(ski, device, "LPP")
-	frontend.sendEntityInfo(GetEntityInfos, h.remoteInfos)
-	h.updateUseCaseInfos(ski, device)
-	frontend.sendUseCaseInfo(GetUseCaseInfos, h.useCaseInfos)
-
 	switch event {
 	case lpp.UseCaseSupportUpdate:
 		readData(h, entity, []string{"LPP"})
+		go h.distributeAggregates(false)
 
 	case lpp.DataUpdateLimit:
 		if currentLimit, err := h.uclpp.ProductionLimit(entity); err == nil {
-			if ski == remoteSki {
-				fmt.Println("Event lpp.DataUpdateLimit", ski, currentLimit.Value)
-
-				h.productionLimits = currentLimit
-
-				if currentLimit.IsActive {
-					fmt.Println("New production limit received: active,", currentLimit.Value, "W,", currentLimit.Duration)
-				} else {
-					fmt.Println("New production limit received: inactive,", currentLimit.Value, "W,", currentLimit.Duration)
-				}
-
-				frontend.sendLimit(ski, GetProductionLimit, "LPP", ucapi.LoadLimit{
-					IsActive: currentLimit.IsActive,
-					Duration: currentLimit.Duration / time.Second,
-					Value:    currentLimit.Value})
-			}
+			h.limits.update(entityKey(entity), func(limits *entityLimits) {
+				limits.ProductionLimits = currentLimit
+			})
+
+			slog.Info("Limit received", "ski", ski, "usecase", "LPP", "active", currentLimit.IsActive, "value", currentLimit.Value, "duration", currentLimit.Duration)
+
+			frontend.sendLimit(ski, GetProductionLimit, "LPP", ucapi.LoadLimit{
+				IsActive: currentLimit.IsActive,
+				Duration: currentLimit.Duration / time.Second,
+				Value:    currentLimit.Value})
 		}
 	case lpp.DataUpdateFailsafeProductionActivePowerLimit:
 		if limit, err := h.uclpp.FailsafeProductionActivePowerLimit(entity); err == nil {
-			if ski == remoteSki {
-				fmt.Println("Event lpp.DataUpdateFailsafeProductionActivePowerLimit", ski, limit)
+			slog.Info("Failsafe value received", "ski", ski, "usecase", "LPP", "value", limit)
 
-				h.productionFailsafeLimits.Value = limit
+			h.limits.update(entityKey(entity), func(limits *entityLimits) {
+				limits.ProductionFailsafeLimits.Value = limit
+			})
 
-				frontend.sendValue(ski, GetProductionFailsafeValue, "LPP", limit)
-			}
+			frontend.sendValue(ski, GetProductionFailsafeValue, "LPP", limit)
 		}
 	case lpp.DataUpdateFailsafeDurationMinimum:
 		if duration, err := h.uclpp.FailsafeDurationMinimum(entity); err == nil {
-			if ski == remoteSki {
-				fmt.Println("Event lpp.DataUpdateFailsafeDurationMinimum", ski, duration)
+			slog.Info("Failsafe duration received", "ski", ski, "usecase", "LPP", "duration", duration)
 
-				h.productionFailsafeLimits.Duration = duration
+			h.limits.update(entityKey(entity), func(limits *entityLimits) {
+				limits.ProductionFailsafeLimits.Duration = duration
+			})
 
-				frontend.sendValue(ski, GetProductionFailsafeDuration, "LPP", float64(duration/time.Second))
-			}
+			frontend.sendValue(ski, GetProductionFailsafeDuration, "LPP", float64(duration/time.Second))
 		}
-		// TODO
-	// case lpp.DataUpdateHeartbeat:
-	// 	if ski == remoteSki {
-	// 		h.readProductionNominalMax(entity)
-	// 		frontend.sendNotification(ski, GetProductionHeartbeat, "LPP")
-	// 	}
+	case lpp.DataUpdateHeartbeat:
+		h.heartbeatReceived(ski, "LPP")
+		frontend.sendNotification(ski, GetProductionHeartbeat, "LPP")
 	default:
 		return
 	}
 }
 
 func (h *controlbox) OnMGCPEvent(ski string, device spineapi.DeviceRemoteInterface, entity spineapi.EntityRemoteInterface, event api.EventType) {
-	fmt.Println("--> MGCP Event: " + string(event) + " from " + ski)
-	connected, exists := h.isConnected[ski]
-	if !exists || !connected {
-		fmt.Println("--> but not connected")
+	slog.Debug("Event", "ski", ski, "usecase", "MGCP", "event", event)
+	if !h.eventReceived(ski, device, "MGCP") {
 		return
 	}
 
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
-
-	h.updateEntityInfos(ski, device, "MGCP")
-	frontend.sendEntityInfo(GetEntityInfos, h.remoteInfos)
-	h.updateUseCaseInfos(ski, device)
-	frontend.sendUseCaseInfo(GetUseCaseInfos, h.useCaseInfos)
-
 	switch event {
 	case mgcp.UseCaseSupportUpdate:
 		readData(h, entity, []string{"MGCP"})
@@ -526,50 +705,48 @@ func (h *controlbox) OnMGCPEvent(ski string, device spineapi.DeviceRemoteInterfa
 	case mgcp.DataUpdatePowerLimitationFactor:
 		if powerLimitFactor, err := h.ucmgcp.PowerLimitationFactor(entity); err == nil {
 			frontend.sendValue(ski, GetPowerLimitationFactor, "MGCP", powerLimitFactor)
+			h.measurementUpdated(ski, "MGCP", "PowerLimitationFactor", powerLimitFactor)
 		}
 	case mgcp.DataUpdatePower:
 		if power, err := h.ucmgcp.Power(entity); err == nil {
 			frontend.sendValue(ski, GetPower, "MGCP", power)
+			h.measurementUpdated(ski, "MGCP", "Power", power)
+			h.gridPowerUpdated(ski, power)
 		}
 	case mgcp.DataUpdateEnergyFeedIn:
 		if energyFeedIn, err := h.ucmgcp.EnergyFeedIn(entity); err == nil {
 			frontend.sendValue(ski, GetEnergyFeedIn, "MGCP", energyFeedIn)
+			h.measurementUpdated(ski, "MGCP", "EnergyFeedIn", energyFeedIn)
 		}
 	case mgcp.DataUpdateEnergyConsumed:
 		if energyConsumed, err := h.ucmgcp.EnergyConsumed(entity); err == nil {
 			frontend.sendValue(ski, GetEnergyConsumed, "MGCP", energyConsumed)
+			h.measurementUpdated(ski, "MGCP", "EnergyConsumed", energyConsumed)
 		}
 	case mgcp.DataUpdateCurrentPerPhase:
 		if currentPerPhase, err := h.ucmgcp.CurrentPerPhase(entity); err == nil {
 			frontend.sendValueArr(ski, GetCurrentPerPhase, "MGCP", currentPerPhase)
+			h.measurementUpdated(ski, "MGCP", "CurrentPerPhase", currentPerPhase...)
 		}
 	case mgcp.DataUpdateVoltagePerPhase:
 		if voltagePerPhase, err := h.ucmgcp.VoltagePerPhase(entity); err == nil {
 			frontend.sendValueArr(ski, GetVoltagePerPhase, "MGCP", voltagePerPhase)
+			h.measurementUpdated(ski, "MGCP", "VoltagePerPhase", voltagePerPhase...)
 		}
 	case mgcp.DataUpdateFrequency:
 		if frequency, err := h.ucmgcp.Frequency(entity); err == nil {
 			frontend.sendValue(ski, GetFrequency, "MGCP", frequency)
+			h.measurementUpdated(ski, "MGCP", "Frequency", frequency)
 		}
 	}
 }
 
 func (h *controlbox) OnMPCEvent(ski string, device spineapi.DeviceRemoteInterface, entity spineapi.EntityRemoteInterface, event api.EventType) {
-	fmt.Println("--> MPC Event: " + string(event) + " from " + ski)
-	connected, exists := h.isConnected[ski]
-	if !exists || !connected {
-		fmt.Println("--> but not connected")
+	slog.Debug("Event", "ski", ski, "usecase", "MPC", "event", event)
+	if !h.eventReceived(ski, device, "MPC") {
 		return
 	}
 
-	h.mutex.Lock()
-	defer h.mutex.Unlock()
-
-	h.updateEntityInfos(ski, device, "MPC")
-	frontend.sendEntityInfo(GetEntityInfos, h.remoteInfos)
-	h.updateUseCaseInfos(ski, device)
-	frontend.sendUseCaseInfo(GetUseCaseInfos, h.useCaseInfos)
-
 	switch event {
 	case mpc.UseCaseSupportUpdate:
 		readData(h, entity, []string{"MPC"})
@@ -577,30 +754,37 @@ func (h *controlbox) OnMPCEvent(ski string, device spineapi.DeviceRemoteInterfac
 	case mpc.DataUpdatePower:
 		if power, err := h.ucmpc.Power(entity); err == nil {
 			frontend.sendValue(ski, GetPower, "MPC", power)
+			h.measurementUpdated(ski, "MPC", "Power", power)
 		}
 	case mpc.DataUpdatePowerPerPhase:
 		if powerPerPhase, err := h.ucmpc.PowerPerPhase(entity); err == nil {
 			frontend.sendValueArr(ski, GetPowerPerPhase, "MPC", powerPerPhase)
+			h.measurementUpdated(ski, "MPC", "PowerPerPhase", powerPerPhase...)
 		}
 	case mpc.DataUpdateEnergyConsumed:
 		if energyConsumed, err := h.ucmpc.EnergyConsumed(entity); err == nil {
 			frontend.sendValue(ski, GetEnergyConsumed, "MPC", energyConsumed)
+			h.measurementUpdated(ski, "MPC", "EnergyConsumed", energyConsumed)
 		}
 	case mpc.DataUpdateEnergyProduced:
 		if energyFeedIn, err := h.ucmpc.EnergyProduced(entity); err == nil {
 			frontend.sendValue(ski, GetEnergyFeedIn, "MPC", energyFeedIn)
+			h.measurementUpdated(ski, "MPC", "EnergyFeedIn", energyFeedIn)
 		}
 	case mpc.DataUpdateCurrentsPerPhase:
 		if currentPerPhase, err := h.ucmpc.CurrentPerPhase(entity); err == nil {
 			frontend.sendValueArr(ski, GetCurrentPerPhase, "MPC", currentPerPhase)
+			h.measurementUpdated(ski, "MPC", "CurrentPerPhase", currentPerPhase...)
 		}
 	case mpc.DataUpdateVoltagePerPhase:
 		if voltagePerPhase, err := h.ucmpc.VoltagePerPhase(entity); err == nil {
 			frontend.sendValueArr(ski, GetVoltagePerPhase, "MPC", voltagePerPhase)
+			h.measurementUpdated(ski, "MPC", "VoltagePerPhase", voltagePerPhase...)
 		}
 	case mpc.DataUpdateFrequency:
 		if frequency, err := h.ucmpc.Frequency(entity); err == nil {
 			frontend.sendValue(ski, GetFrequency, "MPC", frequency)
+			h.measurementUpdated(ski, "MPC", "Frequency", frequency)
 		}
 	}
 }
@@ -1,54 +1,75 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"time"
+	"log/slog"
+	"strings"
 )
 
 // Logging interface
 
 func (h *controlbox) Trace(args ...interface{}) {
-	// h.print("TRACE", args...)
+	h.traceShipMessage(args)
+	h.print(levelTrace, args...)
 }
 
 func (h *controlbox) Tracef(format string, args ...interface{}) {
-	// h.printFormat("TRACE", format, args...)
+	h.printFormat(levelTrace, format, args...)
 }
 
 func (h *controlbox) Debug(args ...interface{}) {
-	// h.print("DEBUG", args...)
+	h.print(slog.LevelDebug, args...)
 }
 
 func (h *controlbox) Debugf(format string, args ...interface{}) {
-	// h.printFormat("DEBUG", format, args...)
+	h.printFormat(slog.LevelDebug, format, args...)
 }
 
 func (h *controlbox) Info(args ...interface{}) {
-	h.print("INFO ", args...)
+	h.print(slog.LevelInfo, args...)
 }
 
 func (h *controlbox) Infof(format string, args ...interface{}) {
-	h.printFormat("INFO ", format, args...)
+	h.printFormat(slog.LevelInfo, format, args...)
 }
 
 func (h *controlbox) Error(args ...interface{}) {
-	h.print("ERROR", args...)
+	h.print(slog.LevelError, args...)
 }
 
 func (h *controlbox) Errorf(format string, args ...interface{}) {
-	h.printFormat("ERROR", format, args...)
+	h.printFormat(slog.LevelError, format, args...)
 }
 
-func (h *controlbox) currentTimestamp() string {
-	return time.Now().Format("2006-01-02 15:04:05")
+func (h *controlbox) print(level slog.Level, args ...interface{}) {
+	if !logEnabled(level) {
+		return
+	}
+	value := strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+	slog.Log(context.Background(), level, value, "source", "eebus")
 }
 
-func (h *controlbox) print(msgType string, args ...interface{}) {
-	value := fmt.Sprintln(args...)
-	fmt.Printf("%s %s %s", h.currentTimestamp(), msgType, value)
+func (h *controlbox) printFormat(level slog.Level, format string, args ...interface{}) {
+	if !logEnabled(level) {
+		return
+	}
+	slog.Log(context.Background(), level, fmt.Sprintf(format, args...), "source", "eebus")
 }
 
-func (h *controlbox) printFormat(msgType, format string, args ...interface{}) {
-	value := fmt.Sprintf(format, args...)
-	fmt.Println(h.currentTimestamp(), msgType, value)
+// traceShipMessage passes the SHIP messages, traced by ship-go as
+// "Send:" or "Recv:" with the SKI and the message, to the SPINE log
+func (h *controlbox) traceShipMessage(args []interface{}) {
+	if spineLog == nil || len(args) != 3 {
+		return
+	}
+	ski, _ := args[1].(string)
+	text, _ := args[2].(string)
+
+	switch args[0] {
+	case "Send:":
+		spineLog.shipMessage("send", ski, text)
+	case "Recv:":
+		spineLog.shipMessage("receive", ski, text)
+	}
 }
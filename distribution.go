@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+)
+
+// Aggregate limits
+//
+// An aggregate limit is a single LPC or LPP limit for all devices supporting
+// the use case, e.g. for several controllable consumers behind one grid
+// connection. It is split across the connected devices by a strategy and
+// split again whenever devices connect or disconnect or report a different
+// nominal maximum. The shares are combined with the limits of the grid
+// connection point control, see arbiter.go.
+
+const (
+	strategyEqual        = "equal"
+	strategyProportional = "proportional"
+	strategyPriority     = "priority"
+)
+
+const distributionCheckInterval = 5 * time.Second
+
+var (
+	errUnknownStrategy = errors.New("strategy must be equal, proportional or priority")
+	errAggregateValue  = errors.New("value must not be negative")
+)
+
+// AggregateLimit is a limit for all devices of a use case and its share per device
+type AggregateLimit struct {
+	UseCase  string
+	IsActive bool
+	Value    float64 // W
+	Duration time.Duration
+	Strategy string
+	Priority []string           `json:",omitempty"` // SKIs in descending priority
+	Since    time.Time          `json:",omitempty"`
+	Shares   map[string]float64 `json:",omitempty"` // W per SKI
+}
+
+type aggregateStore struct {
+	// defaults for aggregate limits without strategy and for the grid controller
+	strategy string
+	priority []string
+
+	limits map[string]AggregateLimit
+
+	mutex sync.Mutex
+	// serializes distributing the limits
+	distributeMutex sync.Mutex
+}
+
+func newAggregateStore() *aggregateStore {
+	s := &aggregateStore{
+		strategy: strings.ToLower(os.Getenv("DISTRIBUTION_STRATEGY")),
+		limits:   map[string]AggregateLimit{},
+	}
+	if s.strategy == "" {
+		s.strategy = strategyEqual
+	}
+	if !validStrategy(s.strategy) {
+		slog.Error("Invalid value", "name", "DISTRIBUTION_STRATEGY", "value", s.strategy)
+		s.strategy = strategyEqual
+	}
+	if priority := os.Getenv("DISTRIBUTION_PRIORITY"); priority != "" {
+		s.priority = strings.Split(priority, ",")
+	}
+	return s
+}
+
+func validStrategy(strategy string) bool {
+	return strategy == strategyEqual || strategy == strategyProportional || strategy == strategyPriority
+}
+
+// distributeLimit splits a total limit across devices. No device gets more
+// than its nominal maximum, the excess is split across the other devices and
+// is left unassigned once all devices reached their nominal maximum. Devices
+// without a nominal maximum get a share of what the devices with one leave
+// for the proportional strategy, an equal share if no device reported one,
+// and an equal share of the remainder with the devices after them for the
+// priority strategy, so they do not leave the following devices without a
+// limit.
+func distributeLimit(total float64, skis []string, nominalMax map[string]float64, strategy string, priority []string) map[string]float64 {
+	switch strategy {
+	case strategyProportional:
+		return fillShares(total, skis, nominalMax, nominalMax)
+	case strategyPriority:
+		shares := map[string]float64{}
+		ordered := slices.Clone(skis)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			pi, pj := slices.Index(priority, ordered[i]), slices.Index(priority, ordered[j])
+			if pi == -1 || pj == -1 {
+				return pi != -1 && pj == -1
+			}
+			return pi < pj
+		})
+		remaining := total
+		for i, ski := range ordered {
+			share := remaining / float64(len(ordered)-i)
+			if nominalMax[ski] > 0 {
+				share = math.Min(remaining, nominalMax[ski])
+			}
+			shares[ski] = math.Floor(share)
+			remaining -= share
+		}
+		return shares
+	default:
+		return fillShares(total, skis, nominalMax, nil)
+	}
+}
+
+// fillShares splits a total across devices by weight, or equally without
+// weights. A share above the nominal maximum of a device is capped and the
+// excess is split across the other devices the same way.
+func fillShares(total float64, skis []string, nominalMax, weights map[string]float64) map[string]float64 {
+	shares := map[string]float64{}
+	open := slices.Clone(skis)
+	remaining := total
+
+	for len(open) > 0 {
+		sum := 0.0
+		for _, ski := range open {
+			sum += weights[ski]
+		}
+		share := func(ski string) float64 {
+			if sum == 0 {
+				return remaining / float64(len(open))
+			}
+			return remaining * weights[ski] / sum
+		}
+
+		// a device above its nominal maximum stays above it when the excess of others is added
+		var capped []string
+		for _, ski := range open {
+			if limit := nominalMax[ski]; limit > 0 && share(ski) > limit {
+				capped = append(capped, ski)
+			}
+		}
+		if len(capped) == 0 {
+			for _, ski := range open {
+				shares[ski] = math.Floor(share(ski))
+			}
+			break
+		}
+
+		for _, ski := range capped {
+			shares[ski] = math.Floor(nominalMax[ski])
+			remaining -= nominalMax[ski]
+		}
+		open = slices.DeleteFunc(open, func(ski string) bool { return slices.Contains(capped, ski) })
+	}
+
+	return shares
+}
+
+// limitDevices returns the sorted SKIs of the connected devices supporting the use case and their nominal maximum
+func (h *controlbox) limitDevices(useCase string) ([]string, map[string]float64) {
+	uc, _, _ := h.reconcileUseCase(useCase)
+
+	skis := []string{}
+	nominalMax := map[string]float64{}
+	for _, entity := range remoteEntities(uc, "") {
+		ski := entity.Device().Ski()
+		if slices.Contains(skis, ski) {
+			continue
+		}
+		skis = append(skis, ski)
+		nominalMax[ski] = h.limits.nominalMax(ski, useCase)
+	}
+	sort.Strings(skis)
+
+	return skis, nominalMax
+}
+
+func (h *controlbox) aggregateList() []AggregateLimit {
+	h.aggregates.mutex.Lock()
+	defer h.aggregates.mutex.Unlock()
+
+	list := make([]AggregateLimit, 0, len(h.aggregates.limits))
+	for _, limit := range h.aggregates.limits {
+		limit.Shares = maps.Clone(limit.Shares)
+		list = append(list, limit)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UseCase < list[j].UseCase })
+
+	return list
+}
+
+// aggregateLimits returns the aggregate limits with durations in seconds like the other limits of the frontend and API
+func (h *controlbox) aggregateLimits() []AggregateLimit {
+	list := h.aggregateList()
+	for i := range list {
+		list[i].Duration /= time.Second
+	}
+	return list
+}
+
+// setAggregateLimit replaces the aggregate limit of a use case and distributes it
+func (h *controlbox) setAggregateLimit(limit AggregateLimit) error {
+	limit.UseCase = strings.ToUpper(limit.UseCase)
+	limit.Strategy = strings.ToLower(limit.Strategy)
+	if limit.UseCase != "LPC" && limit.UseCase != "LPP" {
+		return errUseCaseNotAvailable
+	}
+	if limit.Strategy == "" {
+		limit.Strategy = h.aggregates.strategy
+	}
+	if !validStrategy(limit.Strategy) {
+		return errUnknownStrategy
+	}
+	if limit.Value < 0 {
+		return errAggregateValue
+	}
+	if limit.Strategy == strategyPriority && len(limit.Priority) == 0 {
+		limit.Priority = h.aggregates.priority
+	}
+	limit.Since = time.Now()
+
+	h.aggregates.mutex.Lock()
+	// shares are kept to deactivate the limits of the devices
+	limit.Shares = h.aggregates.limits[limit.UseCase].Shares
+	h.aggregates.limits[limit.UseCase] = limit
+	h.aggregates.mutex.Unlock()
+
+	slog.Info("Aggregate limit set", "usecase", limit.UseCase, "active", limit.IsActive, "value", limit.Value, "strategy", limit.Strategy)
+
+	h.persist()
+	h.distributeAggregates(true)
+	return nil
+}
+
+// distributeAggregates splits the aggregate limits across the connected devices and
+// writes the changed shares. If force is set, all shares are written.
+func (h *controlbox) distributeAggregates(force bool) {
+	h.aggregates.distributeMutex.Lock()
+	defer h.aggregates.distributeMutex.Unlock()
+
+	now := time.Now()
+	changed := false
+
+	for _, useCase := range []string{"LPC", "LPP"} {
+		h.aggregates.mutex.Lock()
+		limit, ok := h.aggregates.limits[useCase]
+		h.aggregates.mutex.Unlock()
+		if !ok {
+			continue
+		}
+
+		expired := limit.IsActive && limit.Duration > 0 && !now.Before(limit.Since.Add(limit.Duration))
+		if expired {
+			// the devices deactivate their limits on their own
+			slog.Info("Aggregate limit expired", "usecase", useCase)
+			limit.IsActive = false
+			limit.Shares = nil
+			h.persist()
+		}
+		if !limit.IsActive && len(limit.Shares) == 0 && !force {
+			if expired {
+				h.updateAggregate(limit)
+				changed = true
+			}
+			continue
+		}
+
+		skis, nominalMax := h.limitDevices(useCase)
+		shares := map[string]float64{}
+		if limit.IsActive {
+			shares = distributeLimit(limit.Value, skis, nominalMax, limit.Strategy, limit.Priority)
+		}
+
+		// the shares requested from the devices, a rejected share is requested again with the next distribution
+		written := map[string]float64{}
+		origin := writeOrigin{id: "aggregate-" + newWriteID()}
+		for _, ski := range skis {
+			share, active := shares[ski]
+			previous, requested := limit.Shares[ski]
+			if !force && requested == active && previous == share {
+				if active {
+					written[ski] = share
+				}
+				continue
+			}
+
+			loadLimit := ucapi.LoadLimit{IsActive: false, DeleteDuration: true}
+			if active {
+				loadLimit = ucapi.LoadLimit{IsActive: true, Value: share}
+				if limit.Duration > 0 {
+					loadLimit.Duration = limit.Since.Add(limit.Duration).Sub(now).Round(time.Second)
+				}
+			}
+
+			slog.Info("Aggregate limit share", "ski", ski, "usecase", useCase, "active", active, "value", share)
+			if err := h.requestLimit(limitSourceAggregate, useCase, ski, loadLimit, origin); err != nil {
+				if requested {
+					written[ski] = previous
+				}
+				continue
+			}
+			if active {
+				written[ski] = share
+			}
+		}
+
+		if !maps.Equal(written, limit.Shares) || force {
+			limit.Shares = written
+			if len(written) == 0 {
+				limit.Shares = nil
+			}
+			h.updateAggregate(limit)
+			changed = true
+		}
+	}
+
+	if changed {
+		frontend.sendAggregateLimits(GetAggregateLimits, h.aggregateLimits())
+	}
+}
+
+// updateAggregate stores a distributed aggregate limit unless it was replaced in the meantime
+func (h *controlbox) updateAggregate(limit AggregateLimit) {
+	h.aggregates.mutex.Lock()
+	defer h.aggregates.mutex.Unlock()
+
+	if current, ok := h.aggregates.limits[limit.UseCase]; ok && current.Since.Equal(limit.Since) {
+		h.aggregates.limits[limit.UseCase] = limit
+	}
+}
+
+func (h *controlbox) runDistribution() {
+	ticker := time.NewTicker(distributionCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.distributeAggregates(false)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestDistributeLimit(t *testing.T) {
+	skis := []string{"a", "b", "c"}
+
+	tests := []struct {
+		name       string
+		total      float64
+		skis       []string
+		nominalMax map[string]float64
+		strategy   string
+		priority   []string
+		want       map[string]float64
+	}{
+		{"no devices", 10000, nil, nil, strategyEqual, nil, map[string]float64{}},
+		{"equal", 10000, skis, nil, strategyEqual, nil, map[string]float64{"a": 3333, "b": 3333, "c": 3333}},
+		{"proportional", 9000, skis, map[string]float64{"a": 2000, "b": 4000, "c": 12000}, strategyProportional, nil,
+			map[string]float64{"a": 1000, "b": 2000, "c": 6000}},
+		{"proportional without nominal maximum", 9000, skis, nil, strategyProportional, nil,
+			map[string]float64{"a": 3000, "b": 3000, "c": 3000}},
+		{"equal above the nominal maximum", 9000, skis, map[string]float64{"a": 2000, "b": 2000, "c": 2000}, strategyEqual, nil,
+			map[string]float64{"a": 2000, "b": 2000, "c": 2000}},
+		{"equal excess redistributed", 9000, skis, map[string]float64{"a": 1000, "b": 5000}, strategyEqual, nil,
+			map[string]float64{"a": 1000, "b": 4000, "c": 4000}},
+		{"equal excess redistributed twice", 9000, skis, map[string]float64{"a": 1000, "b": 3500, "c": 6000}, strategyEqual, nil,
+			map[string]float64{"a": 1000, "b": 3500, "c": 4500}},
+		{"proportional above the nominal maximum", 20000, skis, map[string]float64{"a": 2000, "b": 4000, "c": 12000}, strategyProportional, nil,
+			map[string]float64{"a": 2000, "b": 4000, "c": 12000}},
+		{"proportional excess to a device without nominal maximum", 9000, skis, map[string]float64{"a": 2000, "b": 4000}, strategyProportional, nil,
+			map[string]float64{"a": 2000, "b": 4000, "c": 3000}},
+		{"priority", 10000, skis, map[string]float64{"a": 4000, "b": 4000, "c": 4000}, strategyPriority, []string{"c", "a"},
+			map[string]float64{"c": 4000, "a": 4000, "b": 2000}},
+		{"priority exhausted", 6000, skis, map[string]float64{"a": 4000, "b": 4000, "c": 4000}, strategyPriority, []string{"a", "b", "c"},
+			map[string]float64{"a": 4000, "b": 2000, "c": 0}},
+		{"priority without nominal maximum", 9000, skis, map[string]float64{"b": 2000}, strategyPriority, []string{"a", "b", "c"},
+			map[string]float64{"a": 3000, "b": 2000, "c": 4000}},
+		{"priority without any nominal maximum", 9000, skis, nil, strategyPriority, []string{"a", "b", "c"},
+			map[string]float64{"a": 3000, "b": 3000, "c": 3000}},
+		{"unlisted devices last", 5000, skis, map[string]float64{"a": 4000, "b": 4000, "c": 4000}, strategyPriority, []string{"b"},
+			map[string]float64{"b": 4000, "a": 1000, "c": 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := distributeLimit(tt.total, tt.skis, tt.nominalMax, tt.strategy, tt.priority); !maps.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
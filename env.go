@@ -0,0 +1,70 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Helpers for optional settings from the environment or .env,
+// invalid values are reported and replaced by the default
+
+func envString(name string, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+func envBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Error("Invalid value", "name", name, "value", value)
+		return def
+	}
+	return b
+}
+
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Error("Invalid value", "name", name, "value", value)
+		return def
+	}
+	return i
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Error("Invalid value", "name", name, "value", value)
+		return def
+	}
+	return d
+}
+
+func envFloat(name string, def float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		slog.Error("Invalid value", "name", name, "value", value)
+		return def
+	}
+	return f
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/enbility/eebus-go/api"
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+)
+
+// Failsafe state detection
+//
+// The state a controllable system is expected to be in is derived from the
+// heartbeat it sends, its failsafe duration minimum and the active limit,
+// following the state diagram of §14a EnWG:
+//
+//   - init: no heartbeat was received yet
+//   - limited: the heartbeat is present and a limit is active
+//   - unlimited: the heartbeat is present and no limit is active
+//   - failsafe: the heartbeat is missing for longer than the heartbeat timeout.
+//     The system stays in failsafe until the heartbeat is back and the failsafe
+//     duration minimum has passed.
+
+const (
+	failsafeStateInit      = "init"
+	failsafeStateLimited   = "limited"
+	failsafeStateUnlimited = "unlimited"
+	failsafeStateFailsafe  = "failsafe"
+)
+
+// used as long as the remote entity did not report its failsafe duration minimum
+const defaultFailsafeDurationMinimum = 2 * time.Hour
+
+// number of transitions kept per entity
+const failsafeHistoryLength = 20
+
+// FailsafeTransition is a single change of the derived failsafe state
+type FailsafeTransition struct {
+	State string
+	Time  time.Time
+}
+
+// FailsafeStatus is the derived state of a remote entity for the LPC or LPP use case
+type FailsafeStatus struct {
+	SKI     string
+	Entity  string
+	UseCase string
+	State   string
+	Since   time.Time
+	History []FailsafeTransition
+}
+
+// failsafeInput holds everything the failsafe state is derived from
+type failsafeInput struct {
+	heartbeat        HeartbeatStatus
+	hasHeartbeat     bool
+	limit            ucapi.LoadLimit
+	failsafeDuration time.Duration
+}
+
+// nextFailsafeState derives the failsafe state from the current one
+func nextFailsafeState(current FailsafeStatus, in failsafeInput, now time.Time) string {
+	heartbeatPresent := in.hasHeartbeat && now.Sub(in.heartbeat.LastReceived) <= heartbeatTimeout
+
+	failsafeDuration := in.failsafeDuration
+	if failsafeDuration == 0 {
+		failsafeDuration = defaultFailsafeDurationMinimum
+	}
+
+	switch {
+	case current.State == failsafeStateFailsafe && (!heartbeatPresent || now.Sub(current.Since) < failsafeDuration):
+		return failsafeStateFailsafe
+	case !in.hasHeartbeat:
+		return failsafeStateInit
+	case !heartbeatPresent:
+		return failsafeStateFailsafe
+	case in.limit.IsActive:
+		return failsafeStateLimited
+	default:
+		return failsafeStateUnlimited
+	}
+}
+
+func (h *controlbox) failsafeInput(key limitKey, useCase string) failsafeInput {
+	limits := h.limits.get(key)
+
+	var in failsafeInput
+	switch useCase {
+	case "LPC":
+		in.limit = limits.ConsumptionLimits
+		in.failsafeDuration = limits.ConsumptionFailsafeLimits.Duration
+	case "LPP":
+		in.limit = limits.ProductionLimits
+		in.failsafeDuration = limits.ProductionFailsafeLimits.Duration
+	}
+
+	h.mutex.Lock()
+	in.heartbeat, in.hasHeartbeat = h.heartbeats[heartbeatKey(key.SKI, useCase)]
+	h.mutex.Unlock()
+
+	return in
+}
+
+// evaluateFailsafe updates the failsafe state of all remote LPC and LPP entities
+// and pushes changes to the frontend
+func (h *controlbox) evaluateFailsafe() {
+	now := time.Now()
+	changed := false
+
+	for useCase, uc := range map[string]api.UseCaseInterface{"LPC": h.uclpc, "LPP": h.uclpp} {
+		for _, entity := range remoteEntities(uc, "") {
+			ski := entity.Device().Ski()
+			address := entity.Address().String()
+			key := ski + "/" + useCase + "/" + address
+			in := h.failsafeInput(entityKey(entity), useCase)
+
+			h.mutex.Lock()
+			status, exists := h.failsafe[key]
+			if !exists {
+				status = FailsafeStatus{SKI: ski, Entity: address, UseCase: useCase}
+			}
+			if state := nextFailsafeState(status, in, now); state != status.State {
+				slog.Info("Failsafe state changed", "ski", ski, "usecase", useCase, "entity", address, "state", state)
+
+				status.State = state
+				status.Since = now
+				status.History = append(status.History, FailsafeTransition{State: state, Time: now})
+				if len(status.History) > failsafeHistoryLength {
+					status.History = slices.Clone(status.History[len(status.History)-failsafeHistoryLength:])
+				}
+				h.failsafe[key] = status
+				changed = true
+			}
+			h.mutex.Unlock()
+		}
+	}
+
+	if changed {
+		frontend.sendFailsafeStates(GetFailsafeStates, h.failsafeStates())
+	}
+}
+
+// failsafeStates returns the failsafe state of all remote entities sorted by SKI, use case and entity
+func (h *controlbox) failsafeStates() []FailsafeStatus {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	list := make([]FailsafeStatus, 0, len(h.failsafe))
+	for _, status := range h.failsafe {
+		status.History = slices.Clone(status.History)
+		list = append(list, status)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].SKI != list[j].SKI {
+			return list[i].SKI < list[j].SKI
+		}
+		if list[i].UseCase != list[j].UseCase {
+			return list[i].UseCase < list[j].UseCase
+		}
+		return list[i].Entity < list[j].Entity
+	})
+
+	return list
+}
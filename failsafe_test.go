@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+)
+
+func TestNextFailsafeState(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	heartbeat := func(age time.Duration) failsafeInput {
+		return failsafeInput{hasHeartbeat: true, heartbeat: HeartbeatStatus{LastReceived: now.Add(-age)}}
+	}
+	limited := heartbeat(time.Second)
+	limited.limit = ucapi.LoadLimit{IsActive: true, Value: 4200}
+	shortFailsafe := heartbeat(time.Second)
+	shortFailsafe.failsafeDuration = 3 * time.Hour
+	state := func(state string, since time.Duration) FailsafeStatus {
+		return FailsafeStatus{State: state, Since: now.Add(-since)}
+	}
+
+	tests := []struct {
+		name    string
+		current FailsafeStatus
+		in      failsafeInput
+		want    string
+	}{
+		{"no heartbeat yet", FailsafeStatus{}, failsafeInput{}, failsafeStateInit},
+		{"unlimited", state(failsafeStateInit, time.Minute), heartbeat(time.Second), failsafeStateUnlimited},
+		{"limited", state(failsafeStateUnlimited, time.Minute), limited, failsafeStateLimited},
+		{"heartbeat within timeout", state(failsafeStateLimited, time.Minute), heartbeat(heartbeatTimeout), failsafeStateUnlimited},
+		{"heartbeat lost", state(failsafeStateLimited, time.Minute), heartbeat(heartbeatTimeout + time.Second), failsafeStateFailsafe},
+		{"stays in failsafe without heartbeat", state(failsafeStateFailsafe, 3*time.Hour), heartbeat(time.Hour), failsafeStateFailsafe},
+		{"stays in failsafe for the default duration", state(failsafeStateFailsafe, time.Hour), heartbeat(time.Second), failsafeStateFailsafe},
+		{"leaves failsafe after the default duration", state(failsafeStateFailsafe, 2*time.Hour), limited, failsafeStateLimited},
+		{"stays in failsafe for the reported duration", state(failsafeStateFailsafe, 2*time.Hour), shortFailsafe, failsafeStateFailsafe},
+		{"leaves failsafe after the reported duration", state(failsafeStateFailsafe, 3*time.Hour), shortFailsafe, failsafeStateUnlimited},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextFailsafeState(tt.current, tt.in, now); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
+	"maps"
 	"net/http"
 	"slices"
 	"time"
@@ -15,10 +17,6 @@ import (
 
 // web frontend
 
-const (
-	httpdPort int = 7080
-)
-
 const (
 	Text                           = 0
 	QRCode                         = 1
@@ -57,6 +55,24 @@ const (
 	GetCurrentPerPhase             = 34
 	GetVoltagePerPhase             = 35
 	GetFrequency                   = 36
+	GetTrustInfo                   = 37
+	TrustService                   = 38
+	DenyService                    = 39
+	ForgetService                  = 40
+	GetPairingStatus               = 41
+	GetPairingStates               = 42
+	GetHeartbeatInfo               = 43
+	GetFailsafeStates              = 44
+	GetWriteResult                 = 45
+	GetReconcileStates             = 46
+	GetSchedules                   = 47
+	SetSchedule                    = 48
+	DeleteSchedule                 = 49
+	GetGridControl                 = 50
+	GetAggregateLimits             = 51
+	SetAggregateLimit              = 52
+	ValidationFailed               = 53
+	GetHistory                     = 54
 )
 
 type RemoteInfo struct {
@@ -79,6 +95,7 @@ type EntityInfo struct {
 }
 
 type Message struct {
+	ID           string
 	SKI          string
 	Type         int
 	Text         string
@@ -89,14 +106,60 @@ type Message struct {
 	EntityInfos  []EntityInfo
 	UseCaseInfos map[string][]UseCaseInfo
 	UseCase      string
+	Trust        *TrustInfo
+	Pairing      *PairingStatus
+	Pairings     []PairingStatus
+	Heartbeat    *HeartbeatInfo
+	Failsafe     []FailsafeStatus
+	Result       *WriteResult
+	Reconcile    []ReconcileStatus
+	Schedule     *Schedule
+	Schedules    []Schedule
+	GridControl  *GridControlStatus
+	Aggregate    *AggregateLimit
+	Aggregates   []AggregateLimit
+	Override     bool
+	Violations   []ValidationError
+	History      *HistorySeries
 }
 
+func buildEntityInfos(remoteInfos map[string]RemoteInfo) []EntityInfo {
+	entityInfos := []EntityInfo{}
+
+	for _, remoteInfo := range remoteInfos {
+		device := remoteInfo.Device
+		if device != nil {
+			for _, entity := range device.Entities() {
+				features := []string{}
+
+				for _, f := range entity.Features() {
+					features = append(features, f.String()+", "+string(f.Role()))
+				}
+
+				info := EntityInfo{
+					Address:  entity.Address().String(),
+					Name:     string(entity.EntityType()),
+					SKI:      device.Ski(),
+					Type:     string(*device.DeviceType()),
+					Features: features}
+
+				entityInfos = append(entityInfos, info)
+			}
+		}
+	}
+
+	return entityInfos
+}
+
+// readData reads the LPC and LPP data of a remote entity for the given use cases of the device
 func readData(h *controlbox, entity spineapi.EntityRemoteInterface, ucs []string) {
 	ski := entity.Device().Ski()
 
-	if (ucs == nil || slices.Contains(ucs, "LPC")) && slices.Contains(h.remoteInfos[ski].UseCases, "LPC") {
+	if slices.Contains(ucs, "LPC") {
 		if currentLimit, err := h.uclpc.ConsumptionLimit(entity); err == nil {
-			h.consumptionLimits = currentLimit
+			h.limits.update(entityKey(entity), func(limits *entityLimits) {
+				limits.ConsumptionLimits = currentLimit
+			})
 
 			frontend.sendLimit(ski, GetConsumptionLimit, "LPC", ucapi.LoadLimit{
 				IsActive: currentLimit.IsActive,
@@ -105,27 +168,35 @@ func readData(h *controlbox, entity spineapi.EntityRemoteInterface, ucs []string
 		}
 
 		if limit, err := h.uclpc.FailsafeConsumptionActivePowerLimit(entity); err == nil {
-			h.consumptionFailsafeLimits.Value = limit
+			h.limits.update(entityKey(entity), func(limits *entityLimits) {
+				limits.ConsumptionFailsafeLimits.Value = limit
+			})
 
 			frontend.sendValue(ski, GetConsumptionFailsafeValue, "LPC", limit)
 		}
 
 		if duration, err := h.uclpc.FailsafeDurationMinimum(entity); err == nil {
-			h.consumptionFailsafeLimits.Duration = duration
+			h.limits.update(entityKey(entity), func(limits *entityLimits) {
+				limits.ConsumptionFailsafeLimits.Duration = duration
+			})
 
 			frontend.sendValue(ski, GetConsumptionFailsafeDuration, "LPC", float64(duration/time.Second))
 		}
 
 		if nominal, err := h.uclpc.ConsumptionNominalMax(entity); err == nil {
-			h.consumptionNominalMax = nominal
+			h.limits.update(entityKey(entity), func(limits *entityLimits) {
+				limits.ConsumptionNominalMax = nominal
+			})
 
 			frontend.sendValue(ski, GetConsumptionNominalMax, "LPC", nominal)
 		}
 	}
 
-	if (ucs == nil || slices.Contains(ucs, "LPP")) && slices.Contains(h.remoteInfos[ski].UseCases, "LPP") {
+	if slices.Contains(ucs, "LPP") {
 		if currentLimit, err := h.uclpp.ProductionLimit(entity); err == nil {
-			h.productionLimits = currentLimit
+			h.limits.update(entityKey(entity), func(limits *entityLimits) {
+				limits.ProductionLimits = currentLimit
+			})
 
 			frontend.sendLimit(ski, GetProductionLimit, "LPP", ucapi.LoadLimit{
 				IsActive: currentLimit.IsActive,
@@ -134,49 +205,61 @@ func readData(h *controlbox, entity spineapi.EntityRemoteInterface, ucs []string
 		}
 
 		if limit, err := h.uclpp.FailsafeProductionActivePowerLimit(entity); err == nil {
-			h.productionFailsafeLimits.Value = limit
+			h.limits.update(entityKey(entity), func(limits *entityLimits) {
+				limits.ProductionFailsafeLimits.Value = limit
+			})
 
 			frontend.sendValue(ski, GetProductionFailsafeValue, "LPP", limit)
 		}
 
 		if duration, err := h.uclpp.FailsafeDurationMinimum(entity); err == nil {
-			h.productionFailsafeLimits.Duration = duration
+			h.limits.update(entityKey(entity), func(limits *entityLimits) {
+				limits.ProductionFailsafeLimits.Duration = duration
+			})
 
 			frontend.sendValue(ski, GetProductionFailsafeDuration, "LPP", float64(duration/time.Second))
 		}
 
 		if nominal, err := h.uclpp.ProductionNominalMax(entity); err == nil {
-			h.productionNominalMax = nominal
+			h.limits.update(entityKey(entity), func(limits *entityLimits) {
+				limits.ProductionNominalMax = nominal
+			})
 
 			frontend.sendValue(ski, GetProductionNominalMax, "LPP", nominal)
 		}
 	}
 }
 
-func sendData(h *controlbox, ski string, uc string) {
+func sendData(h *controlbox, client *WebsocketClient, ski string, uc string) {
+	limits := h.limits.device(ski)
+
 	switch uc {
 	case "":
-		frontend.sendText(QRCode, h.myService.QRCodeText())
+		client.sendText(QRCode, h.myService.QRCodeText())
 
 	case "LPC":
-		frontend.sendLimit(ski, GetConsumptionLimit, "LPC", ucapi.LoadLimit{
-			IsActive: h.consumptionLimits.IsActive,
-			Duration: h.consumptionLimits.Duration / time.Second,
-			Value:    h.consumptionLimits.Value})
+		client.sendLimit(ski, GetConsumptionLimit, "LPC", ucapi.LoadLimit{
+			IsActive: limits.ConsumptionLimits.IsActive,
+			Duration: limits.ConsumptionLimits.Duration / time.Second,
+			Value:    limits.ConsumptionLimits.Value})
 
-		frontend.sendValue(ski, GetConsumptionFailsafeValue, "LPC", h.consumptionFailsafeLimits.Value)
+		client.sendValue(ski, GetConsumptionFailsafeValue, "LPC", limits.ConsumptionFailsafeLimits.Value)
 
-		frontend.sendValue(ski, GetConsumptionFailsafeDuration, "LPC", float64(h.consumptionFailsafeLimits.Duration/time.Second))
+		client.sendValue(ski, GetConsumptionFailsafeDuration, "LPC", float64(limits.ConsumptionFailsafeLimits.Duration/time.Second))
+
+		client.sendValue(ski, GetConsumptionNominalMax, "LPC", limits.ConsumptionNominalMax)
 
 	case "LPP":
-		frontend.sendLimit(ski, GetProductionLimit, "LPP", ucapi.LoadLimit{
-			IsActive: h.productionLimits.IsActive,
-			Duration: h.productionLimits.Duration / time.Second,
-			Value:    h.productionLimits.Value})
+		client.sendLimit(ski, GetProductionLimit, "LPP", ucapi.LoadLimit{
+			IsActive: limits.ProductionLimits.IsActive,
+			Duration: limits.ProductionLimits.Duration / time.Second,
+			Value:    limits.ProductionLimits.Value})
+
+		client.sendValue(ski, GetProductionFailsafeValue, "LPP", limits.ProductionFailsafeLimits.Value)
 
-		frontend.sendValue(ski, GetProductionFailsafeValue, "LPP", h.productionFailsafeLimits.Value)
+		client.sendValue(ski, GetProductionFailsafeDuration, "LPP", float64(limits.ProductionFailsafeLimits.Duration/time.Second))
 
-		frontend.sendValue(ski, GetProductionFailsafeDuration, "LPP", float64(h.productionFailsafeLimits.Duration/time.Second))
+		client.sendValue(ski, GetProductionNominalMax, "LPP", limits.ProductionNominalMax)
 
 	default:
 		return
@@ -197,26 +280,34 @@ func serveWs(h *controlbox, w http.ResponseWriter, r *http.Request) {
 
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println("upgrade error:", err)
+		slog.Error("Websocket upgrade failed", "error", err)
 		return
 	}
 
-	frontend = WebsocketClient{
-		websocket: ws}
+	client := frontend.register(ws)
+	defer frontend.unregister(client)
 
-	frontend.sendServiceList(GetServiceList, h.currentRemoteServices)
+	client.sendServiceList(GetServiceList, h.remoteServices())
 
-	sendData(h, "", "")
+	sendData(h, client, "", "")
+	client.sendTrustInfo(GetTrustInfo, h.trustInfo())
+	client.sendPairingStates(GetPairingStates, h.pairingStatusList())
+	client.sendHeartbeatInfo(GetHeartbeatInfo, h.heartbeatInfo())
+	client.sendFailsafeStates(GetFailsafeStates, h.failsafeStates())
+	client.sendReconcileStates(GetReconcileStates, h.reconcileStates())
+	client.sendSchedules(GetSchedules, h.scheduleList())
+	client.sendGridControl(GetGridControl, h.gridControlStatus())
+	client.sendAggregateLimits(GetAggregateLimits, h.aggregateLimits())
 
-	if err := reader(h, ws); err != nil {
-		log.Println(err)
+	if err := reader(h, client); err != nil {
+		slog.Debug("Frontend disconnected", "error", err)
 	}
 }
 
-func reader(h *controlbox, ws *websocket.Conn) error {
+func reader(h *controlbox, client *WebsocketClient) error {
 	for {
 		// read in a message
-		_, p, err := ws.ReadMessage()
+		_, p, err := client.websocket.ReadMessage()
 		if err != nil {
 			return err
 		}
@@ -226,95 +317,117 @@ func reader(h *controlbox, ws *websocket.Conn) error {
 			return err
 		}
 
+		// results of writes are reported back to this client only
+		origin := newWriteOrigin(data.ID, func(result WriteResult) {
+			client.sendWriteResult(GetWriteResult, result)
+		})
+
+		// violated rules are reported back to this client unless the message overrides the validation
+		origin.override = data.Override
+		reportViolations := func(useCase string, err error) {
+			var violations ValidationErrors
+			if errors.As(err, &violations) {
+				client.sendValidationErrors(ValidationFailed, data.ID, data.SKI, useCase, violations)
+			}
+		}
+
 		switch data.Type {
 		case GetServiceList:
-			frontend.sendServiceList(GetServiceList, h.currentRemoteServices)
+			client.sendServiceList(GetServiceList, h.remoteServices())
 		case SelectService:
-			remoteSki = data.Text
-
-			info, exists := h.remoteInfos[remoteSki]
-			if !exists {
-				connected, exists2 := h.isConnected[remoteSki]
-				if !exists2 || !connected {
-					// TODO
-					// second parameter shipID is optional, but if available it should be provided
-					// => test if available
-					h.myService.RegisterRemoteSKI(remoteSki, "")
-				}
-			} else if info.Device != nil {
-				for _, entity := range info.Device.Entities() {
-					readData(h, entity, nil)
-				}
-			}
+			client.selectSki(data.Text)
+			h.selectService(data.Text)
 		case GetEntityInfos:
-			if nil != h.remoteInfos {
-				frontend.sendEntityInfo(GetEntityInfos, h.remoteInfos)
-			}
+			h.mutex.Lock()
+			remoteInfos := maps.Clone(h.remoteInfos)
+			h.mutex.Unlock()
+			client.sendEntityInfo(GetEntityInfos, remoteInfos)
 		case GetUseCaseInfos:
-			if nil != h.remoteInfos {
-				frontend.sendUseCaseInfo(GetUseCaseInfos, h.useCaseInfos)
-			}
+			h.mutex.Lock()
+			useCaseInfos := maps.Clone(h.useCaseInfos)
+			h.mutex.Unlock()
+			client.sendUseCaseInfo(GetUseCaseInfos, useCaseInfos)
+		case GetTrustInfo:
+			client.sendTrustInfo(GetTrustInfo, h.trustInfo())
+		case GetPairingStates:
+			client.sendPairingStates(GetPairingStates, h.pairingStatusList())
+		case TrustService:
+			h.trustService(data.Text)
+		case DenyService:
+			h.denyService(data.Text)
+		case ForgetService:
+			h.forgetService(data.Text)
 		case GetAllData:
-			sendData(h, data.SKI, data.Text)
+			sendData(h, client, data.SKI, data.Text)
 		case SetConsumptionLimit:
 			var limit = data.Limit
+			limit.Duration *= time.Second
 
-			h.consumptionLimits.IsActive = limit.IsActive
-			h.consumptionLimits.Value = limit.Value
-			h.consumptionLimits.Duration = limit.Duration * time.Second
-
-			for _, remoteEntityScenario := range h.uclpc.RemoteEntitiesScenarios() {
-				h.sendConsumptionLimit(remoteEntityScenario.Entity)
-			}
+			reportViolations("LPC", h.setConsumptionLimit(data.SKI, limit, origin))
 		case SetProductionLimit:
 			var limit = data.Limit
+			limit.Duration *= time.Second
 
-			h.productionLimits.IsActive = limit.IsActive
-			h.productionLimits.Value = limit.Value
-			h.productionLimits.Duration = limit.Duration * time.Second
-
-			for _, remoteEntityScenario := range h.uclpp.RemoteEntitiesScenarios() {
-				h.sendProductionLimit(remoteEntityScenario.Entity)
-			}
+			reportViolations("LPP", h.setProductionLimit(data.SKI, limit, origin))
 		case SetConsumptionFailsafeValue:
-			var limit = data.Value
-
-			h.consumptionFailsafeLimits.Value = limit
-
-			for _, remoteEntityScenario := range h.uclpc.RemoteEntitiesScenarios() {
-				h.sendConsumptionFailsafeLimit(remoteEntityScenario.Entity)
-			}
+			reportViolations("LPC", h.setConsumptionFailsafeValue(data.SKI, data.Value, origin))
 		case SetConsumptionFailsafeDuration:
-			var limit = data.Value
-
-			h.consumptionFailsafeLimits.Duration = time.Duration(limit) * time.Second
-
-			for _, remoteEntityScenario := range h.uclpc.RemoteEntitiesScenarios() {
-				h.sendConsumptionFailsafeDuration(remoteEntityScenario.Entity)
-			}
+			duration := time.Duration(data.Value) * time.Second
+			reportViolations("LPC", h.setConsumptionFailsafeDuration(data.SKI, duration, origin))
 		case SetProductionFailsafeValue:
-			var limit = data.Value
-
-			h.productionFailsafeLimits.Value = limit
-
-			for _, remoteEntityScenario := range h.uclpp.RemoteEntitiesScenarios() {
-				h.sendProductionFailsafeLimit(remoteEntityScenario.Entity)
-			}
+			reportViolations("LPP", h.setProductionFailsafeValue(data.SKI, data.Value, origin))
 		case SetProductionFailsafeDuration:
-			var limit = data.Value
-
-			h.productionFailsafeLimits.Duration = time.Duration(limit) * time.Second
-
-			for _, remoteEntityScenario := range h.uclpp.RemoteEntitiesScenarios() {
-				h.sendProductionFailsafeDuration(remoteEntityScenario.Entity)
+			duration := time.Duration(data.Value) * time.Second
+			reportViolations("LPP", h.setProductionFailsafeDuration(data.SKI, duration, origin))
+		case StopConsumptionHeartbeat:
+			_ = h.setHeartbeat("LPC", false)
+		case StartConsumptionHeartbeat:
+			_ = h.setHeartbeat("LPC", true)
+		case StopProductionHeartbeat:
+			_ = h.setHeartbeat("LPP", false)
+		case StartProductionHeartbeat:
+			_ = h.setHeartbeat("LPP", true)
+		case GetHeartbeatInfo:
+			client.sendHeartbeatInfo(GetHeartbeatInfo, h.heartbeatInfo())
+		case GetFailsafeStates:
+			client.sendFailsafeStates(GetFailsafeStates, h.failsafeStates())
+		case GetReconcileStates:
+			client.sendReconcileStates(GetReconcileStates, h.reconcileStates())
+		case GetSchedules:
+			client.sendSchedules(GetSchedules, h.scheduleList())
+		case GetGridControl:
+			client.sendGridControl(GetGridControl, h.gridControlStatus())
+		case GetHistory:
+			// Text is the metric, Value the interval in seconds
+			series, err := h.history.query(data.SKI, data.UseCase, data.Text, time.Time{}, time.Time{}, time.Duration(data.Value)*time.Second)
+			if err == nil {
+				series.Interval /= time.Second
+				client.sendHistory(GetHistory, series)
+			}
+		case GetAggregateLimits:
+			client.sendAggregateLimits(GetAggregateLimits, h.aggregateLimits())
+		case SetAggregateLimit:
+			if data.Aggregate == nil {
+				break
+			}
+			limit := *data.Aggregate
+			limit.Duration *= time.Second
+			if err := h.setAggregateLimit(limit); err != nil {
+				client.sendText(Text, err.Error())
+			}
+		case SetSchedule:
+			if data.Schedule == nil {
+				break
+			}
+			if _, err := h.saveSchedule(*data.Schedule); err != nil {
+				client.sendText(Text, err.Error())
+			}
+		case DeleteSchedule:
+			if err := h.deleteSchedule(data.Text); err != nil {
+				client.sendText(Text, err.Error())
 			}
-			// TODO
-			// case StopConsumptionHeartbeat:
-			// 	h.uclpc.StopHeartbeat()
-			// case StartConsumptionHeartbeat:
-			// 	h.uclpc.StartHeartbeat()
 		}
 
-		frontend.sendNotification("", Acknowledge, "")
+		client.sendNotification("", Acknowledge, "")
 	}
 }
@@ -3,11 +3,13 @@ module controlbox
 go 1.25.5
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.5.1
 	github.com/enbility/eebus-go v0.7.1-0.20250703122432-c2d97a2e53e0
 	github.com/enbility/ship-go v0.6.1-0.20251013112153-09af9aacc65c
 	github.com/enbility/spine-go v0.7.1-0.20250822155603-08a28fe4480c
 	github.com/gorilla/websocket v1.5.3
 	github.com/joho/godotenv v1.5.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -21,8 +23,8 @@ require (
 	github.com/rickb777/plural v1.4.4 // indirect
 	gitlab.com/c0b/go-ordered-json v0.0.0-20201030195603-febf46534d5a // indirect
 	golang.org/x/mod v0.25.0 // indirect
-	golang.org/x/net v0.41.0 // indirect
-	golang.org/x/sync v0.15.0 // indirect
-	golang.org/x/sys v0.33.0 // indirect
+	golang.org/x/net v0.44.0 // indirect
+	golang.org/x/sync v0.17.0 // indirect
+	golang.org/x/sys v0.36.0 // indirect
 	golang.org/x/tools v0.34.0 // indirect
 )
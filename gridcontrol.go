@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+)
+
+// Grid connection point control
+//
+// When enabled with GRID_CONTROL, the power measured at the grid connection
+// point via MGCP is kept below GRID_CONTROL_THRESHOLD by limiting the LPC
+// consumers. While the import exceeds the threshold the aggregate limit of the
+// consumers is lowered by the excess power, starting from the power the
+// consumers measure via MPC, or their nominal maximum if they do not. Once
+// the import is below the threshold minus the hysteresis the limit is raised
+// again by the headroom and released when it reaches the nominal maximum of
+// the consumers. Limits are changed at most once per hold time, also after a
+// release, except for the first activation. Measurements are processed in
+// order by a single goroutine. The consumer limits are combined with the
+// aggregate limits, the lower one applies. In dry-run mode the decisions are
+// only logged.
+
+// measurements waiting for the controller, further ones are dropped
+const gridMeasurementQueue = 16
+
+// GridControlStatus is the configuration and current decision of the grid connection point controller
+type GridControlStatus struct {
+	Enabled    bool
+	DryRun     bool
+	SKI        string  `json:",omitempty"` // grid connection point, any if empty
+	Threshold  float64 // W
+	Hysteresis float64 // W
+	HoldTime   time.Duration
+	MinLimit   float64 // W
+
+	Power      float64 // W, last measured import
+	Active     bool
+	Limit      float64   // W, aggregate limit of all consumers
+	LastChange time.Time `json:",omitempty"`
+	Decision   string    `json:",omitempty"`
+}
+
+type gridMeasurement struct {
+	ski   string
+	power float64
+}
+
+type gridController struct {
+	status       GridControlStatus
+	measurements chan gridMeasurement
+
+	mutex sync.Mutex
+}
+
+func newGridController() *gridController {
+	return &gridController{
+		status: GridControlStatus{
+			Enabled:    envBool("GRID_CONTROL", false),
+			DryRun:     envBool("GRID_CONTROL_DRY_RUN", false),
+			SKI:        os.Getenv("GRID_CONTROL_SKI"),
+			Threshold:  envFloat("GRID_CONTROL_THRESHOLD", 11000),
+			Hysteresis: envFloat("GRID_CONTROL_HYSTERESIS", 500),
+			HoldTime:   envDuration("GRID_CONTROL_HOLD", time.Minute),
+			MinLimit:   envFloat("GRID_CONTROL_MIN_LIMIT", 0),
+		},
+		measurements: make(chan gridMeasurement, gridMeasurementQueue),
+	}
+}
+
+// gridControlStatus returns the controller status with the hold time in seconds like the other durations of the frontend and API
+func (h *controlbox) gridControlStatus() GridControlStatus {
+	h.gridControl.mutex.Lock()
+	defer h.gridControl.mutex.Unlock()
+
+	status := h.gridControl.status
+	status.HoldTime /= time.Second
+	return status
+}
+
+// consumerCapacity returns the sum of the nominal maximum of all connected LPC consumers,
+// or the threshold if the consumers did not report it
+func (h *controlbox) consumerCapacity(threshold float64) float64 {
+	capacity := 0.0
+	seen := map[string]bool{}
+	for _, entity := range remoteEntities(h.uclpc, "") {
+		ski := entity.Device().Ski()
+		if seen[ski] {
+			continue
+		}
+		seen[ski] = true
+		capacity += h.limits.nominalMax(ski, "LPC")
+	}
+
+	if capacity == 0 {
+		return threshold
+	}
+	return capacity
+}
+
+// consumerPower returns the sum of the power measured via MPC at the connected LPC consumers,
+// or nil if none of them reported it
+func (h *controlbox) consumerPower() *float64 {
+	var power *float64
+	seen := map[string]bool{}
+	for _, entity := range remoteEntities(h.uclpc, "") {
+		ski := entity.Device().Ski()
+		if seen[ski] {
+			continue
+		}
+		seen[ski] = true
+		for _, mpcEntity := range remoteEntities(h.ucmpc, ski) {
+			value, err := h.ucmpc.Power(mpcEntity)
+			if err != nil {
+				continue
+			}
+			if power == nil {
+				power = new(float64)
+			}
+			*power += value
+		}
+	}
+
+	return power
+}
+
+// nextGridControlStatus returns the controller status after a power measurement and the decision, if any.
+// The first limit is the measured power of the consumers minus the excess, or their capacity if they
+// did not report their power.
+func nextGridControlStatus(status GridControlStatus, power float64, consumption *float64, capacity float64, now time.Time) (GridControlStatus, string) {
+	status.Power = power
+	holding := !status.LastChange.IsZero() && now.Sub(status.LastChange) < status.HoldTime
+
+	decision := ""
+	switch {
+	case power > status.Threshold && !holding:
+		base := capacity
+		if status.Active {
+			base = status.Limit
+		} else if consumption != nil {
+			base = *consumption
+		}
+		limit := math.Max(status.MinLimit, math.Round(base-(power-status.Threshold)))
+		if status.Active && limit == status.Limit {
+			break
+		}
+		status.Active = true
+		status.Limit = limit
+		decision = fmt.Sprintf("import of %.0f W above threshold of %.0f W, limiting consumers to %.0f W", power, status.Threshold, limit)
+	case status.Active && !holding && power < status.Threshold-status.Hysteresis:
+		limit := math.Round(status.Limit + (status.Threshold - status.Hysteresis - power))
+		if limit >= capacity {
+			status.Active = false
+			status.Limit = 0
+			decision = fmt.Sprintf("import of %.0f W below threshold, releasing consumers", power)
+			break
+		}
+		status.Limit = limit
+		decision = fmt.Sprintf("import of %.0f W below threshold, raising consumers to %.0f W", power, limit)
+	}
+
+	if decision != "" {
+		status.LastChange = now
+		status.Decision = decision
+	}
+	return status, decision
+}
+
+// gridPowerUpdated queues a power measurement of a grid connection point for the controller
+func (h *controlbox) gridPowerUpdated(ski string, power float64) {
+	c := h.gridControl
+	c.mutex.Lock()
+	enabled, gridSKI := c.status.Enabled, c.status.SKI
+	c.mutex.Unlock()
+	if !enabled || (gridSKI != "" && gridSKI != ski) {
+		return
+	}
+
+	select {
+	case c.measurements <- gridMeasurement{ski: ski, power: power}:
+	default:
+		slog.Warn("Grid control measurement dropped", "ski", ski, "power", power)
+	}
+}
+
+// runGridControl runs the controller for the queued measurements in order
+func (h *controlbox) runGridControl() {
+	for measurement := range h.gridControl.measurements {
+		h.controlGridPower(measurement.power)
+	}
+}
+
+func (h *controlbox) controlGridPower(power float64) {
+	c := h.gridControl
+
+	c.mutex.Lock()
+	threshold := c.status.Threshold
+	c.mutex.Unlock()
+	capacity := h.consumerCapacity(threshold)
+	consumption := h.consumerPower()
+
+	c.mutex.Lock()
+	status, decision := nextGridControlStatus(c.status, power, consumption, capacity, time.Now())
+	c.status = status
+	c.mutex.Unlock()
+
+	if decision != "" {
+		if status.DryRun {
+			slog.Info("Grid control", "decision", decision, "dryrun", true)
+		} else {
+			slog.Info("Grid control", "decision", decision)
+			h.applyGridLimit(status.Active, status.Limit)
+		}
+	}
+
+	frontend.sendGridControl(GetGridControl, h.gridControlStatus())
+}
+
+// applyGridLimit splits the aggregate limit across the connected consumers
+// with the default strategy of the aggregate limits
+func (h *controlbox) applyGridLimit(active bool, limit float64) {
+	skis, nominalMax := h.limitDevices("LPC")
+	shares := distributeLimit(limit, skis, nominalMax, h.aggregates.strategy, h.aggregates.priority)
+
+	origin := writeOrigin{id: "gridcontrol-" + newWriteID()}
+	for _, ski := range skis {
+		loadLimit := ucapi.LoadLimit{IsActive: false, DeleteDuration: true}
+		if share, ok := shares[ski]; active && ok {
+			loadLimit = ucapi.LoadLimit{IsActive: true, Value: share}
+		}
+		// a rejected limit is logged and requested again with the next decision
+		_ = h.requestLimit(limitSourceGridControl, "LPC", ski, loadLimit, origin)
+	}
+}
+
+// startGridControl logs the configuration and starts the controller if enabled
+func (h *controlbox) startGridControl() {
+	status := h.gridControlStatus()
+	if !status.Enabled {
+		return
+	}
+	slog.Info("Grid control enabled", "threshold", status.Threshold, "hysteresis", status.Hysteresis, "hold", status.HoldTime*time.Second, "dryrun", status.DryRun)
+
+	go h.runGridControl()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextGridControlStatus(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	config := GridControlStatus{Threshold: 11000, Hysteresis: 500, HoldTime: time.Minute, MinLimit: 1000}
+	limited := func(limit float64, lastChange time.Duration) GridControlStatus {
+		status := config
+		status.Active = true
+		status.Limit = limit
+		status.LastChange = now.Add(-lastChange)
+		return status
+	}
+	released := config
+	released.LastChange = now.Add(-30 * time.Second)
+
+	measured := func(power float64) *float64 { return &power }
+
+	tests := []struct {
+		name        string
+		status      GridControlStatus
+		power       float64
+		consumption *float64
+		wantActive  bool
+		wantLimit   float64
+		decided     bool
+	}{
+		{"below threshold", config, 10000, nil, false, 0, false},
+		{"first activation", config, 12000, measured(8000), true, 7000, true},
+		{"first activation without measurement", config, 12000, nil, true, 21000, true},
+		{"not below min limit", config, 40000, measured(8000), true, 1000, true},
+		{"lowered further", limited(8000, 2*time.Minute), 11500, measured(8000), true, 7500, true},
+		{"held after change", limited(8000, 30*time.Second), 11500, measured(8000), true, 8000, false},
+		{"within hysteresis", limited(8000, 2*time.Minute), 10800, measured(8000), true, 8000, false},
+		{"raised", limited(8000, 2*time.Minute), 9500, measured(8000), true, 9000, true},
+		{"released at capacity", limited(21000, 2*time.Minute), 9000, measured(8000), false, 0, true},
+		{"held after release", released, 12000, measured(8000), false, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, decision := nextGridControlStatus(tt.status, tt.power, tt.consumption, 22000, now)
+			if status.Active != tt.wantActive || status.Limit != tt.wantLimit {
+				t.Errorf("got active %v limit %v, want active %v limit %v", status.Active, status.Limit, tt.wantActive, tt.wantLimit)
+			}
+			if (decision != "") != tt.decided {
+				t.Errorf("got decision %q, want decision %v", decision, tt.decided)
+			}
+			if tt.decided && !status.LastChange.Equal(now) {
+				t.Errorf("last change not updated")
+			}
+			if status.Power != tt.power {
+				t.Errorf("got power %v, want %v", status.Power, tt.power)
+			}
+		})
+	}
+}
+
+func TestGridControlFirstStep(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	config := GridControlStatus{Threshold: 11000, Hysteresis: 500, HoldTime: time.Minute}
+	consumption := 8000.0
+
+	status, _ := nextGridControlStatus(config, 12500, &consumption, 22000, now)
+	if !status.Active || status.Limit != 6500 {
+		t.Fatalf("got active %v limit %v, want 6500 W", status.Active, status.Limit)
+	}
+
+	// the consumers follow the limit, so the import drops by what they no longer draw
+	power := 12500 - (consumption - status.Limit)
+	consumption = status.Limit
+	status, decision := nextGridControlStatus(status, power, &consumption, 22000, now.Add(2*time.Minute))
+	if power > config.Threshold || decision != "" {
+		t.Errorf("got import of %v W and decision %q, want the import at the threshold after one step", power, decision)
+	}
+	if !status.Active || status.Limit != 6500 {
+		t.Errorf("got active %v limit %v, want the limit kept", status.Active, status.Limit)
+	}
+}
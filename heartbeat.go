@@ -0,0 +1,175 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"time"
+
+	spineapi "github.com/enbility/spine-go/api"
+)
+
+// Heartbeat control and monitoring
+//
+// LPC and LPP are served by the same local entity, which sends a single
+// heartbeat. The heartbeat is started and stopped per use case and is sent
+// as long as one of the enabled use cases is not stopped, so stopping it for
+// failsafe tests requires stopping both if both are enabled. The state
+// reported for a use case is that of the shared heartbeat.
+
+// a remote heartbeat is lost if none was received within this duration,
+// the same duration is used by the use cases
+const heartbeatTimeout = 2 * time.Minute
+
+const heartbeatCheckInterval = 10 * time.Second
+
+// HeartbeatStatus is the heartbeat received from a remote device for a use case
+type HeartbeatStatus struct {
+	SKI          string
+	UseCase      string
+	LastReceived time.Time
+	Lost         bool
+}
+
+// HeartbeatInfo is the state of the own heartbeat per use case and of all remote heartbeats
+type HeartbeatInfo struct {
+	Sending map[string]bool
+	Remote  []HeartbeatStatus
+}
+
+func heartbeatKey(ski, useCase string) string {
+	return ski + "/" + useCase
+}
+
+func (h *controlbox) heartbeatManager() spineapi.HeartbeatManagerInterface {
+	entity := h.myService.LocalDevice().EntityForType(h.config.entityType())
+	if entity == nil {
+		return nil
+	}
+	return entity.HeartbeatManager()
+}
+
+// heartbeatSending returns whether the shared heartbeat is sent, for each enabled LPC and LPP use case
+func (h *controlbox) heartbeatSending() map[string]bool {
+	manager := h.heartbeatManager()
+	running := manager != nil && manager.IsHeartbeatRunning()
+
+	sending := map[string]bool{}
+	for _, useCase := range []string{"LPC", "LPP"} {
+		if h.config.useCaseEnabled(useCase) {
+			sending[useCase] = running
+		}
+	}
+	return sending
+}
+
+func (h *controlbox) heartbeatInfo() HeartbeatInfo {
+	info := HeartbeatInfo{
+		Sending: h.heartbeatSending(),
+		Remote:  []HeartbeatStatus{},
+	}
+
+	h.mutex.Lock()
+	for _, status := range h.heartbeats {
+		info.Remote = append(info.Remote, status)
+	}
+	h.mutex.Unlock()
+
+	sort.Slice(info.Remote, func(i, j int) bool {
+		return heartbeatKey(info.Remote[i].SKI, info.Remote[i].UseCase) < heartbeatKey(info.Remote[j].SKI, info.Remote[j].UseCase)
+	})
+
+	return info
+}
+
+// setHeartbeat starts or stops the own heartbeat of a use case
+func (h *controlbox) setHeartbeat(useCase string, sending bool) error {
+	manager := h.heartbeatManager()
+	if (useCase != "LPC" && useCase != "LPP") || !h.config.useCaseEnabled(useCase) || manager == nil {
+		return errUseCaseNotAvailable
+	}
+
+	h.mutex.Lock()
+	h.heartbeatStopped[useCase] = !sending
+
+	// the heartbeat of the local entity is shared, it runs while any use case is sending
+	running := false
+	for _, uc := range []string{"LPC", "LPP"} {
+		running = running || (h.config.useCaseEnabled(uc) && !h.heartbeatStopped[uc])
+	}
+	switch {
+	case running && !manager.IsHeartbeatRunning():
+		_ = manager.StartHeartbeat()
+	case !running:
+		manager.StopHeartbeat()
+	}
+	h.mutex.Unlock()
+
+	slog.Info("Heartbeat", "usecase", useCase, "sending", sending)
+	if !sending && running {
+		slog.Info("Heartbeat still sent for the other use case", "usecase", useCase)
+	}
+
+	frontend.sendHeartbeatInfo(GetHeartbeatInfo, h.heartbeatInfo())
+	return nil
+}
+
+// heartbeatReceived records a heartbeat of a remote device
+func (h *controlbox) heartbeatReceived(ski, useCase string) {
+	key := heartbeatKey(ski, useCase)
+
+	h.mutex.Lock()
+	status, exists := h.heartbeats[key]
+	changed := !exists || status.Lost
+	status = HeartbeatStatus{
+		SKI:          ski,
+		UseCase:      useCase,
+		LastReceived: time.Now(),
+	}
+	h.heartbeats[key] = status
+	h.mutex.Unlock()
+
+	if exists && changed {
+		slog.Info("Heartbeat restored", "ski", ski, "usecase", useCase)
+	}
+	if changed {
+		frontend.sendHeartbeatInfo(GetHeartbeatInfo, h.heartbeatInfo())
+	}
+
+	h.evaluateFailsafe()
+}
+
+// runHeartbeatMonitor periodically checks the remote heartbeats, reports their loss
+// and updates the failsafe states
+func (h *controlbox) runHeartbeatMonitor() {
+	ticker := time.NewTicker(heartbeatCheckInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if h.checkHeartbeats(now) {
+			frontend.sendHeartbeatInfo(GetHeartbeatInfo, h.heartbeatInfo())
+		}
+
+		h.evaluateFailsafe()
+	}
+}
+
+// checkHeartbeats marks the remote heartbeats not received within the timeout as lost
+// and returns whether one was lost
+func (h *controlbox) checkHeartbeats(now time.Time) bool {
+	changed := false
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for key, status := range h.heartbeats {
+		if status.Lost || now.Sub(status.LastReceived) <= heartbeatTimeout {
+			continue
+		}
+		slog.Warn("Heartbeat lost", "ski", status.SKI, "usecase", status.UseCase, "received", status.LastReceived)
+		status.Lost = true
+		h.heartbeats[key] = status
+		changed = true
+	}
+
+	return changed
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/enbility/eebus-go/usecases/eg/lpc"
+	"github.com/enbility/eebus-go/usecases/eg/lpp"
+)
+
+// newHeartbeatTestControlbox returns a ControlBox serving the given LPC and LPP use cases
+func newHeartbeatTestControlbox(t *testing.T, useCases ...string) *controlbox {
+	h := newTestControlbox(t)
+	h.config = defaultDeviceConfig()
+	h.config.UseCases = useCases
+	h.heartbeats = map[string]HeartbeatStatus{}
+	h.heartbeatStopped = map[string]bool{}
+
+	entity := h.myService.LocalDevice().EntityForType(h.config.entityType())
+	if h.config.useCaseEnabled("LPC") {
+		h.uclpc = lpc.NewLPC(entity, h.OnLPCEvent)
+		h.myService.AddUseCase(h.uclpc)
+	}
+	if h.config.useCaseEnabled("LPP") {
+		h.uclpp = lpp.NewLPP(entity, h.OnLPPEvent)
+		h.myService.AddUseCase(h.uclpp)
+	}
+	return h
+}
+
+func TestSetHeartbeat(t *testing.T) {
+	type step struct {
+		useCase string
+		sending bool
+		want    map[string]bool
+	}
+	tests := []struct {
+		name     string
+		useCases []string
+		steps    []step
+	}{
+		{
+			name:     "shared by LPC and LPP",
+			useCases: []string{"LPC", "LPP"},
+			steps: []step{
+				{"LPC", true, map[string]bool{"LPC": true, "LPP": true}},
+				// LPP still needs the heartbeat, the shared state is reported
+				{"LPC", false, map[string]bool{"LPC": true, "LPP": true}},
+				{"LPP", false, map[string]bool{"LPC": false, "LPP": false}},
+				{"LPP", true, map[string]bool{"LPC": true, "LPP": true}},
+			},
+		},
+		{
+			name:     "LPC only",
+			useCases: []string{"LPC"},
+			steps: []step{
+				{"LPC", true, map[string]bool{"LPC": true}},
+				{"LPC", false, map[string]bool{"LPC": false}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHeartbeatTestControlbox(t, tt.useCases...)
+			for i, step := range tt.steps {
+				if err := h.setHeartbeat(step.useCase, step.sending); err != nil {
+					t.Fatalf("step %d: %v", i, err)
+				}
+				if got := h.heartbeatSending(); !maps.Equal(got, step.want) {
+					t.Errorf("step %d: got %v, want %v", i, got, step.want)
+				}
+				if got := h.heartbeatManager().IsHeartbeatRunning(); got != step.want[step.useCase] {
+					t.Errorf("step %d: heartbeat running %t, want %t", i, got, step.want[step.useCase])
+				}
+			}
+		})
+	}
+}
+
+func TestSetHeartbeatUnavailable(t *testing.T) {
+	h := newHeartbeatTestControlbox(t, "LPC")
+
+	for _, useCase := range []string{"LPP", "MPC", ""} {
+		if err := h.setHeartbeat(useCase, false); !errors.Is(err, errUseCaseNotAvailable) {
+			t.Errorf("%q: got error %v, want %v", useCase, err, errUseCaseNotAvailable)
+		}
+	}
+}
+
+func TestCheckHeartbeats(t *testing.T) {
+	h := &controlbox{heartbeats: map[string]HeartbeatStatus{}}
+	now := time.Now()
+	h.heartbeats[heartbeatKey("recent", "LPC")] = HeartbeatStatus{SKI: "recent", UseCase: "LPC", LastReceived: now.Add(-time.Minute)}
+	h.heartbeats[heartbeatKey("old", "LPC")] = HeartbeatStatus{SKI: "old", UseCase: "LPC", LastReceived: now.Add(-heartbeatTimeout - time.Second)}
+
+	if !h.checkHeartbeats(now) {
+		t.Error("no heartbeat lost, want the old one")
+	}
+	if h.heartbeats[heartbeatKey("recent", "LPC")].Lost || !h.heartbeats[heartbeatKey("old", "LPC")].Lost {
+		t.Errorf("got %+v, want only the old heartbeat lost", h.heartbeats)
+	}
+	// a lost heartbeat is reported once
+	if h.checkHeartbeats(now.Add(time.Minute)) {
+		t.Error("lost heartbeat reported again")
+	}
+}
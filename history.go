@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Measurement history
+//
+// The MPC and MGCP values of every device are kept in a ring buffer per
+// SKI, use case and metric. Samples older than HISTORY_RETENTION are dropped
+// and each series keeps at most HISTORY_SAMPLES samples.
+
+var errHistoryNotFound = errors.New("no history for this metric")
+
+// Sample is a measurement at a point in time, values per phase for the per phase metrics
+type Sample struct {
+	Time   time.Time
+	Values []float64
+}
+
+// HistorySeries is the history of a metric, optionally averaged over intervals
+type HistorySeries struct {
+	SKI      string
+	UseCase  string
+	Metric   string
+	Interval time.Duration `json:",omitempty"`
+	Samples  []Sample
+}
+
+// HistoryInfo describes an available series of a device
+type HistoryInfo struct {
+	UseCase string
+	Metric  string
+	Samples int
+	From    time.Time
+	To      time.Time
+}
+
+// ring is a buffer of samples in chronological order, it grows up to its capacity
+// and overwrites the oldest samples afterwards
+type ring struct {
+	samples  []Sample
+	start    int
+	count    int
+	capacity int
+}
+
+func (r *ring) add(sample Sample) {
+	if r.count == len(r.samples) && len(r.samples) < r.capacity {
+		grown := make([]Sample, min(max(2*r.count, 64), r.capacity))
+		for i := 0; i < r.count; i++ {
+			grown[i] = r.at(i)
+		}
+		r.samples = grown
+		r.start = 0
+	}
+
+	index := (r.start + r.count) % len(r.samples)
+	r.samples[index] = sample
+	if r.count < len(r.samples) {
+		r.count++
+	} else {
+		r.start = (r.start + 1) % len(r.samples)
+	}
+}
+
+func (r *ring) at(i int) Sample {
+	return r.samples[(r.start+i)%len(r.samples)]
+}
+
+// dropBefore removes the samples older than t
+func (r *ring) dropBefore(t time.Time) {
+	for r.count > 0 && r.at(0).Time.Before(t) {
+		r.samples[r.start] = Sample{}
+		r.start = (r.start + 1) % len(r.samples)
+		r.count--
+	}
+}
+
+type historyStore struct {
+	retention time.Duration
+	capacity  int
+
+	series map[string]*ring
+
+	mutex sync.Mutex
+}
+
+func newHistoryStore() *historyStore {
+	return &historyStore{
+		retention: envDuration("HISTORY_RETENTION", 24*time.Hour),
+		capacity:  max(envInt("HISTORY_SAMPLES", 20000), 1),
+		series:    map[string]*ring{},
+	}
+}
+
+func historyKey(ski, useCase, metric string) string {
+	return ski + "/" + useCase + "/" + metric
+}
+
+// record adds a measurement of a device
+func (s *historyStore) record(ski, useCase, metric string, values ...float64) {
+	now := time.Now()
+	key := historyKey(ski, useCase, metric)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r, ok := s.series[key]
+	if !ok {
+		r = &ring{capacity: s.capacity}
+		s.series[key] = r
+	}
+	r.dropBefore(now.Add(-s.retention))
+	r.add(Sample{Time: now, Values: append([]float64(nil), values...)})
+}
+
+// list returns the available series of a device
+func (s *historyStore) list(ski string) []HistoryInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cutoff := time.Now().Add(-s.retention)
+	list := []HistoryInfo{}
+	for key, r := range s.series {
+		rest, found := strings.CutPrefix(key, ski+"/")
+		if !found {
+			continue
+		}
+		r.dropBefore(cutoff)
+		if r.count == 0 {
+			continue
+		}
+		useCase, metric, _ := strings.Cut(rest, "/")
+		list = append(list, HistoryInfo{
+			UseCase: useCase,
+			Metric:  metric,
+			Samples: r.count,
+			From:    r.at(0).Time,
+			To:      r.at(r.count - 1).Time,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].UseCase != list[j].UseCase {
+			return list[i].UseCase < list[j].UseCase
+		}
+		return list[i].Metric < list[j].Metric
+	})
+
+	return list
+}
+
+// query returns the samples of a metric between from and to, a zero time is unbounded.
+// A positive interval averages the samples per interval.
+func (s *historyStore) query(ski, useCase, metric string, from, to time.Time, interval time.Duration) (HistorySeries, error) {
+	s.mutex.Lock()
+	r, ok := s.series[historyKey(ski, useCase, metric)]
+	if !ok {
+		s.mutex.Unlock()
+		return HistorySeries{}, errHistoryNotFound
+	}
+	r.dropBefore(time.Now().Add(-s.retention))
+
+	samples := []Sample{}
+	for i := 0; i < r.count; i++ {
+		sample := r.at(i)
+		if (!from.IsZero() && sample.Time.Before(from)) || (!to.IsZero() && sample.Time.After(to)) {
+			continue
+		}
+		samples = append(samples, sample)
+	}
+	s.mutex.Unlock()
+
+	if interval > 0 {
+		samples = downsample(samples, interval)
+	}
+
+	return HistorySeries{
+		SKI:      ski,
+		UseCase:  useCase,
+		Metric:   metric,
+		Interval: interval,
+		Samples:  samples,
+	}, nil
+}
+
+// downsample averages chronological samples per interval, the time of a sample is the start of its interval
+func downsample(samples []Sample, interval time.Duration) []Sample {
+	result := []Sample{}
+
+	var bucket time.Time
+	var sums []float64
+	var counts []int
+	flush := func() {
+		if len(counts) == 0 {
+			return
+		}
+		values := make([]float64, len(sums))
+		for i := range sums {
+			values[i] = sums[i] / float64(counts[i])
+		}
+		result = append(result, Sample{Time: bucket, Values: values})
+	}
+
+	for _, sample := range samples {
+		start := sample.Time.Truncate(interval)
+		if !start.Equal(bucket) {
+			flush()
+			bucket, sums, counts = start, nil, nil
+		}
+		for i, value := range sample.Values {
+			if i == len(sums) {
+				sums = append(sums, 0)
+				counts = append(counts, 0)
+			}
+			sums[i] += value
+			counts[i]++
+		}
+	}
+	flush()
+
+	return result
+}
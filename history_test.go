@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDownsample(t *testing.T) {
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	at := func(offset time.Duration, values ...float64) Sample {
+		return Sample{Time: start.Add(offset), Values: values}
+	}
+
+	tests := []struct {
+		name     string
+		samples  []Sample
+		interval time.Duration
+		want     []Sample
+	}{
+		{"no samples", nil, time.Minute, []Sample{}},
+		{"single sample", []Sample{at(10*time.Second, 100)}, time.Minute, []Sample{at(0, 100)}},
+		{"averaged per interval", []Sample{
+			at(0, 100), at(20*time.Second, 200), at(70*time.Second, 50),
+		}, time.Minute, []Sample{at(0, 150), at(time.Minute, 50)}},
+		{"empty intervals skipped", []Sample{
+			at(0, 100), at(3*time.Minute, 300),
+		}, time.Minute, []Sample{at(0, 100), at(3*time.Minute, 300)}},
+		{"per phase", []Sample{
+			at(0, 1, 2, 3), at(30*time.Second, 3, 4, 5),
+		}, time.Minute, []Sample{at(0, 2, 3, 4)}},
+		{"differing number of values", []Sample{
+			at(0, 10), at(30*time.Second, 20, 40),
+		}, time.Minute, []Sample{at(0, 15, 40)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := downsample(tt.samples, tt.interval); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,712 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+	spineapi "github.com/enbility/spine-go/api"
+)
+
+// HTTP JSON API
+//
+// The API offers the same operations as the websocket protocol. Limits use
+// the websocket representation, i.e. durations are given in seconds.
+
+// Device describes a remote EEBUS device
+type Device struct {
+	SKI        string
+	Name       string
+	Identifier string
+	Brand      string
+	Type       string
+	Model      string
+	Serial     string
+	Connected  bool
+	UseCases   []string
+}
+
+// DeviceDetails describes a remote EEBUS device including its use cases and entities
+type DeviceDetails struct {
+	Device
+	UseCaseInfos []UseCaseInfo
+	EntityInfos  []EntityInfo
+}
+
+// LimitState is the LPC or LPP limit state of a device or of one of its
+// entities. The state of a device is that of its first entity, Entities
+// lists the state of every entity.
+type LimitState struct {
+	Entity           string `json:",omitempty"`
+	Limit            ucapi.LoadLimit
+	FailsafeValue    float64
+	FailsafeDuration float64
+	NominalMax       float64
+	Entities         []LimitState `json:",omitempty"`
+}
+
+// Measurements holds the MPC or MGCP values of a device, unavailable values are omitted
+type Measurements struct {
+	PowerLimitationFactor *float64  `json:",omitempty"`
+	Power                 *float64  `json:",omitempty"`
+	PowerPerPhase         []float64 `json:",omitempty"`
+	EnergyFeedIn          *float64  `json:",omitempty"`
+	EnergyConsumed        *float64  `json:",omitempty"`
+	CurrentPerPhase       []float64 `json:",omitempty"`
+	VoltagePerPhase       []float64 `json:",omitempty"`
+	Frequency             *float64  `json:",omitempty"`
+}
+
+// ValueRequest is the request body for setting a failsafe value or duration
+type ValueRequest struct {
+	Value float64
+}
+
+// TrustRequest is the request body for a trust decision
+type TrustRequest struct {
+	Trusted bool
+}
+
+// HeartbeatRequest is the request body for starting or stopping the own heartbeat
+type HeartbeatRequest struct {
+	Sending bool
+}
+
+// ErrorResponse is returned for failed requests, Violations lists the violated rules of an invalid limit
+type ErrorResponse struct {
+	Error      string
+	Violations []ValidationError `json:",omitempty"`
+}
+
+// openapiSpec describes the API, keep it in sync with the handlers below and the client package
+//
+//go:embed openapi.json
+var openapiSpec []byte
+
+const correlationIDHeader = "X-Correlation-ID"
+
+var (
+	errDeviceNotFound      = errors.New("device not found")
+	errUseCaseNotAvailable = errors.New("use case not available")
+	errNoPairingState      = errors.New("no pairing state reported")
+	errWriteNotFound       = errors.New("write not found")
+	errInvalidTime         = errors.New("from and to must be RFC 3339 times or durations relative to now, e.g. -1h")
+	errInvalidInterval     = errors.New("interval must be a positive duration, e.g. 1m")
+)
+
+func setupApiRoutes(h *controlbox, mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(openapiSpec)
+	})
+
+	mux.HandleFunc("GET /api/devices", h.apiDevices)
+	mux.HandleFunc("GET /api/devices/{ski}", h.apiDevice)
+
+	mux.HandleFunc("GET /api/devices/{ski}/lpc", h.apiConsumptionLimits)
+	mux.HandleFunc("PUT /api/devices/{ski}/lpc/limit", h.apiSetConsumptionLimit)
+	mux.HandleFunc("PUT /api/devices/{ski}/lpc/failsafe/value", h.apiSetConsumptionFailsafeValue)
+	mux.HandleFunc("PUT /api/devices/{ski}/lpc/failsafe/duration", h.apiSetConsumptionFailsafeDuration)
+
+	mux.HandleFunc("GET /api/devices/{ski}/lpp", h.apiProductionLimits)
+	mux.HandleFunc("PUT /api/devices/{ski}/lpp/limit", h.apiSetProductionLimit)
+	mux.HandleFunc("PUT /api/devices/{ski}/lpp/failsafe/value", h.apiSetProductionFailsafeValue)
+	mux.HandleFunc("PUT /api/devices/{ski}/lpp/failsafe/duration", h.apiSetProductionFailsafeDuration)
+
+	mux.HandleFunc("GET /api/devices/{ski}/mpc", h.apiMPC)
+	mux.HandleFunc("GET /api/devices/{ski}/mgcp", h.apiMGCP)
+	mux.HandleFunc("GET /api/devices/{ski}/failsafe", h.apiDeviceFailsafeStates)
+	mux.HandleFunc("GET /api/devices/{ski}/history", h.apiHistory)
+	mux.HandleFunc("GET /api/devices/{ski}/history/{usecase}/{metric}", h.apiHistorySeries)
+
+	mux.HandleFunc("GET /api/trust", h.apiTrust)
+	mux.HandleFunc("PUT /api/trust/{ski}", h.apiSetTrust)
+	mux.HandleFunc("DELETE /api/trust/{ski}", h.apiForgetTrust)
+
+	mux.HandleFunc("GET /api/pairing", h.apiPairingStates)
+	mux.HandleFunc("GET /api/pairing/{ski}", h.apiPairingState)
+
+	mux.HandleFunc("GET /api/failsafe", h.apiFailsafeStates)
+
+	mux.HandleFunc("GET /api/writes/{id}", h.apiWriteResults)
+	mux.HandleFunc("GET /api/reconcile", h.apiReconcileStates)
+
+	mux.HandleFunc("GET /api/gridcontrol", h.apiGridControl)
+
+	mux.HandleFunc("GET /api/aggregate", h.apiAggregateLimits)
+	mux.HandleFunc("PUT /api/aggregate/{usecase}", h.apiSetAggregateLimit)
+
+	mux.HandleFunc("GET /api/schedules", h.apiSchedules)
+	mux.HandleFunc("POST /api/schedules", h.apiCreateSchedule)
+	mux.HandleFunc("GET /api/schedules/{id}", h.apiSchedule)
+	mux.HandleFunc("PUT /api/schedules/{id}", h.apiUpdateSchedule)
+	mux.HandleFunc("DELETE /api/schedules/{id}", h.apiDeleteSchedule)
+
+	mux.HandleFunc("GET /api/heartbeat", h.apiHeartbeat)
+	mux.HandleFunc("PUT /api/heartbeat/{usecase}", h.apiSetHeartbeat)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, ErrorResponse{Error: err.Error()})
+}
+
+// validated responds with the violated rules of a limit, the request
+// overrides the validation with the override query parameter
+func validated(w http.ResponseWriter, err error) bool {
+	var violations ValidationErrors
+	if !errors.As(err, &violations) {
+		return true
+	}
+
+	writeJSON(w, http.StatusUnprocessableEntity, ErrorResponse{Error: err.Error(), Violations: violations})
+	return false
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+// devices returns all visible, connected or registered devices sorted by SKI
+func (h *controlbox) devices() []Device {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	devices := map[string]Device{}
+	device := func(ski string) Device {
+		if d, ok := devices[ski]; ok {
+			return d
+		}
+		return Device{SKI: ski}
+	}
+
+	for _, service := range h.currentRemoteServices {
+		d := device(service.Ski)
+		d.Name = service.Name
+		d.Identifier = service.Identifier
+		d.Brand = service.Brand
+		d.Type = service.Type
+		d.Model = service.Model
+		d.Serial = service.Serial
+		devices[service.Ski] = d
+	}
+	for ski, info := range h.remoteInfos {
+		d := device(ski)
+		d.UseCases = slices.Clone(info.UseCases)
+		devices[ski] = d
+	}
+	for ski, connected := range h.isConnected {
+		d := device(ski)
+		d.Connected = connected
+		devices[ski] = d
+	}
+	for ski := range h.registeredSkis {
+		devices[ski] = device(ski)
+	}
+
+	result := make([]Device, 0, len(devices))
+	for _, d := range devices {
+		result = append(result, d)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].SKI < result[j].SKI })
+
+	return result
+}
+
+func (h *controlbox) device(ski string) (Device, error) {
+	for _, d := range h.devices() {
+		if d.SKI == ski {
+			return d, nil
+		}
+	}
+	return Device{}, errDeviceNotFound
+}
+
+func (h *controlbox) apiDevices(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.devices())
+}
+
+func (h *controlbox) apiDevice(w http.ResponseWriter, r *http.Request) {
+	ski := r.PathValue("ski")
+
+	device, err := h.device(ski)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	details := DeviceDetails{
+		Device:       device,
+		UseCaseInfos: []UseCaseInfo{},
+		EntityInfos:  []EntityInfo{},
+	}
+
+	h.mutex.Lock()
+	if info, ok := h.useCaseInfos[ski]; ok {
+		details.UseCaseInfos = info
+	}
+	if info, ok := h.remoteInfos[ski]; ok {
+		details.EntityInfos = buildEntityInfos(map[string]RemoteInfo{ski: info})
+	}
+	h.mutex.Unlock()
+
+	writeJSON(w, http.StatusOK, details)
+}
+
+func consumptionLimitState(limits entityLimits) LimitState {
+	return LimitState{
+		Limit: ucapi.LoadLimit{
+			IsActive: limits.ConsumptionLimits.IsActive,
+			Duration: limits.ConsumptionLimits.Duration / time.Second,
+			Value:    limits.ConsumptionLimits.Value},
+		FailsafeValue:    limits.ConsumptionFailsafeLimits.Value,
+		FailsafeDuration: float64(limits.ConsumptionFailsafeLimits.Duration / time.Second),
+		NominalMax:       limits.ConsumptionNominalMax,
+	}
+}
+
+func productionLimitState(limits entityLimits) LimitState {
+	return LimitState{
+		Limit: ucapi.LoadLimit{
+			IsActive: limits.ProductionLimits.IsActive,
+			Duration: limits.ProductionLimits.Duration / time.Second,
+			Value:    limits.ProductionLimits.Value},
+		FailsafeValue:    limits.ProductionFailsafeLimits.Value,
+		FailsafeDuration: float64(limits.ProductionFailsafeLimits.Duration / time.Second),
+		NominalMax:       limits.ProductionNominalMax,
+	}
+}
+
+// deviceLimitState returns the limit state of a device and its entities
+func (h *controlbox) deviceLimitState(ski string, state func(limits entityLimits) LimitState) LimitState {
+	var result LimitState
+	for i, key := range h.limits.entities(ski) {
+		entity := state(h.limits.get(key))
+		entity.Entity = key.Entity
+		if i == 0 {
+			result = entity
+			result.Entity = ""
+		}
+		result.Entities = append(result.Entities, entity)
+	}
+	return result
+}
+
+// apiLimits handles a limit request for a known device and responds with the resulting limit state
+//
+// Writes use the correlation ID of the X-Correlation-ID request header or a generated one,
+// it is returned in the response header and identifies the results at /api/writes/{id}.
+func (h *controlbox) apiLimits(w http.ResponseWriter, r *http.Request, status int, state func(limits entityLimits) LimitState, apply func(ski string, origin writeOrigin) bool) {
+	ski := r.PathValue("ski")
+
+	if _, err := h.device(ski); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if apply != nil {
+		origin := newWriteOrigin(r.Header.Get(correlationIDHeader), nil)
+		origin.override, _ = strconv.ParseBool(r.URL.Query().Get("override"))
+		w.Header().Set(correlationIDHeader, origin.id)
+		if !apply(ski, origin) {
+			return
+		}
+	}
+
+	writeJSON(w, status, h.deviceLimitState(ski, state))
+}
+
+func (h *controlbox) apiConsumptionLimits(w http.ResponseWriter, r *http.Request) {
+	h.apiLimits(w, r, http.StatusOK, consumptionLimitState, nil)
+}
+
+func (h *controlbox) apiSetConsumptionLimit(w http.ResponseWriter, r *http.Request) {
+	h.apiLimits(w, r, http.StatusAccepted, consumptionLimitState, func(ski string, origin writeOrigin) bool {
+		var limit ucapi.LoadLimit
+		if !readJSON(w, r, &limit) {
+			return false
+		}
+		limit.Duration *= time.Second
+		return validated(w, h.setConsumptionLimit(ski, limit, origin))
+	})
+}
+
+func (h *controlbox) apiSetConsumptionFailsafeValue(w http.ResponseWriter, r *http.Request) {
+	h.apiLimits(w, r, http.StatusAccepted, consumptionLimitState, func(ski string, origin writeOrigin) bool {
+		var req ValueRequest
+		if !readJSON(w, r, &req) {
+			return false
+		}
+
+		return validated(w, h.setConsumptionFailsafeValue(ski, req.Value, origin))
+	})
+}
+
+func (h *controlbox) apiSetConsumptionFailsafeDuration(w http.ResponseWriter, r *http.Request) {
+	h.apiLimits(w, r, http.StatusAccepted, consumptionLimitState, func(ski string, origin writeOrigin) bool {
+		var req ValueRequest
+		if !readJSON(w, r, &req) {
+			return false
+		}
+
+		duration := time.Duration(req.Value) * time.Second
+		return validated(w, h.setConsumptionFailsafeDuration(ski, duration, origin))
+	})
+}
+
+func (h *controlbox) apiProductionLimits(w http.ResponseWriter, r *http.Request) {
+	h.apiLimits(w, r, http.StatusOK, productionLimitState, nil)
+}
+
+func (h *controlbox) apiSetProductionLimit(w http.ResponseWriter, r *http.Request) {
+	h.apiLimits(w, r, http.StatusAccepted, productionLimitState, func(ski string, origin writeOrigin) bool {
+		var limit ucapi.LoadLimit
+		if !readJSON(w, r, &limit) {
+			return false
+		}
+		limit.Duration *= time.Second
+		return validated(w, h.setProductionLimit(ski, limit, origin))
+	})
+}
+
+func (h *controlbox) apiSetProductionFailsafeValue(w http.ResponseWriter, r *http.Request) {
+	h.apiLimits(w, r, http.StatusAccepted, productionLimitState, func(ski string, origin writeOrigin) bool {
+		var req ValueRequest
+		if !readJSON(w, r, &req) {
+			return false
+		}
+
+		return validated(w, h.setProductionFailsafeValue(ski, req.Value, origin))
+	})
+}
+
+func (h *controlbox) apiSetProductionFailsafeDuration(w http.ResponseWriter, r *http.Request) {
+	h.apiLimits(w, r, http.StatusAccepted, productionLimitState, func(ski string, origin writeOrigin) bool {
+		var req ValueRequest
+		if !readJSON(w, r, &req) {
+			return false
+		}
+
+		duration := time.Duration(req.Value) * time.Second
+		return validated(w, h.setProductionFailsafeDuration(ski, duration, origin))
+	})
+}
+
+func optional(value float64, err error) *float64 {
+	if err != nil {
+		return nil
+	}
+	return &value
+}
+
+func optionalArr(values []float64, err error) []float64 {
+	if err != nil {
+		return nil
+	}
+	return values
+}
+
+func (h *controlbox) readMPC(entity spineapi.EntityRemoteInterface) Measurements {
+	return Measurements{
+		Power:           optional(h.ucmpc.Power(entity)),
+		PowerPerPhase:   optionalArr(h.ucmpc.PowerPerPhase(entity)),
+		EnergyFeedIn:    optional(h.ucmpc.EnergyProduced(entity)),
+		EnergyConsumed:  optional(h.ucmpc.EnergyConsumed(entity)),
+		CurrentPerPhase: optionalArr(h.ucmpc.CurrentPerPhase(entity)),
+		VoltagePerPhase: optionalArr(h.ucmpc.VoltagePerPhase(entity)),
+		Frequency:       optional(h.ucmpc.Frequency(entity)),
+	}
+}
+
+func (h *controlbox) readMGCP(entity spineapi.EntityRemoteInterface) Measurements {
+	return Measurements{
+		PowerLimitationFactor: optional(h.ucmgcp.PowerLimitationFactor(entity)),
+		Power:                 optional(h.ucmgcp.Power(entity)),
+		EnergyFeedIn:          optional(h.ucmgcp.EnergyFeedIn(entity)),
+		EnergyConsumed:        optional(h.ucmgcp.EnergyConsumed(entity)),
+		CurrentPerPhase:       optionalArr(h.ucmgcp.CurrentPerPhase(entity)),
+		VoltagePerPhase:       optionalArr(h.ucmgcp.VoltagePerPhase(entity)),
+		Frequency:             optional(h.ucmgcp.Frequency(entity)),
+	}
+}
+
+func (h *controlbox) apiMPC(w http.ResponseWriter, r *http.Request) {
+	entities := remoteEntities(h.ucmpc, r.PathValue("ski"))
+	if len(entities) == 0 {
+		writeError(w, http.StatusNotFound, errUseCaseNotAvailable)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.readMPC(entities[0]))
+}
+
+func (h *controlbox) apiMGCP(w http.ResponseWriter, r *http.Request) {
+	entities := remoteEntities(h.ucmgcp, r.PathValue("ski"))
+	if len(entities) == 0 {
+		writeError(w, http.StatusNotFound, errUseCaseNotAvailable)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.readMGCP(entities[0]))
+}
+
+func (h *controlbox) apiTrust(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.trustInfo())
+}
+
+func (h *controlbox) apiSetTrust(w http.ResponseWriter, r *http.Request) {
+	var req TrustRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	if req.Trusted {
+		h.trustService(r.PathValue("ski"))
+	} else {
+		h.denyService(r.PathValue("ski"))
+	}
+
+	writeJSON(w, http.StatusOK, h.trustInfo())
+}
+
+func (h *controlbox) apiForgetTrust(w http.ResponseWriter, r *http.Request) {
+	h.forgetService(r.PathValue("ski"))
+
+	writeJSON(w, http.StatusOK, h.trustInfo())
+}
+
+func (h *controlbox) apiPairingStates(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.pairingStatusList())
+}
+
+func (h *controlbox) apiPairingState(w http.ResponseWriter, r *http.Request) {
+	status, ok := h.pairingStatusForSKI(r.PathValue("ski"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errNoPairingState)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (h *controlbox) apiHeartbeat(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.heartbeatInfo())
+}
+
+func (h *controlbox) apiSetHeartbeat(w http.ResponseWriter, r *http.Request) {
+	var req HeartbeatRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+
+	if err := h.setHeartbeat(strings.ToUpper(r.PathValue("usecase")), req.Sending); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.heartbeatInfo())
+}
+
+func (h *controlbox) apiFailsafeStates(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.failsafeStates())
+}
+
+func (h *controlbox) apiDeviceFailsafeStates(w http.ResponseWriter, r *http.Request) {
+	ski := r.PathValue("ski")
+
+	if _, err := h.device(ski); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	states := []FailsafeStatus{}
+	for _, status := range h.failsafeStates() {
+		if status.SKI == ski {
+			states = append(states, status)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, states)
+}
+
+func (h *controlbox) apiWriteResults(w http.ResponseWriter, r *http.Request) {
+	results, ok := h.writeResults.get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errWriteNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (h *controlbox) apiReconcileStates(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.reconcileStates())
+}
+
+func (h *controlbox) apiSchedules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.scheduleList())
+}
+
+func (h *controlbox) apiSchedule(w http.ResponseWriter, r *http.Request) {
+	schedule, err := h.schedule(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, schedule)
+}
+
+func (h *controlbox) apiCreateSchedule(w http.ResponseWriter, r *http.Request) {
+	var schedule Schedule
+	if !readJSON(w, r, &schedule) {
+		return
+	}
+	schedule.ID = ""
+
+	schedule, err := h.saveSchedule(schedule)
+	if !validated(w, err) {
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, schedule)
+}
+
+func (h *controlbox) apiUpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	if _, err := h.schedule(r.PathValue("id")); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	var schedule Schedule
+	if !readJSON(w, r, &schedule) {
+		return
+	}
+	schedule.ID = r.PathValue("id")
+
+	schedule, err := h.saveSchedule(schedule)
+	if !validated(w, err) {
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, schedule)
+}
+
+func (h *controlbox) apiDeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	if err := h.deleteSchedule(r.PathValue("id")); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *controlbox) apiGridControl(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.gridControlStatus())
+}
+
+func (h *controlbox) apiAggregateLimits(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.aggregateLimits())
+}
+
+func (h *controlbox) apiSetAggregateLimit(w http.ResponseWriter, r *http.Request) {
+	var limit AggregateLimit
+	if !readJSON(w, r, &limit) {
+		return
+	}
+	limit.UseCase = r.PathValue("usecase")
+	limit.Duration *= time.Second
+
+	if err := h.setAggregateLimit(limit); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errUseCaseNotAvailable) {
+			status = http.StatusNotFound
+		}
+		writeError(w, status, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.aggregateLimits())
+}
+
+// parseHistoryTime parses an RFC 3339 time or a duration relative to now, an empty value is unbounded
+func parseHistoryTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errInvalidTime
+	}
+	return t, nil
+}
+
+func (h *controlbox) apiHistory(w http.ResponseWriter, r *http.Request) {
+	ski := r.PathValue("ski")
+
+	if _, err := h.device(ski); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.history.list(ski))
+}
+
+func (h *controlbox) apiHistorySeries(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	query := r.URL.Query()
+
+	from, err := parseHistoryTime(query.Get("from"), now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	to, err := parseHistoryTime(query.Get("to"), now)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var interval time.Duration
+	if value := query.Get("interval"); value != "" {
+		if interval, err = time.ParseDuration(value); err != nil || interval <= 0 {
+			writeError(w, http.StatusBadRequest, errInvalidInterval)
+			return
+		}
+	}
+
+	series, err := h.history.query(r.PathValue("ski"), strings.ToUpper(r.PathValue("usecase")), r.PathValue("metric"), from, to, interval)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	series.Interval /= time.Second
+
+	writeJSON(w, http.StatusOK, series)
+}
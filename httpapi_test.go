@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestAPI serves the API of a ControlBox knowing the device ski, whose
+// entity reports a nominal maximum of 5000 W for LPC
+func newTestAPI(t *testing.T) (*controlbox, *httptest.Server) {
+	h := &controlbox{
+		registeredSkis: map[string]bool{"ski": true},
+		limits:         newLimitStore(),
+		writeResults:   newWriteResultStore(),
+		reconciler:     newReconciler(),
+	}
+	h.limits.update(limitKey{SKI: "ski", Entity: "[1]"}, func(limits *entityLimits) {
+		limits.ConsumptionNominalMax = 5000
+	})
+
+	mux := http.NewServeMux()
+	setupApiRoutes(h, mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return h, server
+}
+
+func TestAPIStatusCodes(t *testing.T) {
+	_, server := newTestAPI(t)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"devices", http.MethodGet, "/api/devices", "", http.StatusOK},
+		{"device", http.MethodGet, "/api/devices/ski", "", http.StatusOK},
+		{"unknown device", http.MethodGet, "/api/devices/other", "", http.StatusNotFound},
+		{"limits", http.MethodGet, "/api/devices/ski/lpc", "", http.StatusOK},
+		{"limits of an unknown device", http.MethodGet, "/api/devices/other/lpc", "", http.StatusNotFound},
+		{"set limit", http.MethodPut, "/api/devices/ski/lpc/limit", `{"IsActive":true,"Value":4000}`, http.StatusAccepted},
+		{"set limit of an unknown device", http.MethodPut, "/api/devices/other/lpc/limit", `{"IsActive":true,"Value":4000}`, http.StatusNotFound},
+		{"invalid body", http.MethodPut, "/api/devices/ski/lpc/limit", `{"IsActive":`, http.StatusBadRequest},
+		{"invalid limit", http.MethodPut, "/api/devices/ski/lpc/limit", `{"IsActive":true,"Value":-1}`, http.StatusUnprocessableEntity},
+		{"MPC of an unknown device", http.MethodGet, "/api/devices/other/mpc", "", http.StatusNotFound},
+		{"unknown write", http.MethodGet, "/api/writes/unknown", "", http.StatusNotFound},
+		{"openapi", http.MethodGet, "/api/openapi.json", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, server.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("Content-Type"); got != "application/json" {
+				t.Errorf("got content type %q, want application/json", got)
+			}
+		})
+	}
+}
+
+func TestAPIValidation(t *testing.T) {
+	_, server := newTestAPI(t)
+
+	put := func(query string) (*http.Response, ErrorResponse) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPut, server.URL+"/api/devices/ski/lpc/limit"+query, strings.NewReader(`{"IsActive":true,"Value":6000}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var body ErrorResponse
+		if resp.StatusCode != http.StatusAccepted {
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp, body
+	}
+
+	resp, body := put("")
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusUnprocessableEntity)
+	}
+	if len(body.Violations) != 1 || body.Violations[0].Rule != ruleNominalMax || body.Violations[0].Bound != 5000 {
+		t.Errorf("got violations %+v, want the nominal maximum of 5000 W", body.Violations)
+	}
+
+	if resp, _ := put("?override=true"); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("override: got status %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+}
+
+func TestAPICorrelationID(t *testing.T) {
+	h, server := newTestAPI(t)
+
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"given", "my-id"},
+		{"generated", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPut, server.URL+"/api/devices/ski/lpc/limit", strings.NewReader(`{"IsActive":true,"Value":3000,"Duration":60}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != "" {
+				req.Header.Set(correlationIDHeader, tt.header)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			id := resp.Header.Get(correlationIDHeader)
+			if id == "" || (tt.header != "" && id != tt.header) {
+				t.Errorf("got correlation ID %q, want %q", id, tt.header)
+			}
+
+			var state LimitState
+			if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+				t.Fatal(err)
+			}
+			if !state.Limit.IsActive || state.Limit.Value != 3000 || state.Limit.Duration != 60 {
+				t.Errorf("got limit %+v, want 3000 W for 60 s", state.Limit)
+			}
+		})
+	}
+
+	if limit := h.limits.device("ski").ConsumptionLimits; limit.Value != 3000 {
+		t.Errorf("stored limit: got %v, want 3000", limit.Value)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/enbility/eebus-go/api"
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+	spineapi "github.com/enbility/spine-go/api"
+)
+
+type failsafeLimits struct {
+	Value    float64
+	Duration time.Duration
+}
+
+// entityLimits holds the LPC/LPP limit state of a single remote entity
+type entityLimits struct {
+	ConsumptionLimits         ucapi.LoadLimit
+	ProductionLimits          ucapi.LoadLimit
+	ConsumptionFailsafeLimits failsafeLimits
+	ProductionFailsafeLimits  failsafeLimits
+	ConsumptionNominalMax     float64
+	ProductionNominalMax      float64
+}
+
+// limitKey identifies a remote entity by the SKI of its device and its address
+type limitKey struct {
+	SKI    string
+	Entity string
+}
+
+func entityKey(entity spineapi.EntityRemoteInterface) limitKey {
+	return limitKey{SKI: entity.Device().Ski(), Entity: entity.Address().String()}
+}
+
+// limitStore keeps the limit state of every remote entity, keyed by SKI and entity address
+type limitStore struct {
+	limits   map[limitKey]entityLimits
+	onChange func(ski string)
+	mutex    sync.Mutex
+}
+
+func newLimitStore() *limitStore {
+	return &limitStore{
+		limits: map[limitKey]entityLimits{},
+	}
+}
+
+// get returns a copy of the limit state of an entity
+func (s *limitStore) get(key limitKey) entityLimits {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.limits[key]
+}
+
+// update modifies the limit state of an entity
+func (s *limitStore) update(key limitKey, fn func(limits *entityLimits)) {
+	s.mutex.Lock()
+	old := s.limits[key]
+	limits := old
+	fn(&limits)
+	s.limits[key] = limits
+	onChange := s.onChange
+	s.mutex.Unlock()
+
+	if limits != old && onChange != nil {
+		onChange(key.SKI)
+	}
+}
+
+// updateDevice modifies the limit state of all known entities of a device
+func (s *limitStore) updateDevice(ski string, fn func(limits *entityLimits)) {
+	for _, key := range s.entities(ski) {
+		s.update(key, fn)
+	}
+}
+
+// entities returns the known entities of a device sorted by address
+func (s *limitStore) entities(ski string) []limitKey {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	keys := []limitKey{}
+	for key := range s.limits {
+		if key.SKI == ski {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Entity < keys[j].Entity })
+
+	return keys
+}
+
+// device returns the limit state of the first entity of a device, devices
+// usually offer a use case on a single entity
+func (s *limitStore) device(ski string) entityLimits {
+	keys := s.entities(ski)
+	if len(keys) == 0 {
+		return entityLimits{}
+	}
+	return s.get(keys[0])
+}
+
+// nominalMax returns the smallest nominal maximum the entities of a device
+// reported for the use case, 0 if none was reported. A limit sent to the
+// device applies to each of its entities.
+func (s *limitStore) nominalMax(ski, useCase string) float64 {
+	nominalMax := 0.0
+	for _, key := range s.entities(ski) {
+		limits := s.get(key)
+		value := limits.ConsumptionNominalMax
+		if useCase == "LPP" {
+			value = limits.ProductionNominalMax
+		}
+		if value > 0 && (nominalMax == 0 || value < nominalMax) {
+			nominalMax = value
+		}
+	}
+	return nominalMax
+}
+
+// skis returns the sorted SKIs of all devices with a limit state
+func (s *limitStore) skis() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	skis := []string{}
+	for key := range s.limits {
+		if !slices.Contains(skis, key.SKI) {
+			skis = append(skis, key.SKI)
+		}
+	}
+	slices.Sort(skis)
+
+	return skis
+}
+
+// all returns a copy of the limit state of all entities
+func (s *limitStore) all() map[limitKey]entityLimits {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return maps.Clone(s.limits)
+}
+
+// restore replaces the limit state of all entities, e.g. from the state file
+func (s *limitStore) restore(limits map[limitKey]entityLimits) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.limits = maps.Clone(limits)
+	if s.limits == nil {
+		s.limits = map[limitKey]entityLimits{}
+	}
+}
+
+// remoteEntities returns the remote entities supporting the use case.
+// If ski is not empty, only entities of that device are returned.
+func remoteEntities(uc api.UseCaseInterface, ski string) []spineapi.EntityRemoteInterface {
+	entities := []spineapi.EntityRemoteInterface{}
+	// a disabled use case is not created
+	if uc == nil {
+		return entities
+	}
+
+	for _, remoteEntityScenario := range uc.RemoteEntitiesScenarios() {
+		entity := remoteEntityScenario.Entity
+		if entity == nil || entity.Device() == nil {
+			continue
+		}
+		if ski != "" && entity.Device().Ski() != ski {
+			continue
+		}
+		entities = append(entities, entity)
+	}
+
+	return entities
+}
+
+// applyLimits stores a limit change for the entities of the device identified
+// by ski supporting the use case and sends it to them. An empty ski applies
+// the change to every device supporting the use case, the stored state of a
+// device which is not connected is changed too.
+func (h *controlbox) applyLimits(uc api.UseCaseInterface, ski string, origin writeOrigin, update func(limits *entityLimits), send func(entity spineapi.EntityRemoteInterface, origin writeOrigin)) {
+	if origin.id == "" {
+		origin.id = newWriteID()
+	}
+
+	entities := remoteEntities(uc, ski)
+	if ski != "" && len(entities) == 0 {
+		h.limits.updateDevice(ski, update)
+	}
+
+	for _, entity := range entities {
+		h.limits.update(entityKey(entity), update)
+		send(entity, origin)
+	}
+}
+
+// setConsumptionLimit validates and writes an LPC limit, the origin may override the validation
+func (h *controlbox) setConsumptionLimit(ski string, limit ucapi.LoadLimit, origin writeOrigin) error {
+	if err := h.validateLimit("LPC", ski, limit); err != nil && !origin.override {
+		return err
+	}
+
+	h.applyLimits(h.uclpc, ski, origin, func(limits *entityLimits) {
+		limits.ConsumptionLimits.IsActive = limit.IsActive
+		limits.ConsumptionLimits.Value = limit.Value
+		limits.ConsumptionLimits.Duration = limit.Duration
+	}, h.sendConsumptionLimit)
+	h.desireLimit("LPC", ski, limit)
+	return nil
+}
+
+// setProductionLimit validates and writes an LPP limit, the origin may override the validation
+func (h *controlbox) setProductionLimit(ski string, limit ucapi.LoadLimit, origin writeOrigin) error {
+	if err := h.validateLimit("LPP", ski, limit); err != nil && !origin.override {
+		return err
+	}
+
+	h.applyLimits(h.uclpp, ski, origin, func(limits *entityLimits) {
+		limits.ProductionLimits.IsActive = limit.IsActive
+		limits.ProductionLimits.Value = limit.Value
+		limits.ProductionLimits.Duration = limit.Duration
+	}, h.sendProductionLimit)
+	h.desireLimit("LPP", ski, limit)
+	return nil
+}
+
+func (h *controlbox) setConsumptionFailsafeValue(ski string, value float64, origin writeOrigin) error {
+	if err := h.validateFailsafeValue("LPC", ski, value); err != nil && !origin.override {
+		return err
+	}
+
+	h.applyLimits(h.uclpc, ski, origin, func(limits *entityLimits) {
+		limits.ConsumptionFailsafeLimits.Value = value
+	}, h.sendConsumptionFailsafeLimit)
+	return nil
+}
+
+func (h *controlbox) setConsumptionFailsafeDuration(ski string, duration time.Duration, origin writeOrigin) error {
+	if err := validateFailsafeDuration(duration); err != nil && !origin.override {
+		return err
+	}
+
+	h.applyLimits(h.uclpc, ski, origin, func(limits *entityLimits) {
+		limits.ConsumptionFailsafeLimits.Duration = duration
+	}, h.sendConsumptionFailsafeDuration)
+	return nil
+}
+
+func (h *controlbox) setProductionFailsafeValue(ski string, value float64, origin writeOrigin) error {
+	if err := h.validateFailsafeValue("LPP", ski, value); err != nil && !origin.override {
+		return err
+	}
+
+	h.applyLimits(h.uclpp, ski, origin, func(limits *entityLimits) {
+		limits.ProductionFailsafeLimits.Value = value
+	}, h.sendProductionFailsafeLimit)
+	return nil
+}
+
+func (h *controlbox) setProductionFailsafeDuration(ski string, duration time.Duration, origin writeOrigin) error {
+	if err := validateFailsafeDuration(duration); err != nil && !origin.override {
+		return err
+	}
+
+	h.applyLimits(h.uclpp, ski, origin, func(limits *entityLimits) {
+		limits.ProductionFailsafeLimits.Duration = duration
+	}, h.sendProductionFailsafeDuration)
+	return nil
+}
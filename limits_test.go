@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+)
+
+func TestLimitStoreKeepsEntitiesApart(t *testing.T) {
+	s := newLimitStore()
+	first := limitKey{SKI: "ski", Entity: "1"}
+	second := limitKey{SKI: "ski", Entity: "2"}
+
+	var changed []string
+	s.onChange = func(ski string) { changed = append(changed, ski) }
+
+	s.update(second, func(limits *entityLimits) {
+		limits.ConsumptionLimits = ucapi.LoadLimit{IsActive: true, Value: 2000}
+	})
+	s.update(first, func(limits *entityLimits) {
+		limits.ConsumptionLimits = ucapi.LoadLimit{IsActive: true, Value: 1000}
+	})
+	// unchanged state is not reported
+	s.update(first, func(limits *entityLimits) {
+		limits.ConsumptionLimits.Value = 1000
+	})
+
+	if got := s.get(first).ConsumptionLimits.Value; got != 1000 {
+		t.Errorf("first entity: got %v, want 1000", got)
+	}
+	if got := s.get(second).ConsumptionLimits.Value; got != 2000 {
+		t.Errorf("second entity: got %v, want 2000", got)
+	}
+	if got := s.device("ski").ConsumptionLimits.Value; got != 1000 {
+		t.Errorf("device: got %v, want the first entity's 1000", got)
+	}
+	if len(changed) != 2 {
+		t.Errorf("got %d change notifications, want 2", len(changed))
+	}
+
+	s.updateDevice("ski", func(limits *entityLimits) {
+		limits.ConsumptionLimits.IsActive = false
+	})
+	for _, key := range []limitKey{first, second} {
+		if s.get(key).ConsumptionLimits.IsActive {
+			t.Errorf("entity %s: limit still active after updateDevice", key.Entity)
+		}
+	}
+}
+
+func TestLimitStoreNominalMax(t *testing.T) {
+	tests := []struct {
+		name       string
+		nominalMax []float64
+		want       float64
+	}{
+		{"unknown", nil, 0},
+		{"not reported", []float64{0}, 0},
+		{"single entity", []float64{11000}, 11000},
+		{"smallest of the entities", []float64{11000, 4200}, 4200},
+		{"ignores unreported entities", []float64{0, 4200}, 4200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newLimitStore()
+			for i, value := range tt.nominalMax {
+				s.update(limitKey{SKI: "ski", Entity: string(rune('1' + i))}, func(limits *entityLimits) {
+					limits.ConsumptionNominalMax = value
+					limits.ProductionNominalMax = 2 * value
+				})
+			}
+			s.update(limitKey{SKI: "other", Entity: "1"}, func(limits *entityLimits) {
+				limits.ConsumptionNominalMax = 1
+			})
+
+			if got := s.nominalMax("ski", "LPC"); got != tt.want {
+				t.Errorf("LPC: got %v, want %v", got, tt.want)
+			}
+			if got := s.nominalMax("ski", "LPP"); got != 2*tt.want {
+				t.Errorf("LPP: got %v, want %v", got, 2*tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	shipmodel "github.com/enbility/ship-go/model"
+	"github.com/enbility/ship-go/ship"
+	"github.com/enbility/spine-go/model"
+)
+
+// Logging
+//
+// Log messages are written with log/slog as text or JSON at the level set
+// by --log-level or LOG_LEVEL: trace, debug, info, warn or error. Messages
+// about a device carry ski and usecase attributes, messages of the eebus
+// libraries a source attribute. Trace includes every SHIP message.
+// With --spine-log or SPINE_LOG the decoded SPINE datagrams are appended
+// to a separate file as JSON lines, independent of the log level.
+
+const levelTrace = slog.Level(-8)
+
+var logLevels = map[string]slog.Level{
+	"trace": levelTrace,
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// spineLog writes the decoded SPINE datagrams, nil if disabled
+var spineLog *spineDatagramLog
+
+// setupLogging replaces the default logger, the log package writes to it too
+func setupLogging(level, format, spineLogFile string) error {
+	logLevel, ok := logLevels[strings.ToLower(level)]
+	if !ok {
+		return fmt.Errorf("log level must be trace, debug, info, warn or error")
+	}
+
+	options := &slog.HandlerOptions{
+		Level: logLevel,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if attr.Key == slog.LevelKey && attr.Value.Any() == levelTrace {
+				attr.Value = slog.StringValue("TRACE")
+			}
+			return attr
+		},
+	}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(os.Stdout, options)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stdout, options)
+	default:
+		return fmt.Errorf("log format must be text or json")
+	}
+	slog.SetDefault(slog.New(handler))
+
+	if spineLogFile != "" {
+		file, err := os.OpenFile(spineLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		spineLog = &spineDatagramLog{writer: file}
+		slog.Info("Logging SPINE datagrams", "file", spineLogFile)
+	}
+
+	return nil
+}
+
+// logEnabled reports whether messages of the level are logged
+func logEnabled(level slog.Level) bool {
+	return slog.Default().Enabled(context.Background(), level)
+}
+
+// SpineDatagram is a line of the SPINE log
+type SpineDatagram struct {
+	Time      time.Time
+	Direction string
+	SKI       string
+	Overview  string
+	Datagram  model.DatagramType
+}
+
+type spineDatagramLog struct {
+	writer io.WriteCloser
+	mutex  sync.Mutex
+}
+
+// shipMessage logs the SPINE datagram of a SHIP data message as traced by
+// ship-go, other SHIP messages are ignored
+func (l *spineDatagramLog) shipMessage(direction, ski, text string) {
+	if l == nil {
+		return
+	}
+
+	var data shipmodel.ShipData
+	if err := json.Unmarshal(ship.JsonFromEEBUSJson([]byte(text)), &data); err != nil || data.Data.Payload == nil {
+		return
+	}
+	var datagram model.Datagram
+	if err := json.Unmarshal(data.Data.Payload, &datagram); err != nil {
+		slog.Debug("Failed to decode SPINE datagram", "ski", ski, "error", err)
+		return
+	}
+
+	line, err := json.Marshal(SpineDatagram{
+		Time:      time.Now(),
+		Direction: direction,
+		SKI:       ski,
+		Overview:  datagram.Datagram.PrintMessageOverview(direction == "send", "", ""),
+		Datagram:  datagram.Datagram,
+	})
+	if err != nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, err := l.writer.Write(append(line, '\n')); err != nil {
+		slog.Error("Failed to write SPINE log", "error", err)
+	}
+}
+
+func (l *spineDatagramLog) close() {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_ = l.writer.Close()
+}
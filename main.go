@@ -1,53 +1,64 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 
 	_ "github.com/joho/godotenv/autoload"
 )
 
-var remoteSki string
-
-var frontend WebsocketClient
+var frontend = newWebsocketHub()
 
 // main app
 func usage() {
-	fmt.Println("Usage: controlbox <port>")
+	fmt.Println("Usage: controlbox <command> [options]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	for _, cmd := range commands {
+		fmt.Printf("  %-12s %s\n", cmd.name, cmd.summary)
+	}
 	fmt.Println()
-	fmt.Println("Certificate configuration via .env file:")
-	fmt.Println("  CERT_PEM + KEY_PEM   inline PEM content")
-	fmt.Println("  (auto-generated and persisted on first run if absent)")
+	fmt.Println("controlbox <port> is short for controlbox serve --eebus-port <port>.")
+	fmt.Println("Run controlbox help <command> for the options of a command.")
 }
 
 func setupRoutes(h *controlbox) {
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		serveWs(h, w, r)
 	})
+
+	http.HandleFunc("GET /metrics", h.serveMetrics)
+
+	setupApiRoutes(h, http.DefaultServeMux)
+	setupFrontendRoutes(http.DefaultServeMux)
 }
 
 func main() {
-	if len(os.Args) != 2 {
-		usage()
-		os.Exit(1)
-	}
+	os.Exit(runCommand(os.Args[1:]))
+}
 
+// serve runs the EEBUS service and the HTTP server until a signal stops them
+func serve(eebusPort int, httpAddr string, config *deviceConfig) {
 	srv := new(controlbox)
-	srv.run()
+	srv.run(eebusPort, config)
 	setupRoutes(srv)
 
+	server := &http.Server{Addr: httpAddr}
+
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
-		<-sig
-		os.Exit(0)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
 	}()
 
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(httpdPort), nil))
+	<-sig
+	os.Exit(srv.shutdown(server, sig))
 }
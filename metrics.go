@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prometheus metrics
+//
+// /metrics exposes the limit, failsafe, measurement, connection and heartbeat
+// state per SKI in the Prometheus text format, together with counters of the
+// limit writes and their results.
+
+// writeCounterKey identifies a counter of limit writes
+type writeCounterKey struct {
+	ski     string
+	useCase string
+	field   string
+	status  string
+}
+
+type writeCounters struct {
+	counts map[writeCounterKey]uint64
+	mutex  sync.Mutex
+}
+
+func newWriteCounters() *writeCounters {
+	return &writeCounters{
+		counts: map[writeCounterKey]uint64{},
+	}
+}
+
+// count records a reported write result, a pending result is a sent write
+func (c *writeCounters) count(result WriteResult) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.counts[writeCounterKey{result.SKI, result.UseCase, result.Field, result.Status}]++
+}
+
+func (c *writeCounters) snapshot() map[writeCounterKey]uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	counts := make(map[writeCounterKey]uint64, len(c.counts))
+	for key, count := range c.counts {
+		counts[key] = count
+	}
+	return counts
+}
+
+// metricFamily collects the samples of a metric, the text format requires them to be grouped
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	samples []string
+}
+
+type metricSet struct {
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+func (s *metricSet) add(kind, name, help string, value float64, labels ...string) {
+	if s.byName == nil {
+		s.byName = map[string]*metricFamily{}
+	}
+	family, ok := s.byName[name]
+	if !ok {
+		family = &metricFamily{name: name, help: help, kind: kind}
+		s.byName[name] = family
+		s.families = append(s.families, family)
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+	sample := name
+	if len(pairs) > 0 {
+		sample += "{" + strings.Join(pairs, ",") + "}"
+	}
+	family.samples = append(family.samples, sample+" "+strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (s *metricSet) gauge(name, help string, value float64, labels ...string) {
+	s.add("gauge", name, help, value, labels...)
+}
+
+func (s *metricSet) counter(name, help string, value float64, labels ...string) {
+	s.add("counter", name, help, value, labels...)
+}
+
+func (s *metricSet) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, family := range s.families {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind)
+		for _, sample := range family.samples {
+			fmt.Fprintln(w, sample)
+		}
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (h *controlbox) collectLimits(m *metricSet) {
+	limits := h.limits.all()
+	keys := make([]limitKey, 0, len(limits))
+	for key := range limits {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].SKI != keys[j].SKI {
+			return keys[i].SKI < keys[j].SKI
+		}
+		return keys[i].Entity < keys[j].Entity
+	})
+
+	for _, key := range keys {
+		l := limits[key]
+		for _, uc := range []struct {
+			useCase string
+			state   LimitState
+		}{
+			{"LPC", consumptionLimitState(l)},
+			{"LPP", productionLimitState(l)},
+		} {
+			labels := []string{"ski", key.SKI, "entity", key.Entity, "use_case", uc.useCase}
+			m.gauge("controlbox_limit_active", "Whether the limit is active", boolValue(uc.state.Limit.IsActive), labels...)
+			m.gauge("controlbox_limit_watts", "Limit in W", uc.state.Limit.Value, labels...)
+			m.gauge("controlbox_limit_duration_seconds", "Duration of the limit", float64(uc.state.Limit.Duration), labels...)
+			m.gauge("controlbox_failsafe_limit_watts", "Failsafe limit in W", uc.state.FailsafeValue, labels...)
+			m.gauge("controlbox_failsafe_duration_seconds", "Failsafe duration minimum", uc.state.FailsafeDuration, labels...)
+			m.gauge("controlbox_nominal_max_watts", "Nominal maximum power in W", uc.state.NominalMax, labels...)
+		}
+	}
+}
+
+func (h *controlbox) collectMeasurements(m *metricSet) {
+	collect := func(ski, useCase string, values Measurements) {
+		scalar := func(name, help string, value *float64) {
+			if value != nil {
+				m.gauge(name, help, *value, "ski", ski, "use_case", useCase)
+			}
+		}
+		phases := func(name, help string, values []float64) {
+			for i, value := range values {
+				m.gauge(name, help, value, "ski", ski, "use_case", useCase, "phase", strconv.Itoa(i+1))
+			}
+		}
+
+		scalar("controlbox_power_limitation_factor", "Power limitation factor of the grid connection point", values.PowerLimitationFactor)
+		scalar("controlbox_power_watts", "Power in W, positive for consumption", values.Power)
+		phases("controlbox_phase_power_watts", "Power per phase in W", values.PowerPerPhase)
+		scalar("controlbox_energy_feed_in_wh", "Energy fed in or produced in Wh", values.EnergyFeedIn)
+		scalar("controlbox_energy_consumed_wh", "Energy consumed in Wh", values.EnergyConsumed)
+		phases("controlbox_phase_current_amperes", "Current per phase in A", values.CurrentPerPhase)
+		phases("controlbox_phase_voltage_volts", "Voltage per phase in V", values.VoltagePerPhase)
+		scalar("controlbox_frequency_hertz", "Frequency in Hz", values.Frequency)
+	}
+
+	for _, entity := range remoteEntities(h.ucmpc, "") {
+		collect(entity.Device().Ski(), "MPC", h.readMPC(entity))
+	}
+	for _, entity := range remoteEntities(h.ucmgcp, "") {
+		collect(entity.Device().Ski(), "MGCP", h.readMGCP(entity))
+	}
+}
+
+func (h *controlbox) collectConnections(m *metricSet) {
+	now := time.Now()
+
+	h.mutex.Lock()
+	connected := make(map[string]bool, len(h.isConnected))
+	for ski, c := range h.isConnected {
+		connected[ski] = c
+	}
+	heartbeats := make([]HeartbeatStatus, 0, len(h.heartbeats))
+	for _, status := range h.heartbeats {
+		heartbeats = append(heartbeats, status)
+	}
+	h.mutex.Unlock()
+
+	skis := make([]string, 0, len(connected))
+	for ski := range connected {
+		skis = append(skis, ski)
+	}
+	sort.Strings(skis)
+	for _, ski := range skis {
+		m.gauge("controlbox_connected", "Whether the device is connected", boolValue(connected[ski]), "ski", ski)
+	}
+
+	sort.Slice(heartbeats, func(i, j int) bool {
+		return heartbeatKey(heartbeats[i].SKI, heartbeats[i].UseCase) < heartbeatKey(heartbeats[j].SKI, heartbeats[j].UseCase)
+	})
+	for _, status := range heartbeats {
+		m.gauge("controlbox_heartbeat_age_seconds", "Time since the last heartbeat of the device", now.Sub(status.LastReceived).Seconds(), "ski", status.SKI, "use_case", status.UseCase)
+		m.gauge("controlbox_heartbeat_lost", "Whether the heartbeat of the device is lost", boolValue(status.Lost), "ski", status.SKI, "use_case", status.UseCase)
+	}
+	sending := h.heartbeatSending()
+	for _, useCase := range []string{"LPC", "LPP"} {
+		if _, ok := sending[useCase]; !ok {
+			continue
+		}
+		m.gauge("controlbox_heartbeat_sending", "Whether the own heartbeat shared by LPC and LPP is sent", boolValue(sending[useCase]), "use_case", useCase)
+	}
+
+	for _, status := range h.failsafeStates() {
+		m.gauge("controlbox_failsafe_state", "Derived failsafe state of the entity, 1 for the current state", 1, "ski", status.SKI, "use_case", status.UseCase, "entity", status.Entity, "state", status.State)
+	}
+}
+
+func (h *controlbox) collectWrites(m *metricSet) {
+	counts := h.writeCounters.snapshot()
+	keys := make([]writeCounterKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		return a.ski+a.useCase+a.field+a.status < b.ski+b.useCase+b.field+b.status
+	})
+
+	for _, key := range keys {
+		labels := []string{"ski", key.ski, "use_case", key.useCase, "field", key.field}
+		count := float64(counts[key])
+		switch key.status {
+		case writeStatusPending:
+			m.counter("controlbox_writes_total", "Limit and failsafe writes sent", count, labels...)
+		case writeStatusRejected:
+			m.counter("controlbox_write_rejections_total", "Limit and failsafe writes rejected by the device", count, labels...)
+		}
+		m.counter("controlbox_write_results_total", "Reported limit and failsafe write states", count, append(labels, "status", key.status)...)
+	}
+}
+
+func (h *controlbox) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var m metricSet
+	h.collectLimits(&m)
+	h.collectMeasurements(&m)
+	h.collectConnections(&m)
+	h.collectWrites(&m)
+	m.write(w)
+}
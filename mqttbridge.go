@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+)
+
+// MQTT bridge
+//
+// When MQTT_BROKER is set, MPC and MGCP measurements and the LPC and LPP
+// state of every device are published as retained messages to
+//
+//	<MQTT_TOPIC>/<ski>/<use case>/<name>
+//
+// e.g. controlbox/<ski>/MGCP/Power or controlbox/<ski>/LPC/Limit, using the
+// names and units of the HTTP API. Commands are received on the same topics
+// with a /set suffix:
+//
+//	<ski>/LPC/Limit/set             {"IsActive":true,"Value":4200,"Duration":3600}
+//	<ski>/LPC/Active/set            true or false, keeps the value of the limit, a limit
+//	                                with a duration is only deactivated
+//	<ski>/LPC/FailsafeValue/set     4200 or {"Value":4200,"Override":true}
+//	<ski>/LPC/FailsafeDuration/set  7200 (seconds)
+//
+// Results of the commands are published to <ski>/<use case>/WriteResult and
+// rejected commands, also those for an unknown use case, to <ski>/<use case>/Error.
+// The connection, keep alive and reconnects are handled by the Eclipse Paho client.
+
+// time to wait for the broker to accept a message or a subscription
+const mqttWriteTimeout = 5 * time.Second
+
+var errMQTTActiveDuration = errors.New("limit has a duration, activate it with Limit/set")
+
+type mqttBridge struct {
+	client mqtt.Client
+	broker string
+	prefix string
+}
+
+// mqttCommand is the JSON payload of a command, plain values are accepted as well
+type mqttCommand struct {
+	ucapi.LoadLimit
+	Override bool
+}
+
+// newMQTTBridge connects to the broker of MQTT_BROKER, it returns nil if MQTT is not configured
+func (h *controlbox) newMQTTBridge() *mqttBridge {
+	broker := os.Getenv("MQTT_BROKER")
+	if broker == "" {
+		return nil
+	}
+
+	prefix := strings.TrimSuffix(os.Getenv("MQTT_TOPIC"), "/")
+	if prefix == "" {
+		prefix = "controlbox"
+	}
+	clientID := os.Getenv("MQTT_CLIENT_ID")
+	if clientID == "" {
+		clientID = "controlbox-" + newWriteID()
+	}
+	user, password := os.Getenv("MQTT_USER"), os.Getenv("MQTT_PASSWORD")
+	if user == "" && password != "" {
+		// MQTT 3.1.1 does not allow a password without a user name
+		slog.Warn("MQTT_PASSWORD is ignored without MQTT_USER")
+		password = ""
+	}
+	// whole seconds, 0 disables the keep alive
+	keepAlive := max(envDuration("MQTT_KEEPALIVE", 30*time.Second), 0)
+
+	b := &mqttBridge{broker: broker, prefix: prefix}
+	options := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetUsername(user).
+		SetPassword(password).
+		SetKeepAlive(keepAlive).
+		SetWriteTimeout(mqttWriteTimeout).
+		SetWill(prefix+"/status", "offline", 0, true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(5 * time.Second).
+		SetMaxReconnectInterval(time.Minute).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			slog.Info("MQTT connected", "broker", broker)
+
+			filter := prefix + "/+/+/+/set"
+			token := client.Subscribe(filter, 0, func(_ mqtt.Client, msg mqtt.Message) {
+				h.mqttCommandReceived(msg.Topic(), msg.Payload())
+			})
+			if !token.WaitTimeout(mqttWriteTimeout) || token.Error() != nil {
+				slog.Error("MQTT subscribe failed", "topic", filter, "error", token.Error())
+			}
+
+			h.mqttConnected()
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			slog.Warn("MQTT connection lost", "broker", broker, "error", err)
+		})
+	b.client = mqtt.NewClient(options)
+
+	return b
+}
+
+// start connects to the broker, the client reconnects on its own
+func (b *mqttBridge) start() {
+	if b == nil {
+		return
+	}
+	slog.Info("MQTT bridge enabled", "broker", b.broker, "topic", b.prefix)
+	b.client.Connect()
+}
+
+// publish sends a QoS 0 message, messages are dropped while disconnected
+func (b *mqttBridge) publish(topic string, value any, retain bool) {
+	if b == nil {
+		return
+	}
+
+	var payload []byte
+	switch v := value.(type) {
+	case string:
+		payload = []byte(v)
+	case float64:
+		payload = []byte(strconv.FormatFloat(v, 'f', -1, 64))
+	case bool:
+		payload = []byte(strconv.FormatBool(v))
+	default:
+		var err error
+		if payload, err = json.Marshal(v); err != nil {
+			return
+		}
+	}
+
+	token := b.client.Publish(b.prefix+"/"+topic, 0, retain, payload)
+	if err := token.Error(); err != nil && !errors.Is(err, mqtt.ErrNotConnected) {
+		slog.Error("MQTT publish failed", "topic", topic, "error", err)
+	}
+}
+
+// close disconnects from the broker without sending the last will
+func (b *mqttBridge) close() {
+	if b == nil {
+		return
+	}
+	if b.client.IsConnected() {
+		b.client.Publish(b.prefix+"/status", 0, true, "offline").WaitTimeout(mqttWriteTimeout)
+	}
+	b.client.Disconnect(250)
+}
+
+// mqttConnected publishes the current state after (re)connecting
+func (h *controlbox) mqttConnected() {
+	h.mqtt.publish("status", "online", true)
+
+	h.mutex.Lock()
+	connected := make(map[string]bool, len(h.isConnected))
+	for ski, c := range h.isConnected {
+		connected[ski] = c
+	}
+	h.mutex.Unlock()
+
+	for ski, c := range connected {
+		h.mqtt.publish(ski+"/Connected", c, true)
+	}
+	for _, ski := range h.limits.skis() {
+		h.publishLimits(ski)
+	}
+}
+
+// publishLimits publishes the LPC and LPP state of a device
+func (h *controlbox) publishLimits(ski string) {
+	if h.mqtt == nil {
+		return
+	}
+
+	for useCase, state := range map[string]LimitState{
+		"LPC": h.deviceLimitState(ski, consumptionLimitState),
+		"LPP": h.deviceLimitState(ski, productionLimitState),
+	} {
+		h.mqtt.publish(ski+"/"+useCase+"/Limit", state.Limit, true)
+		h.mqtt.publish(ski+"/"+useCase+"/FailsafeValue", state.FailsafeValue, true)
+		h.mqtt.publish(ski+"/"+useCase+"/FailsafeDuration", state.FailsafeDuration, true)
+		h.mqtt.publish(ski+"/"+useCase+"/NominalMax", state.NominalMax, true)
+	}
+}
+
+// publishMeasurement publishes an MPC or MGCP value, per phase values as a JSON array
+func (h *controlbox) publishMeasurement(ski, useCase, metric string, values []float64) {
+	if len(values) == 1 && !strings.HasSuffix(metric, "PerPhase") {
+		h.mqtt.publish(ski+"/"+useCase+"/"+metric, values[0], true)
+		return
+	}
+	h.mqtt.publish(ski+"/"+useCase+"/"+metric, values, true)
+}
+
+// parseMQTTValue parses a plain number or a JSON command, a plain number for a limit activates it
+func parseMQTTValue(name string, payload []byte) (mqttCommand, error) {
+	var command mqttCommand
+	if value, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64); err == nil {
+		command.Value = value
+		command.IsActive = name == "Limit"
+		return command, nil
+	}
+	err := json.Unmarshal(payload, &command)
+	return command, err
+}
+
+// activeLimit returns the current limit of a device activated or deactivated. A limit
+// with a duration is only deactivated, the remaining duration is not known to activate it again.
+func activeLimit(current ucapi.LoadLimit, active bool) (ucapi.LoadLimit, error) {
+	if active && current.Duration > 0 {
+		return current, errMQTTActiveDuration
+	}
+	current.IsActive = active
+	current.Duration = 0
+	return current, nil
+}
+
+// mqttCommandReceived maps a command topic onto the operations of the websocket Set* messages
+func (h *controlbox) mqttCommandReceived(topic string, payload []byte) {
+	parts := strings.Split(strings.TrimPrefix(topic, h.mqtt.prefix+"/"), "/")
+	if len(parts) != 4 || parts[3] != "set" {
+		return
+	}
+	ski, useCase, name := parts[0], strings.ToUpper(parts[1]), parts[2]
+
+	slog.Info("MQTT command", "topic", topic, "payload", string(payload))
+
+	fail := func(err error) {
+		response := ErrorResponse{Error: err.Error()}
+		if violations, ok := err.(ValidationErrors); ok {
+			response.Violations = violations
+		}
+		h.mqtt.publish(ski+"/"+useCase+"/Error", response, false)
+	}
+
+	if useCase != "LPC" && useCase != "LPP" {
+		fail(errUseCaseNotAvailable)
+		return
+	}
+	if _, err := h.device(ski); err != nil {
+		fail(err)
+		return
+	}
+
+	origin := newWriteOrigin("mqtt-"+newWriteID(), func(result WriteResult) {
+		h.mqtt.publish(ski+"/"+useCase+"/WriteResult", result, false)
+	})
+
+	var command mqttCommand
+	var err error
+	if name == "Active" {
+		var active bool
+		if active, err = strconv.ParseBool(strings.TrimSpace(string(payload))); err == nil {
+			current := consumptionLimitState(h.limits.device(ski)).Limit
+			if useCase == "LPP" {
+				current = productionLimitState(h.limits.device(ski)).Limit
+			}
+			command.LoadLimit, err = activeLimit(current, active)
+		}
+	} else {
+		command, err = parseMQTTValue(name, payload)
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	// violated rules are published unless the command overrides the validation
+	origin.override = command.Override
+	switch name {
+	case "Limit", "Active":
+		limit := command.LoadLimit
+		limit.Duration *= time.Second
+		if useCase == "LPP" {
+			err = h.setProductionLimit(ski, limit, origin)
+		} else {
+			err = h.setConsumptionLimit(ski, limit, origin)
+		}
+	case "FailsafeValue":
+		if useCase == "LPP" {
+			err = h.setProductionFailsafeValue(ski, command.Value, origin)
+		} else {
+			err = h.setConsumptionFailsafeValue(ski, command.Value, origin)
+		}
+	case "FailsafeDuration":
+		duration := time.Duration(command.Value) * time.Second
+		if useCase == "LPP" {
+			err = h.setProductionFailsafeDuration(ski, duration, origin)
+		} else {
+			err = h.setConsumptionFailsafeDuration(ski, duration, origin)
+		}
+	default:
+		err = fmt.Errorf("unknown command %s", name)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+// measurementUpdated records an MPC or MGCP value and publishes it
+func (h *controlbox) measurementUpdated(ski, useCase, metric string, values ...float64) {
+	h.history.record(ski, useCase, metric, values...)
+	h.publishMeasurement(ski, useCase, metric, values)
+}
+
+// limitsChanged persists and publishes the changed limit state of a device
+func (h *controlbox) limitsChanged(ski string) {
+	h.persist()
+	h.publishLimits(ski)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+)
+
+func TestParseMQTTValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		payload string
+		want    mqttCommand
+		wantErr bool
+	}{
+		{"plain limit activates it", "Limit", "4200", mqttCommand{LoadLimit: ucapi.LoadLimit{IsActive: true, Value: 4200}}, false},
+		{"plain value with whitespace", "FailsafeValue", " 4200\n", mqttCommand{LoadLimit: ucapi.LoadLimit{Value: 4200}}, false},
+		{"plain duration", "FailsafeDuration", "7200", mqttCommand{LoadLimit: ucapi.LoadLimit{Value: 7200}}, false},
+		{"JSON limit", "Limit", `{"IsActive":true,"Value":4200,"Duration":3600}`,
+			mqttCommand{LoadLimit: ucapi.LoadLimit{IsActive: true, Value: 4200, Duration: 3600}}, false},
+		{"JSON inactive limit", "Limit", `{"IsActive":false}`, mqttCommand{}, false},
+		{"JSON override", "FailsafeValue", `{"Value":-1,"Override":true}`,
+			mqttCommand{LoadLimit: ucapi.LoadLimit{Value: -1}, Override: true}, false},
+		{"invalid", "Limit", "on", mqttCommand{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMQTTValue(tt.command, []byte(tt.payload))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestActiveLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		current ucapi.LoadLimit
+		active  bool
+		want    ucapi.LoadLimit
+		wantErr error
+	}{
+		{"activate", ucapi.LoadLimit{Value: 4200}, true, ucapi.LoadLimit{IsActive: true, Value: 4200}, nil},
+		{"deactivate", ucapi.LoadLimit{IsActive: true, Value: 4200}, false, ucapi.LoadLimit{Value: 4200}, nil},
+		{"deactivate with duration", ucapi.LoadLimit{IsActive: true, Value: 4200, Duration: 600}, false, ucapi.LoadLimit{Value: 4200}, nil},
+		{"activate with duration", ucapi.LoadLimit{Value: 4200, Duration: 600}, true, ucapi.LoadLimit{}, errMQTTActiveDuration},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := activeLimit(tt.current, tt.active)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// recordingClient records the published messages instead of sending them to a broker
+type recordingClient struct {
+	mqtt.Client
+	published map[string]string
+}
+
+func (c *recordingClient) Publish(topic string, _ byte, _ bool, payload any) mqtt.Token {
+	c.published[topic] = string(payload.([]byte))
+	return &mqtt.DummyToken{}
+}
+
+func TestMQTTCommandReceived(t *testing.T) {
+	tests := []struct {
+		name      string
+		topic     string
+		payload   string
+		wantError string
+	}{
+		{"unknown use case", "ski/MPC/Limit/set", "4200", "ski/MPC/Error"},
+		{"unknown device", "other/LPC/Limit/set", "4200", "other/LPC/Error"},
+		{"invalid value", "ski/LPC/Limit/set", "on", "ski/LPC/Error"},
+		{"activate a limit with duration", "ski/LPP/Active/set", "true", "ski/LPP/Error"},
+		{"deactivate a limit with duration", "ski/lpp/Active/set", "false", ""},
+		{"limit", "ski/LPC/Limit/set", "4200", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &recordingClient{published: map[string]string{}}
+			h := &controlbox{
+				isConnected: map[string]bool{"ski": true},
+				limits:      newLimitStore(),
+				reconciler:  newReconciler(),
+				mqtt:        &mqttBridge{client: client, prefix: "controlbox"},
+			}
+			h.limits.update(limitKey{SKI: "ski", Entity: "[1]"}, func(limits *entityLimits) {
+				limits.ProductionLimits = ucapi.LoadLimit{IsActive: true, Value: 4200, Duration: 10 * time.Minute}
+			})
+
+			h.mqttCommandReceived("controlbox/"+tt.topic, []byte(tt.payload))
+
+			var errorTopics []string
+			for topic := range client.published {
+				if strings.HasSuffix(topic, "/Error") {
+					errorTopics = append(errorTopics, strings.TrimPrefix(topic, "controlbox/"))
+				}
+			}
+			if tt.wantError == "" && len(errorTopics) > 0 {
+				t.Errorf("got errors on %v, want none", errorTopics)
+			}
+			if tt.wantError != "" && (len(errorTopics) != 1 || errorTopics[0] != tt.wantError) {
+				t.Errorf("got errors on %v, want one on %s", errorTopics, tt.wantError)
+			}
+		})
+	}
+}
+
+// TestMQTTBridgeBroker connects the bridge to the broker of MQTT_TEST_BROKER, e.g. tcp://localhost:1883
+func TestMQTTBridgeBroker(t *testing.T) {
+	broker := os.Getenv("MQTT_TEST_BROKER")
+	if broker == "" {
+		t.Skip("MQTT_TEST_BROKER not set")
+	}
+	prefix := "controlbox-test-" + newWriteID()
+	t.Setenv("MQTT_BROKER", broker)
+	t.Setenv("MQTT_TOPIC", prefix)
+
+	received := make(chan mqtt.Message, 10)
+	observer := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).SetClientID(prefix + "-observer"))
+	if token := observer.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("observer connect: %v", token.Error())
+	}
+	defer observer.Disconnect(0)
+	token := observer.Subscribe(prefix+"/#", 0, func(_ mqtt.Client, msg mqtt.Message) { received <- msg })
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("observer subscribe: %v", token.Error())
+	}
+
+	h := &controlbox{isConnected: map[string]bool{"ski": true}, limits: newLimitStore()}
+	h.mqtt = h.newMQTTBridge()
+	h.mqtt.start()
+
+	expect := func(topic, payload string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case msg := <-received:
+				if msg.Topic() == prefix+"/"+topic && string(msg.Payload()) == payload {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("%s=%s not received", topic, payload)
+			}
+		}
+	}
+
+	expect("status", "online")
+	expect("ski/Connected", "true")
+
+	// an invalid command is answered on the error topic
+	observer.Publish(prefix+"/ski/LPC/Limit/set", 0, false, "on").WaitTimeout(5 * time.Second)
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-received:
+			if msg.Topic() == prefix+"/ski/LPC/Error" {
+				h.mqtt.close()
+				expect("status", "offline")
+				return
+			}
+		case <-timeout:
+			t.Fatal("error of the invalid command not received")
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"time"
+
+	shipapi "github.com/enbility/ship-go/api"
+)
+
+// Pairing state machine
+//
+// The SHIP connection states reported by the service are condensed into the
+// pairing states below. Every device keeps its current state, the detailed
+// SHIP state, the ship ID and a short history of transitions for debugging.
+
+const (
+	pairingStateNone          = "none"
+	pairingStateQueued        = "queued"
+	pairingStateInitiated     = "initiated"
+	pairingStateReceivedTrust = "received-trust"
+	pairingStateTrusted       = "trusted"
+	pairingStateDenied        = "denied"
+	pairingStateError         = "error"
+)
+
+// number of transitions kept per device
+const pairingHistoryLength = 20
+
+// PairingTransition is a single change of the SHIP pairing state
+type PairingTransition struct {
+	State     string
+	ShipState string
+	Error     string `json:",omitempty"`
+	Time      time.Time
+}
+
+// PairingStatus is the pairing state of a remote device
+type PairingStatus struct {
+	SKI            string
+	ShipID         string
+	State          string
+	ShipState      string
+	Error          string
+	LastTransition time.Time
+	History        []PairingTransition
+}
+
+var shipStateNames = map[shipapi.ConnectionState]string{
+	shipapi.ConnectionStateNone:                   "none",
+	shipapi.ConnectionStateQueued:                 "queued",
+	shipapi.ConnectionStateInitiated:              "initiated",
+	shipapi.ConnectionStateReceivedPairingRequest: "received-pairing-request",
+	shipapi.ConnectionStateInProgress:             "in-progress",
+	shipapi.ConnectionStateTrusted:                "trusted",
+	shipapi.ConnectionStatePin:                    "pin",
+	shipapi.ConnectionStateCompleted:              "completed",
+	shipapi.ConnectionStateRemoteDeniedTrust:      "remote-denied-trust",
+	shipapi.ConnectionStateError:                  "error",
+}
+
+func shipStateName(state shipapi.ConnectionState) string {
+	if name, ok := shipStateNames[state]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown (%d)", state)
+}
+
+// pairingState maps a SHIP connection state to its pairing state
+func pairingState(state shipapi.ConnectionState) string {
+	switch state {
+	case shipapi.ConnectionStateQueued:
+		return pairingStateQueued
+	case shipapi.ConnectionStateInitiated, shipapi.ConnectionStateInProgress, shipapi.ConnectionStatePin:
+		return pairingStateInitiated
+	case shipapi.ConnectionStateReceivedPairingRequest:
+		return pairingStateReceivedTrust
+	case shipapi.ConnectionStateTrusted, shipapi.ConnectionStateCompleted:
+		return pairingStateTrusted
+	case shipapi.ConnectionStateRemoteDeniedTrust:
+		return pairingStateDenied
+	case shipapi.ConnectionStateError:
+		return pairingStateError
+	default:
+		return pairingStateNone
+	}
+}
+
+// updatePairingStatus records a pairing state transition of a remote device and pushes it to the frontend
+func (h *controlbox) updatePairingStatus(ski string, detail *shipapi.ConnectionStateDetail) {
+	transition := PairingTransition{
+		State:     pairingState(detail.State()),
+		ShipState: shipStateName(detail.State()),
+		Time:      time.Now(),
+	}
+	if err := detail.Error(); err != nil {
+		transition.Error = err.Error()
+	}
+
+	h.mutex.Lock()
+	status, ok := h.pairingStatus[ski]
+	if !ok {
+		status = PairingStatus{SKI: ski, ShipID: h.shipIDs[ski]}
+	}
+
+	// unregistering a SKI after the remote denied trust resets the state,
+	// keep the denial visible until the device tries to pair again
+	if status.State == pairingStateDenied && transition.State == pairingStateNone {
+		h.mutex.Unlock()
+		return
+	}
+
+	if ok && status.ShipState == transition.ShipState && status.Error == transition.Error {
+		h.mutex.Unlock()
+		return
+	}
+
+	status.State = transition.State
+	status.ShipState = transition.ShipState
+	status.Error = transition.Error
+	status.LastTransition = transition.Time
+	status.History = append(status.History, transition)
+	if len(status.History) > pairingHistoryLength {
+		status.History = slices.Clone(status.History[len(status.History)-pairingHistoryLength:])
+	}
+	h.pairingStatus[ski] = status
+	status.History = slices.Clone(status.History)
+	h.mutex.Unlock()
+
+	slog.Info("Pairing state changed", "ski", ski, "state", transition.State, "shipstate", transition.ShipState)
+
+	frontend.sendPairingStatus(GetPairingStatus, status)
+}
+
+// updatePairingShipID stores the ship ID reported for a remote device
+func (h *controlbox) updatePairingShipID(ski, shipID string) {
+	h.mutex.Lock()
+	status, ok := h.pairingStatus[ski]
+	if !ok || status.ShipID == shipID {
+		h.mutex.Unlock()
+		return
+	}
+	status.ShipID = shipID
+	h.pairingStatus[ski] = status
+	status.History = slices.Clone(status.History)
+	h.mutex.Unlock()
+
+	frontend.sendPairingStatus(GetPairingStatus, status)
+}
+
+// pairingStatusList returns the pairing states of all devices which reported one, sorted by SKI
+func (h *controlbox) pairingStatusList() []PairingStatus {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	list := make([]PairingStatus, 0, len(h.pairingStatus))
+	for _, status := range h.pairingStatus {
+		status.History = slices.Clone(status.History)
+		list = append(list, status)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].SKI < list[j].SKI })
+
+	return list
+}
+
+func (h *controlbox) pairingStatusForSKI(ski string) (PairingStatus, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	status, ok := h.pairingStatus[ski]
+	status.History = slices.Clone(status.History)
+	return status, ok
+}
+
+// remoteDeniedTrust removes the pairing with a remote device which denied trust,
+// all other connections are kept
+func (h *controlbox) remoteDeniedTrust(ski string) {
+	h.mutex.Lock()
+	registered := h.registeredSkis[ski]
+	delete(h.registeredSkis, ski)
+	delete(h.pendingTrust, ski)
+	h.mutex.Unlock()
+
+	slog.Warn("Remote service denied trust", "ski", ski)
+
+	// this runs within a pairing update of the service, which reports the
+	// reset pairing state synchronously again, answer asynchronously
+	go func() {
+		h.myService.CancelPairingWithSKI(ski)
+		h.myService.UnregisterRemoteSKI(ski)
+	}()
+
+	if registered {
+		h.persist()
+	}
+	frontend.sendTrustInfo(GetTrustInfo, h.trustInfo())
+}
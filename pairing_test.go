@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	shipapi "github.com/enbility/ship-go/api"
+)
+
+func TestPairingState(t *testing.T) {
+	tests := []struct {
+		state shipapi.ConnectionState
+		want  string
+	}{
+		{shipapi.ConnectionStateNone, pairingStateNone},
+		{shipapi.ConnectionStateQueued, pairingStateQueued},
+		{shipapi.ConnectionStateInitiated, pairingStateInitiated},
+		{shipapi.ConnectionStateInProgress, pairingStateInitiated},
+		{shipapi.ConnectionStatePin, pairingStateInitiated},
+		{shipapi.ConnectionStateReceivedPairingRequest, pairingStateReceivedTrust},
+		{shipapi.ConnectionStateTrusted, pairingStateTrusted},
+		{shipapi.ConnectionStateCompleted, pairingStateTrusted},
+		{shipapi.ConnectionStateRemoteDeniedTrust, pairingStateDenied},
+		{shipapi.ConnectionStateError, pairingStateError},
+	}
+
+	for _, tt := range tests {
+		t.Run(shipStateName(tt.state), func(t *testing.T) {
+			if got := pairingState(tt.state); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdatePairingStatus(t *testing.T) {
+	h := &controlbox{pairingStatus: map[string]PairingStatus{}, shipIDs: map[string]string{"ski": "ship-id"}}
+	update := func(state shipapi.ConnectionState, err error) {
+		h.updatePairingStatus("ski", shipapi.NewConnectionStateDetail(state, err))
+	}
+
+	update(shipapi.ConnectionStateQueued, nil)
+	update(shipapi.ConnectionStateInitiated, nil)
+	// repeated states are no transitions
+	update(shipapi.ConnectionStateInitiated, nil)
+	update(shipapi.ConnectionStateInProgress, nil)
+	update(shipapi.ConnectionStateError, errors.New("timeout"))
+	update(shipapi.ConnectionStateError, errors.New("refused"))
+
+	status, ok := h.pairingStatusForSKI("ski")
+	if !ok {
+		t.Fatal("no pairing state")
+	}
+	if status.ShipID != "ship-id" || status.State != pairingStateError || status.Error != "refused" {
+		t.Errorf("got %+v, want the error state of ship-id", status)
+	}
+	if len(status.History) != 5 {
+		t.Errorf("got %d transitions, want 5", len(status.History))
+	}
+
+	// a denial stays visible when the pairing is reset
+	update(shipapi.ConnectionStateRemoteDeniedTrust, nil)
+	update(shipapi.ConnectionStateNone, nil)
+	if status, _ := h.pairingStatusForSKI("ski"); status.State != pairingStateDenied {
+		t.Errorf("got state %s after the reset, want %s", status.State, pairingStateDenied)
+	}
+	update(shipapi.ConnectionStateQueued, nil)
+	if status, _ := h.pairingStatusForSKI("ski"); status.State != pairingStateQueued {
+		t.Errorf("got state %s after a new attempt, want %s", status.State, pairingStateQueued)
+	}
+
+	for i := 0; i < pairingHistoryLength; i++ {
+		update(shipapi.ConnectionStateInitiated, nil)
+		update(shipapi.ConnectionStateQueued, nil)
+	}
+	if status, _ := h.pairingStatusForSKI("ski"); len(status.History) != pairingHistoryLength {
+		t.Errorf("got %d transitions, want the last %d", len(status.History), pairingHistoryLength)
+	}
+
+	h.updatePairingShipID("ski", "new-id")
+	if list := h.pairingStatusList(); len(list) != 1 || list[0].ShipID != "new-id" {
+		t.Errorf("got %+v, want the new ship ID", list)
+	}
+}
+
+func TestRemoteDeniedTrust(t *testing.T) {
+	h := newTestControlbox(t)
+	h.trustService("ski")
+
+	// the service reports the denial from within its pairing handling, the
+	// pairing is removed asynchronously
+	done := make(chan struct{})
+	go func() {
+		h.ServicePairingDetailUpdate("ski", shipapi.NewConnectionStateDetail(shipapi.ConnectionStateRemoteDeniedTrust, nil))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pairing update blocked")
+	}
+
+	if info := h.trustInfo(); len(info.Trusted) != 0 || len(info.Denied) != 0 {
+		t.Errorf("got %+v, want the device neither trusted nor denied", info)
+	}
+	for deadline := time.Now().Add(5 * time.Second); trusted(h, "ski"); {
+		if time.Now().After(deadline) {
+			t.Fatal("device still paired with the service")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status, _ := h.pairingStatusForSKI("ski"); status.State != pairingStateDenied {
+		t.Errorf("got state %s, want %s", status.State, pairingStateDenied)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/enbility/eebus-go/api"
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+	spineapi "github.com/enbility/spine-go/api"
+)
+
+// Limit reconciliation
+//
+// When enabled with RECONCILE_LIMITS, the limits set via the frontend or the
+// API are remembered as desired limits and compared with the limits reported
+// by the devices. Differing limits are sent again with an exponential backoff
+// until they match or the retry budget is exhausted.
+
+const (
+	reconcileStateInSync    = "in-sync"
+	reconcileStatePending   = "pending"
+	reconcileStateRetrying  = "retrying"
+	reconcileStateExhausted = "exhausted"
+)
+
+const (
+	reconcileCheckInterval = 5 * time.Second
+	reconcileMaxBackoff    = 5 * time.Minute
+)
+
+// ReconcileStatus compares the desired and the reported limit of a device for a use case
+type ReconcileStatus struct {
+	SKI         string
+	UseCase     string
+	Desired     ucapi.LoadLimit
+	Reported    *ucapi.LoadLimit `json:",omitempty"`
+	State       string
+	Attempts    int
+	MaxAttempts int
+	NextAttempt time.Time `json:",omitempty"`
+	Since       time.Time
+}
+
+type reconciler struct {
+	enabled bool
+	retries int
+	backoff time.Duration
+
+	status map[string]ReconcileStatus
+
+	mutex sync.Mutex
+}
+
+func newReconciler() *reconciler {
+	return &reconciler{
+		enabled: envBool("RECONCILE_LIMITS", false),
+		retries: envInt("RECONCILE_RETRIES", 5),
+		backoff: envDuration("RECONCILE_BACKOFF", 10*time.Second),
+		status:  map[string]ReconcileStatus{},
+	}
+}
+
+// delay before the given attempt, doubling with every attempt
+func (r *reconciler) delay(attempt int) time.Duration {
+	delay := r.backoff
+	for i := 0; i < attempt && delay < reconcileMaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, reconcileMaxBackoff)
+}
+
+func (r *reconciler) list() []ReconcileStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	list := make([]ReconcileStatus, 0, len(r.status))
+	for _, status := range r.status {
+		list = append(list, status)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].SKI != list[j].SKI {
+			return list[i].SKI < list[j].SKI
+		}
+		return list[i].UseCase < list[j].UseCase
+	})
+
+	return list
+}
+
+// limitsMatch compares the parts of a limit a device has to apply, the
+// duration is not compared as devices report the remaining duration
+func limitsMatch(desired, reported ucapi.LoadLimit) bool {
+	if desired.IsActive != reported.IsActive {
+		return false
+	}
+	return !desired.IsActive || math.Abs(desired.Value-reported.Value) < 0.5
+}
+
+func (h *controlbox) reconcileUseCase(useCase string) (api.UseCaseInterface, func(spineapi.EntityRemoteInterface) (ucapi.LoadLimit, error), func(spineapi.EntityRemoteInterface, ucapi.LoadLimit, writeOrigin)) {
+	// a disabled use case has no remote entities, so there is nothing to read
+	if useCase == "LPP" {
+		if h.uclpp == nil {
+			return nil, nil, h.writeProductionLimit
+		}
+		return h.uclpp, h.uclpp.ProductionLimit, h.writeProductionLimit
+	}
+	if h.uclpc == nil {
+		return nil, nil, h.writeConsumptionLimit
+	}
+	return h.uclpc, h.uclpc.ConsumptionLimit, h.writeConsumptionLimit
+}
+
+// desireLimit remembers a limit set for a device, an empty ski applies to all devices supporting the use case
+func (h *controlbox) desireLimit(useCase, ski string, limit ucapi.LoadLimit) {
+	if !h.reconciler.enabled {
+		return
+	}
+
+	uc, _, _ := h.reconcileUseCase(useCase)
+	skis := []string{ski}
+	if ski == "" {
+		skis = nil
+		for _, entity := range remoteEntities(uc, "") {
+			skis = append(skis, entity.Device().Ski())
+		}
+	}
+
+	now := time.Now()
+	h.reconciler.mutex.Lock()
+	for _, ski := range skis {
+		h.reconciler.status[ski+"/"+useCase] = ReconcileStatus{
+			SKI:         ski,
+			UseCase:     useCase,
+			Desired:     limit,
+			State:       reconcileStatePending,
+			MaxAttempts: h.reconciler.retries,
+			NextAttempt: now.Add(h.reconciler.delay(0)),
+			Since:       now,
+		}
+	}
+	h.reconciler.mutex.Unlock()
+
+	frontend.sendReconcileStates(GetReconcileStates, h.reconcileStates())
+}
+
+// reconcile compares all desired limits with the reported ones and sends them again if needed
+func (h *controlbox) reconcile() {
+	now := time.Now()
+	changed := false
+
+	for _, status := range h.reconciler.list() {
+		uc, read, write := h.reconcileUseCase(status.UseCase)
+		entities := remoteEntities(uc, status.SKI)
+
+		// each entity of the device applies the limit on its own, nil if it reported none
+		reported := make([]*ucapi.LoadLimit, len(entities))
+		for i, entity := range entities {
+			if limit, err := read(entity); err == nil {
+				reported[i] = &limit
+			}
+		}
+
+		next, expired, retry := h.reconciler.step(status, reported, now)
+		if expired {
+			// the device deactivates the limit on its own
+			h.reconciler.mutex.Lock()
+			delete(h.reconciler.status, status.SKI+"/"+status.UseCase)
+			h.reconciler.mutex.Unlock()
+			changed = true
+			continue
+		}
+
+		if retry {
+			// the desired limit is written, the limit store holds the reported one,
+			// an active limit only for its remaining duration
+			desired := status.Desired
+			if desired.IsActive && desired.Duration > 0 {
+				desired.Duration -= now.Sub(status.Since)
+			}
+			slog.Info("Limit reconciliation", "ski", status.SKI, "usecase", status.UseCase, "attempt", next.Attempts)
+			for i, entity := range entities {
+				if !entityInSync(status.Desired, reported[i]) {
+					write(entity, desired, writeOrigin{})
+				}
+			}
+		}
+
+		if next.State == status.State && next.Attempts == status.Attempts && reportedEqual(next.Reported, status.Reported) {
+			continue
+		}
+
+		h.reconciler.mutex.Lock()
+		// the desired limit may have been replaced in the meantime
+		if current, ok := h.reconciler.status[status.SKI+"/"+status.UseCase]; ok && current.Since.Equal(status.Since) {
+			h.reconciler.status[status.SKI+"/"+status.UseCase] = next
+			changed = true
+		}
+		h.reconciler.mutex.Unlock()
+	}
+
+	if changed {
+		frontend.sendReconcileStates(GetReconcileStates, h.reconcileStates())
+	}
+}
+
+func entityInSync(desired ucapi.LoadLimit, reported *ucapi.LoadLimit) bool {
+	return reported != nil && limitsMatch(desired, *reported)
+}
+
+// step returns the next state of a desired limit from the limits reported by the
+// entities of the device, whether the limit has expired, and whether it has to
+// be written again to the entities which are not in sync
+func (r *reconciler) step(status ReconcileStatus, reported []*ucapi.LoadLimit, now time.Time) (ReconcileStatus, bool, bool) {
+	next := status
+	next.Reported = nil
+
+	inSync := len(reported) > 0
+	for _, limit := range reported {
+		inSync = inSync && entityInSync(status.Desired, limit)
+	}
+	// the reported limit is that of the first entity out of sync, if any
+	for _, limit := range reported {
+		if limit != nil && (next.Reported == nil || (entityInSync(status.Desired, next.Reported) && !entityInSync(status.Desired, limit))) {
+			next.Reported = limit
+		}
+	}
+
+	expired := status.Desired.IsActive && status.Desired.Duration > 0 && now.After(status.Since.Add(status.Desired.Duration))
+	switch {
+	case expired:
+		return next, true, false
+	case inSync:
+		next.State = reconcileStateInSync
+		next.Attempts = 0
+		next.NextAttempt = time.Time{}
+	case status.State == reconcileStateInSync:
+		// the device changed the limit afterwards
+		next.State = reconcileStatePending
+		next.NextAttempt = now.Add(r.delay(0))
+	case status.State == reconcileStateExhausted || now.Before(status.NextAttempt) || len(reported) == 0:
+		// nothing to do until the next attempt or the device is back
+	case status.Attempts >= status.MaxAttempts:
+		slog.Warn("Limit reconciliation gave up", "ski", status.SKI, "usecase", status.UseCase, "attempts", status.Attempts)
+		next.State = reconcileStateExhausted
+		next.NextAttempt = time.Time{}
+	default:
+		next.Attempts++
+		next.State = reconcileStateRetrying
+		next.NextAttempt = now.Add(r.delay(next.Attempts))
+		return next, false, true
+	}
+
+	return next, false, false
+}
+
+// reconcileStates returns the reconciliation states with durations in seconds like the other limits of the frontend and API
+func (h *controlbox) reconcileStates() []ReconcileStatus {
+	states := h.reconciler.list()
+	for i := range states {
+		states[i].Desired.Duration /= time.Second
+		if states[i].Reported != nil {
+			reported := *states[i].Reported
+			reported.Duration /= time.Second
+			states[i].Reported = &reported
+		}
+	}
+	return states
+}
+
+func reportedEqual(a, b *ucapi.LoadLimit) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IsActive == b.IsActive && a.Value == b.Value
+}
+
+func (h *controlbox) runReconciliation() {
+	if !h.reconciler.enabled {
+		return
+	}
+
+	slog.Info("Limit reconciliation enabled", "retries", h.reconciler.retries, "backoff", h.reconciler.backoff)
+
+	ticker := time.NewTicker(reconcileCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.reconcile()
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+)
+
+func TestReconcilerDelay(t *testing.T) {
+	r := &reconciler{backoff: 10 * time.Second}
+
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, 10 * time.Second},
+		{1, 20 * time.Second},
+		{2, 40 * time.Second},
+		{4, 160 * time.Second},
+		{5, reconcileMaxBackoff},
+		{100, reconcileMaxBackoff},
+	}
+
+	for _, tt := range tests {
+		if got := r.delay(tt.attempt); got != tt.want {
+			t.Errorf("attempt %d: got %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestReconcilerStep(t *testing.T) {
+	r := &reconciler{backoff: 10 * time.Second}
+	now := time.Now()
+	desired := ucapi.LoadLimit{IsActive: true, Value: 4000}
+	match := &ucapi.LoadLimit{IsActive: true, Value: 4000}
+	drift := &ucapi.LoadLimit{IsActive: true, Value: 6000}
+
+	status := func(state string, attempts int, next time.Time) ReconcileStatus {
+		return ReconcileStatus{
+			SKI: "ski", UseCase: "LPC", Desired: desired, State: state,
+			Attempts: attempts, MaxAttempts: 3, NextAttempt: next, Since: now.Add(-time.Minute),
+		}
+	}
+
+	tests := []struct {
+		name         string
+		status       ReconcileStatus
+		reported     []*ucapi.LoadLimit
+		wantState    string
+		wantAttempts int
+		wantNext     time.Duration
+		wantReported *ucapi.LoadLimit
+		wantExpired  bool
+		wantRetry    bool
+	}{
+		{
+			name:         "all entities in sync",
+			status:       status(reconcileStatePending, 0, now),
+			reported:     []*ucapi.LoadLimit{match, match},
+			wantState:    reconcileStateInSync,
+			wantReported: match,
+		},
+		{
+			name:         "drift of the second entity",
+			status:       status(reconcileStateInSync, 0, time.Time{}),
+			reported:     []*ucapi.LoadLimit{match, drift},
+			wantState:    reconcileStatePending,
+			wantNext:     10 * time.Second,
+			wantReported: drift,
+		},
+		{
+			name:         "entity without a reported limit",
+			status:       status(reconcileStatePending, 0, now),
+			reported:     []*ucapi.LoadLimit{match, nil},
+			wantState:    reconcileStateRetrying,
+			wantAttempts: 1,
+			wantNext:     20 * time.Second,
+			wantReported: match,
+			wantRetry:    true,
+		},
+		{
+			name:         "backoff doubles",
+			status:       status(reconcileStateRetrying, 2, now),
+			reported:     []*ucapi.LoadLimit{drift},
+			wantState:    reconcileStateRetrying,
+			wantAttempts: 3,
+			wantNext:     80 * time.Second,
+			wantReported: drift,
+			wantRetry:    true,
+		},
+		{
+			name:         "waiting for the next attempt",
+			status:       status(reconcileStateRetrying, 1, now.Add(time.Second)),
+			reported:     []*ucapi.LoadLimit{drift},
+			wantState:    reconcileStateRetrying,
+			wantAttempts: 1,
+			wantNext:     time.Second,
+			wantReported: drift,
+		},
+		{
+			name:         "device disconnected",
+			status:       status(reconcileStatePending, 0, time.Time{}),
+			wantState:    reconcileStatePending,
+			wantReported: nil,
+		},
+		{
+			name:         "retries exhausted",
+			status:       status(reconcileStateRetrying, 3, now),
+			reported:     []*ucapi.LoadLimit{drift},
+			wantState:    reconcileStateExhausted,
+			wantAttempts: 3,
+			wantReported: drift,
+		},
+		{
+			name:         "exhausted limit back in sync",
+			status:       status(reconcileStateExhausted, 3, time.Time{}),
+			reported:     []*ucapi.LoadLimit{match},
+			wantState:    reconcileStateInSync,
+			wantReported: match,
+		},
+		{
+			name: "expired",
+			status: func() ReconcileStatus {
+				s := status(reconcileStateRetrying, 1, now)
+				s.Desired.Duration = 30 * time.Second
+				return s
+			}(),
+			reported:    []*ucapi.LoadLimit{drift},
+			wantExpired: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, expired, retry := r.step(tt.status, tt.reported, now)
+			if expired != tt.wantExpired || retry != tt.wantRetry {
+				t.Fatalf("got expired %t and retry %t, want %t and %t", expired, retry, tt.wantExpired, tt.wantRetry)
+			}
+			if expired {
+				return
+			}
+			if next.State != tt.wantState || next.Attempts != tt.wantAttempts {
+				t.Errorf("got state %s after %d attempts, want %s after %d", next.State, next.Attempts, tt.wantState, tt.wantAttempts)
+			}
+			if got := next.NextAttempt; (tt.wantNext == 0 && !got.IsZero()) || (tt.wantNext != 0 && !got.Equal(now.Add(tt.wantNext))) {
+				t.Errorf("got next attempt %v, want in %v", got, tt.wantNext)
+			}
+			if !reportedEqual(next.Reported, tt.wantReported) {
+				t.Errorf("got reported %+v, want %+v", next.Reported, tt.wantReported)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+)
+
+// Limit schedules
+//
+// A schedule limits a device for a use case during recurring weekly windows,
+// e.g. weekdays 17:00-20:00, or during a single window given by From and To.
+// The limit is written at the start of a window with the remaining duration
+// of the window, so the device deactivates it on its own even if ControlBox
+// is not running at the end of the window. Overlapping windows of a device
+// apply the lowest value.
+
+const scheduleCheckInterval = 15 * time.Second
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+var (
+	errScheduleNotFound   = errors.New("schedule not found")
+	errScheduleUseCase    = errors.New("use case must be LPC or LPP")
+	errScheduleValue      = errors.New("value must not be negative")
+	errScheduleWindow     = errors.New("either from and to or weekdays, start and end are required")
+	errScheduleOneOff     = errors.New("to must be after from")
+	errScheduleWeekday    = errors.New("weekdays must be one of sun, mon, tue, wed, thu, fri, sat")
+	errScheduleTimeOfDay  = errors.New("start and end must be given as HH:MM")
+	errScheduleEmptyRange = errors.New("start and end must differ")
+)
+
+// Schedule is a time based LPC or LPP limit of a device
+type Schedule struct {
+	ID      string
+	SKI     string
+	UseCase string
+	Value   float64 // W
+	Enabled bool
+
+	// recurring window in local time, End before Start spans midnight
+	Weekdays []string `json:",omitempty"`
+	Start    string   `json:",omitempty"`
+	End      string   `json:",omitempty"`
+
+	// one-off window
+	From *time.Time `json:",omitempty"`
+	To   *time.Time `json:",omitempty"`
+}
+
+// scheduledLimit is the limit a schedule applied to a device
+type scheduledLimit struct {
+	scheduleID string
+	value      float64
+	end        time.Time
+}
+
+// AppliedSchedule is a limit written by a schedule, persisted so the limit
+// of a window that ended while ControlBox was not running is deactivated
+type AppliedSchedule struct {
+	SKI        string
+	UseCase    string
+	ScheduleID string
+	Value      float64
+	End        time.Time
+}
+
+type scheduleStore struct {
+	schedules map[string]Schedule
+	applied   map[string]scheduledLimit
+
+	mutex sync.Mutex
+	// serializes applying the schedules
+	applyMutex sync.Mutex
+}
+
+func newScheduleStore() *scheduleStore {
+	return &scheduleStore{
+		schedules: map[string]Schedule{},
+		applied:   map[string]scheduledLimit{},
+	}
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, errScheduleTimeOfDay
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// timeOfDay returns the time of a day, an offset of 24h or more is on a following day
+func timeOfDay(day time.Time, offset time.Duration) time.Time {
+	hour, minute := int(offset/time.Hour), int(offset%time.Hour/time.Minute)
+	return time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, day.Location())
+}
+
+func (s Schedule) validate() error {
+	if s.UseCase != "LPC" && s.UseCase != "LPP" {
+		return errScheduleUseCase
+	}
+	if s.Value < 0 {
+		return errScheduleValue
+	}
+
+	if s.From != nil || s.To != nil {
+		if s.From == nil || s.To == nil || len(s.Weekdays) > 0 || s.Start != "" || s.End != "" {
+			return errScheduleWindow
+		}
+		if !s.To.After(*s.From) {
+			return errScheduleOneOff
+		}
+		return nil
+	}
+
+	if len(s.Weekdays) == 0 {
+		return errScheduleWindow
+	}
+	for _, day := range s.Weekdays {
+		if !slices.Contains(weekdayNames, day) {
+			return errScheduleWeekday
+		}
+	}
+	start, err := parseTimeOfDay(s.Start)
+	if err != nil {
+		return err
+	}
+	end, err := parseTimeOfDay(s.End)
+	if err != nil {
+		return err
+	}
+	if start == end {
+		return errScheduleEmptyRange
+	}
+
+	return nil
+}
+
+// window returns the end of the window containing now, if any
+func (s Schedule) window(now time.Time) (time.Time, bool) {
+	if !s.Enabled {
+		return time.Time{}, false
+	}
+
+	if s.From != nil && s.To != nil {
+		return *s.To, !now.Before(*s.From) && now.Before(*s.To)
+	}
+
+	startOffset, _ := parseTimeOfDay(s.Start)
+	endOffset, _ := parseTimeOfDay(s.End)
+	if endOffset <= startOffset {
+		endOffset += 24 * time.Hour
+	}
+
+	// a window started yesterday may span midnight
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for _, day := range []time.Time{today, today.AddDate(0, 0, -1)} {
+		if !slices.Contains(s.Weekdays, weekdayNames[day.Weekday()]) {
+			continue
+		}
+		// the wall clock times, a day with a DST change has not 24 hours
+		start := timeOfDay(day, startOffset)
+		end := timeOfDay(day, endOffset)
+		if !now.Before(start) && now.Before(end) {
+			return end, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+func (h *controlbox) scheduleList() []Schedule {
+	h.schedules.mutex.Lock()
+	defer h.schedules.mutex.Unlock()
+
+	list := make([]Schedule, 0, len(h.schedules.schedules))
+	for _, schedule := range h.schedules.schedules {
+		list = append(list, schedule)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	return list
+}
+
+// appliedSchedules returns the limits written by schedules sorted by SKI and use case
+func (h *controlbox) appliedSchedules() []AppliedSchedule {
+	h.schedules.mutex.Lock()
+	defer h.schedules.mutex.Unlock()
+
+	list := make([]AppliedSchedule, 0, len(h.schedules.applied))
+	for key, limit := range h.schedules.applied {
+		ski, useCase, _ := strings.Cut(key, "/")
+		list = append(list, AppliedSchedule{SKI: ski, UseCase: useCase, ScheduleID: limit.scheduleID, Value: limit.value, End: limit.end})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].SKI != list[j].SKI {
+			return list[i].SKI < list[j].SKI
+		}
+		return list[i].UseCase < list[j].UseCase
+	})
+
+	return list
+}
+
+func (h *controlbox) schedule(id string) (Schedule, error) {
+	h.schedules.mutex.Lock()
+	defer h.schedules.mutex.Unlock()
+
+	schedule, ok := h.schedules.schedules[id]
+	if !ok {
+		return Schedule{}, errScheduleNotFound
+	}
+	return schedule, nil
+}
+
+// saveSchedule creates a schedule, or replaces it if the ID exists
+func (h *controlbox) saveSchedule(schedule Schedule) (Schedule, error) {
+	schedule.UseCase = strings.ToUpper(schedule.UseCase)
+	for i, day := range schedule.Weekdays {
+		schedule.Weekdays[i] = strings.ToLower(day)
+	}
+	if err := schedule.validate(); err != nil {
+		return schedule, err
+	}
+	if err := validationResult(h.checkValue(schedule.UseCase, schedule.SKI, "Value", schedule.Value)); err != nil {
+		return schedule, err
+	}
+	if schedule.ID == "" {
+		schedule.ID = newWriteID()
+	}
+
+	h.schedules.mutex.Lock()
+	h.schedules.schedules[schedule.ID] = schedule
+	h.schedules.mutex.Unlock()
+
+	h.schedulesChanged()
+	return schedule, nil
+}
+
+func (h *controlbox) deleteSchedule(id string) error {
+	h.schedules.mutex.Lock()
+	_, ok := h.schedules.schedules[id]
+	delete(h.schedules.schedules, id)
+	h.schedules.mutex.Unlock()
+
+	if !ok {
+		return errScheduleNotFound
+	}
+
+	h.schedulesChanged()
+	return nil
+}
+
+func (h *controlbox) schedulesChanged() {
+	h.persist()
+	h.applySchedules()
+	frontend.sendSchedules(GetSchedules, h.scheduleList())
+}
+
+// applySchedules writes the limits of all active windows and deactivates the limits of ended windows
+func (h *controlbox) applySchedules() {
+	h.schedules.applyMutex.Lock()
+	defer h.schedules.applyMutex.Unlock()
+
+	now := time.Now()
+
+	h.schedules.mutex.Lock()
+	desired := map[string]scheduledLimit{}
+	for _, schedule := range h.schedules.schedules {
+		end, active := schedule.window(now)
+		if !active {
+			continue
+		}
+		key := schedule.SKI + "/" + schedule.UseCase
+		if current, ok := desired[key]; ok && current.value <= schedule.Value {
+			continue
+		}
+		desired[key] = scheduledLimit{scheduleID: schedule.ID, value: schedule.Value, end: end}
+	}
+
+	var writes []string
+	for key, limit := range desired {
+		if h.schedules.applied[key] != limit {
+			writes = append(writes, key)
+		}
+	}
+	for key := range h.schedules.applied {
+		if _, ok := desired[key]; !ok {
+			writes = append(writes, key)
+		}
+	}
+	h.schedules.mutex.Unlock()
+
+	for _, key := range writes {
+		ski, useCase, _ := strings.Cut(key, "/")
+		limit, active := desired[key]
+
+		uc, _, _ := h.reconcileUseCase(useCase)
+		if len(remoteEntities(uc, ski)) == 0 {
+			// written once the device is connected
+			continue
+		}
+
+		loadLimit := ucapi.LoadLimit{IsActive: active, Value: limit.value, Duration: limit.end.Sub(now).Round(time.Second)}
+		origin := writeOrigin{id: "schedule-" + limit.scheduleID}
+		if !active {
+			h.schedules.mutex.Lock()
+			origin.id = "schedule-" + h.schedules.applied[key].scheduleID
+			h.schedules.mutex.Unlock()
+			loadLimit = ucapi.LoadLimit{IsActive: false, DeleteDuration: true}
+		}
+
+		slog.Info("Schedule sets limit", "ski", ski, "usecase", useCase, "id", origin.id, "active", active, "value", loadLimit.Value, "duration", loadLimit.Duration)
+
+		var err error
+		if useCase == "LPP" {
+			err = h.setProductionLimit(ski, loadLimit, origin)
+		} else {
+			err = h.setConsumptionLimit(ski, loadLimit, origin)
+		}
+		if err != nil {
+			// retried with the next check
+			slog.Warn("Schedule limit rejected", "ski", ski, "usecase", useCase, "id", origin.id, "error", err)
+			continue
+		}
+
+		h.schedules.mutex.Lock()
+		if active {
+			h.schedules.applied[key] = limit
+		} else {
+			delete(h.schedules.applied, key)
+		}
+		h.schedules.mutex.Unlock()
+		h.persist()
+	}
+}
+
+func (h *controlbox) runScheduler() {
+	ticker := time.NewTicker(scheduleCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.applySchedules()
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestScheduleValidate(t *testing.T) {
+	from := time.Date(2026, 10, 16, 8, 0, 0, 0, time.Local)
+	to := from.Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		want     error
+	}{
+		{"weekly", Schedule{UseCase: "LPC", Weekdays: []string{"mon"}, Start: "17:00", End: "20:00"}, nil},
+		{"spans midnight", Schedule{UseCase: "LPP", Weekdays: []string{"sat"}, Start: "22:00", End: "02:00"}, nil},
+		{"one-off", Schedule{UseCase: "LPC", From: &from, To: &to}, nil},
+		{"use case", Schedule{UseCase: "MPC", Weekdays: []string{"mon"}, Start: "17:00", End: "20:00"}, errScheduleUseCase},
+		{"negative value", Schedule{UseCase: "LPC", Value: -1, Weekdays: []string{"mon"}, Start: "17:00", End: "20:00"}, errScheduleValue},
+		{"no window", Schedule{UseCase: "LPC"}, errScheduleWindow},
+		{"one-off without to", Schedule{UseCase: "LPC", From: &from}, errScheduleWindow},
+		{"one-off and weekly", Schedule{UseCase: "LPC", From: &from, To: &to, Weekdays: []string{"mon"}}, errScheduleWindow},
+		{"to before from", Schedule{UseCase: "LPC", From: &to, To: &from}, errScheduleOneOff},
+		{"weekday", Schedule{UseCase: "LPC", Weekdays: []string{"monday"}, Start: "17:00", End: "20:00"}, errScheduleWeekday},
+		{"time of day", Schedule{UseCase: "LPC", Weekdays: []string{"mon"}, Start: "5pm", End: "20:00"}, errScheduleTimeOfDay},
+		{"empty range", Schedule{UseCase: "LPC", Weekdays: []string{"mon"}, Start: "17:00", End: "17:00"}, errScheduleEmptyRange},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.schedule.validate(); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleWindow(t *testing.T) {
+	// 2026-10-17 is a Saturday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.Local)
+	}
+	weekly := func(weekdays []string, start, end string) Schedule {
+		return Schedule{Enabled: true, Weekdays: weekdays, Start: start, End: end}
+	}
+	from, to := at(16, 8, 0), at(16, 10, 0)
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		now      time.Time
+		active   bool
+		end      time.Time
+	}{
+		{"before start", weekly([]string{"fri"}, "17:00", "20:00"), at(16, 16, 59), false, time.Time{}},
+		{"at start", weekly([]string{"fri"}, "17:00", "20:00"), at(16, 17, 0), true, at(16, 20, 0)},
+		{"at end", weekly([]string{"fri"}, "17:00", "20:00"), at(16, 20, 0), false, time.Time{}},
+		{"other weekday", weekly([]string{"thu"}, "17:00", "20:00"), at(16, 18, 0), false, time.Time{}},
+		{"before midnight", weekly([]string{"fri"}, "22:00", "02:00"), at(16, 23, 0), true, at(17, 2, 0)},
+		{"after midnight", weekly([]string{"fri"}, "22:00", "02:00"), at(17, 1, 0), true, at(17, 2, 0)},
+		{"after midnight, started on another weekday", weekly([]string{"sat"}, "22:00", "02:00"), at(17, 1, 0), false, time.Time{}},
+		{"after midnight, week wraps", weekly([]string{"sat"}, "22:00", "02:00"), at(18, 1, 0), true, at(18, 2, 0)},
+		{"one-off", Schedule{Enabled: true, From: &from, To: &to}, at(16, 9, 0), true, to},
+		{"one-off ended", Schedule{Enabled: true, From: &from, To: &to}, to, false, time.Time{}},
+		{"disabled", Schedule{Weekdays: []string{"fri"}, Start: "17:00", End: "20:00"}, at(16, 18, 0), false, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			end, active := tt.schedule.window(tt.now)
+			if active != tt.active {
+				t.Fatalf("got active %v, want %v", active, tt.active)
+			}
+			if active && !end.Equal(tt.end) {
+				t.Errorf("got end %v, want %v", end, tt.end)
+			}
+		})
+	}
+}
+
+func TestScheduleWindowDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	// the clocks are set back on 2026-10-25 and forward on 2026-03-29, both Sundays
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, berlin)
+	}
+	weekly := func(weekdays []string, start, end string) Schedule {
+		return Schedule{Enabled: true, Weekdays: weekdays, Start: start, End: end}
+	}
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		now      time.Time
+		active   bool
+		end      time.Time
+	}{
+		{"25 hour day, before start", weekly([]string{"sun"}, "17:00", "20:00"), at(10, 25, 16, 30), false, time.Time{}},
+		{"25 hour day, before end", weekly([]string{"sun"}, "17:00", "20:00"), at(10, 25, 19, 30), true, at(10, 25, 20, 0)},
+		{"23 hour day, before start", weekly([]string{"sun"}, "17:00", "20:00"), at(3, 29, 16, 30), false, time.Time{}},
+		{"23 hour day, before end", weekly([]string{"sun"}, "17:00", "20:00"), at(3, 29, 19, 30), true, at(3, 29, 20, 0)},
+		{"spans the change", weekly([]string{"sat"}, "22:00", "06:00"), at(10, 25, 5, 30), true, at(10, 25, 6, 0)},
+		{"spans the change, ended", weekly([]string{"sat"}, "22:00", "06:00"), at(10, 25, 6, 0), false, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			end, active := tt.schedule.window(tt.now)
+			if active != tt.active {
+				t.Fatalf("got active %v, want %v", active, tt.active)
+			}
+			if active && !end.Equal(tt.end) {
+				t.Errorf("got end %v, want %v", end, tt.end)
+			}
+		})
+	}
+}
+
+func TestSaveScheduleNominalMax(t *testing.T) {
+	h := &controlbox{limits: newLimitStore(), schedules: newScheduleStore()}
+	h.limits.update(limitKey{SKI: "ski", Entity: "[1]"}, func(limits *entityLimits) {
+		limits.ConsumptionNominalMax = 5000
+	})
+	schedule := func(value float64) Schedule {
+		return Schedule{SKI: "ski", UseCase: "lpc", Value: value, Weekdays: []string{"mon"}, Start: "17:00", End: "20:00"}
+	}
+
+	_, err := h.saveSchedule(schedule(6000))
+	var violations ValidationErrors
+	if !errors.As(err, &violations) || len(violations) != 1 || violations[0].Rule != ruleNominalMax {
+		t.Fatalf("got %v, want the nominal maximum violated", err)
+	}
+	if list := h.scheduleList(); len(list) != 0 {
+		t.Errorf("got schedules %+v, want none saved", list)
+	}
+
+	saved, err := h.saveSchedule(schedule(5000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.ID == "" || saved.UseCase != "LPC" {
+		t.Errorf("got %+v, want an LPC schedule with an ID", saved)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+)
+
+// Graceful shutdown
+//
+// On SIGINT or SIGTERM the HTTP server stops accepting requests and waits
+// for the running ones, the frontend websockets are closed, active limits
+// are deactivated if SHUTDOWN_DEACTIVATE_LIMITS is set, the state file is
+// written, and the SHIP connections and the mDNS announcement are closed.
+// ControlBox exits anyway after SHUTDOWN_TIMEOUT (default 10s) or on a
+// second signal.
+
+// shutdown stops ControlBox and returns the exit code
+func (h *controlbox) shutdown(server *http.Server, sig <-chan os.Signal) int {
+	timeout := envDuration("SHUTDOWN_TIMEOUT", 10*time.Second)
+	slog.Info("Shutting down", "timeout", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		h.stop(ctx, server)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		slog.Info("Shutdown complete")
+		return 0
+	case <-ctx.Done():
+		slog.Error("Shutdown timed out")
+	case <-sig:
+		slog.Error("Shutdown aborted")
+	}
+	return 1
+}
+
+func (h *controlbox) stop(ctx context.Context, server *http.Server) {
+	// waits for running API requests, websockets are hijacked and closed below
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("HTTP server shutdown failed", "error", err)
+	}
+	frontend.closeAll()
+
+	if envBool("SHUTDOWN_DEACTIVATE_LIMITS", false) {
+		h.deactivateLimits(ctx)
+	}
+	h.writeState()
+
+	h.mqtt.close()
+
+	// closes the SHIP connections and removes the mDNS announcement
+	h.myService.Shutdown()
+
+	spineLog.close()
+}
+
+// pendingWrites tracks the writes waiting for the answer of a device, devices
+// may use the same entity addresses
+type pendingWrites struct {
+	group   sync.WaitGroup
+	pending map[string]bool
+
+	mutex sync.Mutex
+}
+
+func newPendingWrites() *pendingWrites {
+	return &pendingWrites{pending: map[string]bool{}}
+}
+
+// update counts a pending write until its result is reported
+func (p *pendingWrites) update(result WriteResult) {
+	key := result.SKI + "/" + result.UseCase + "/" + result.Entity + "/" + result.Field
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	switch {
+	case result.Status == writeStatusPending:
+		if !p.pending[key] {
+			p.pending[key] = true
+			p.group.Add(1)
+		}
+	case p.pending[key]:
+		delete(p.pending, key)
+		p.group.Done()
+	}
+}
+
+// deactivateLimits deactivates the active limits of all connected devices
+// and waits for the devices to answer, the deactivated limits are persisted
+func (h *controlbox) deactivateLimits(ctx context.Context) {
+	pending := newPendingWrites()
+	origin := newWriteOrigin("shutdown", pending.update)
+
+	consumption, production := map[string]bool{}, map[string]bool{}
+	for key, limits := range h.limits.all() {
+		consumption[key.SKI] = consumption[key.SKI] || limits.ConsumptionLimits.IsActive
+		production[key.SKI] = production[key.SKI] || limits.ProductionLimits.IsActive
+	}
+
+	inactive := ucapi.LoadLimit{IsActive: false, DeleteDuration: true}
+	for _, ski := range h.limits.skis() {
+		if consumption[ski] && len(remoteEntities(h.uclpc, ski)) > 0 {
+			slog.Info("Deactivating limit", "ski", ski, "usecase", "LPC")
+			// an inactive limit always passes the validation
+			_ = h.setConsumptionLimit(ski, inactive, origin)
+		}
+		if production[ski] && len(remoteEntities(h.uclpp, ski)) > 0 {
+			slog.Info("Deactivating limit", "ski", ski, "usecase", "LPP")
+			_ = h.setProductionLimit(ski, inactive, origin)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pending.group.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("Deactivation of limits not confirmed by all devices")
+	}
+}
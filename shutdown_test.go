@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPendingWrites(t *testing.T) {
+	p := newPendingWrites()
+	result := func(ski, status string) WriteResult {
+		return WriteResult{SKI: ski, UseCase: "LPC", Entity: "[1]", Field: "Limit", Status: status}
+	}
+
+	// two devices with the same entity address
+	p.update(result("a", writeStatusPending))
+	p.update(result("b", writeStatusPending))
+	// a repeated pending state is counted once
+	p.update(result("a", writeStatusPending))
+
+	done := make(chan struct{})
+	go func() {
+		p.group.Wait()
+		close(done)
+	}()
+
+	p.update(result("a", writeStatusAccepted))
+	select {
+	case <-done:
+		t.Fatal("done before the second device answered")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a result without a pending write is ignored
+	p.update(result("a", writeStatusAccepted))
+	p.update(result("b", writeStatusRejected))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("still waiting after both devices answered")
+	}
+}
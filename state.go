@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// persisted state of a single remote device
+type deviceState struct {
+	// limit state per entity address
+	Entities   map[string]entityLimits `json:",omitempty"`
+	Registered bool                    `json:",omitempty"`
+	Denied     bool                    `json:",omitempty"`
+	ShipID     string                  `json:",omitempty"`
+}
+
+// persistedState is the content of the state file
+type persistedState struct {
+	Devices    map[string]deviceState
+	Schedules  []Schedule       `json:",omitempty"`
+	Aggregates []AggregateLimit `json:",omitempty"`
+	// limits written by schedules, deactivated once their window ended
+	AppliedSchedules []AppliedSchedule `json:",omitempty"`
+}
+
+// stateFile returns the path of the state file from STATE_FILE, defaulting to state.json
+func stateFile() string {
+	if path := os.Getenv("STATE_FILE"); path != "" {
+		return path
+	}
+	return "state.json"
+}
+
+// loadState reads the state file. A missing file results in an empty state.
+func loadState(path string) (persistedState, error) {
+	state := persistedState{
+		Devices: map[string]deviceState{},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if state.Devices == nil {
+		state.Devices = map[string]deviceState{}
+	}
+
+	return state, nil
+}
+
+// saveState atomically replaces the state file
+func saveState(path string, state persistedState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// restoreState loads the state file and registers all known remote SKIs,
+// it must be called before the service is started
+func (h *controlbox) restoreState() {
+	state, err := loadState(h.stateFile)
+	if err != nil {
+		// keep the unreadable file for inspection and start without state
+		corrupt := fmt.Sprintf("%s.corrupt-%s", h.stateFile, time.Now().Format("20060102-150405"))
+		slog.Error("Failed to load state, starting without state", "file", h.stateFile, "error", err)
+		if err := os.Rename(h.stateFile, corrupt); err != nil {
+			slog.Error("Failed to move state file aside", "file", h.stateFile, "error", err)
+		} else {
+			slog.Warn("State file moved aside", "file", corrupt)
+		}
+		state = persistedState{Devices: map[string]deviceState{}}
+	}
+
+	limits := map[limitKey]entityLimits{}
+	for ski, device := range state.Devices {
+		for entity, entityState := range device.Entities {
+			limits[limitKey{SKI: ski, Entity: entity}] = entityState
+		}
+
+		if device.ShipID != "" {
+			h.shipIDs[ski] = device.ShipID
+		}
+
+		if device.Denied {
+			h.deniedSkis[ski] = true
+		} else if device.Registered {
+			h.registeredSkis[ski] = true
+			h.myService.RegisterRemoteSKI(ski, device.ShipID)
+		}
+	}
+	h.limits.restore(limits)
+
+	for _, schedule := range state.Schedules {
+		h.schedules.schedules[schedule.ID] = schedule
+	}
+	for _, limit := range state.AppliedSchedules {
+		h.schedules.applied[limit.SKI+"/"+limit.UseCase] = scheduledLimit{scheduleID: limit.ScheduleID, value: limit.Value, end: limit.End}
+	}
+	for _, limit := range state.Aggregates {
+		h.aggregates.limits[limit.UseCase] = limit
+	}
+
+	slog.Info("State restored", "devices", len(state.Devices), "file", h.stateFile)
+}
+
+// persist requests writing the state file, the file is written asynchronously
+func (h *controlbox) persist() {
+	select {
+	case h.persistC <- struct{}{}:
+	default:
+		// a write is already pending
+	}
+}
+
+func (h *controlbox) runPersistence() {
+	for range h.persistC {
+		h.writeState()
+	}
+}
+
+func (h *controlbox) writeState() {
+	// the state is also written on shutdown, the later write has to win
+	h.stateMutex.Lock()
+	defer h.stateMutex.Unlock()
+
+	state := persistedState{
+		Devices:    map[string]deviceState{},
+		Schedules:  h.scheduleList(),
+		Aggregates: h.aggregateList(),
+
+		AppliedSchedules: h.appliedSchedules(),
+	}
+
+	for key, limits := range h.limits.all() {
+		device := state.Devices[key.SKI]
+		if device.Entities == nil {
+			device.Entities = map[string]entityLimits{}
+		}
+		device.Entities[key.Entity] = limits
+		state.Devices[key.SKI] = device
+	}
+
+	h.mutex.Lock()
+	for ski := range h.registeredSkis {
+		device := state.Devices[ski]
+		device.Registered = true
+		state.Devices[ski] = device
+	}
+	for ski := range h.deniedSkis {
+		device := state.Devices[ski]
+		device.Denied = true
+		state.Devices[ski] = device
+	}
+	for ski, shipID := range h.shipIDs {
+		device := state.Devices[ski]
+		device.ShipID = shipID
+		state.Devices[ski] = device
+	}
+	h.mutex.Unlock()
+
+	if err := saveState(h.stateFile, state); err != nil {
+		slog.Error("Failed to write state", "file", h.stateFile, "error", err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadState(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		devices int
+		wantErr bool
+	}{
+		{"missing", "", 0, false},
+		{"empty devices", `{}`, 0, false},
+		{"ship ID only", `{"Devices":{"ski":{"ShipID":"id"}}}`, 1, false},
+		{"corrupt", `{"Devices":`, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.json")
+			if tt.content != "" {
+				if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			state, err := loadState(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && len(state.Devices) != tt.devices {
+				t.Errorf("got %d devices, want %d", len(state.Devices), tt.devices)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	shipapi "github.com/enbility/ship-go/api"
+)
+
+// Trust management
+//
+// Registered SKIs form the allowlist and are trusted, denied SKIs are never
+// paired. Pairing requests of all other devices are queued until an operator
+// approves or rejects them.
+
+// PendingTrust is a pairing request waiting for an operator decision
+type PendingTrust struct {
+	SKI   string
+	Since time.Time
+}
+
+// TrustInfo lists the trust decisions of all known devices
+type TrustInfo struct {
+	Trusted []string
+	Denied  []string
+	Pending []PendingTrust
+}
+
+type trustPolicy int
+
+const (
+	trustUnknown trustPolicy = iota
+	trustAllowed
+	trustDenied
+)
+
+// skiList parses a comma or whitespace separated list of SKIs from an environment variable
+func skiList(env string) []string {
+	return strings.FieldsFunc(os.Getenv(env), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+// applyTrustConfig adds the SKIs configured via TRUSTED_SKIS and DENIED_SKIS
+// to the allow- and denylist, it must be called before the service is started
+func (h *controlbox) applyTrustConfig() {
+	for _, ski := range skiList("DENIED_SKIS") {
+		delete(h.registeredSkis, ski)
+		h.deniedSkis[ski] = true
+	}
+
+	for _, ski := range skiList("TRUSTED_SKIS") {
+		if h.deniedSkis[ski] || h.registeredSkis[ski] {
+			continue
+		}
+		h.registeredSkis[ski] = true
+		h.myService.RegisterRemoteSKI(ski, h.shipIDs[ski])
+	}
+}
+
+// trustPolicyForSKI must be called with the mutex held
+func (h *controlbox) trustPolicyForSKI(ski string) trustPolicy {
+	switch {
+	case h.deniedSkis[ski]:
+		return trustDenied
+	case h.registeredSkis[ski]:
+		return trustAllowed
+	default:
+		return trustUnknown
+	}
+}
+
+func (h *controlbox) trustInfo() TrustInfo {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	info := TrustInfo{
+		Trusted: []string{},
+		Denied:  []string{},
+		Pending: []PendingTrust{},
+	}
+
+	for ski := range h.registeredSkis {
+		info.Trusted = append(info.Trusted, ski)
+	}
+	for ski := range h.deniedSkis {
+		info.Denied = append(info.Denied, ski)
+	}
+	for ski, since := range h.pendingTrust {
+		info.Pending = append(info.Pending, PendingTrust{SKI: ski, Since: since})
+	}
+
+	slices.Sort(info.Trusted)
+	slices.Sort(info.Denied)
+	sort.Slice(info.Pending, func(i, j int) bool { return info.Pending[i].Since.Before(info.Pending[j].Since) })
+
+	return info
+}
+
+// handlePairingRequest answers a pairing request of a remote device from the trust policy
+func (h *controlbox) handlePairingRequest(ski string) {
+	h.mutex.Lock()
+	policy := h.trustPolicyForSKI(ski)
+	shipID := h.shipIDs[ski]
+	if policy == trustUnknown {
+		if _, exists := h.pendingTrust[ski]; !exists {
+			slog.Info("Pairing request waiting for approval", "ski", ski)
+			h.pendingTrust[ski] = time.Now()
+		}
+	}
+	h.mutex.Unlock()
+
+	// pairing updates are reported from within the service, answer asynchronously
+	switch policy {
+	case trustAllowed:
+		go h.myService.RegisterRemoteSKI(ski, shipID)
+	case trustDenied:
+		slog.Info("Rejecting pairing request of denied device", "ski", ski)
+		go h.myService.CancelPairingWithSKI(ski)
+	default:
+		frontend.sendTrustInfo(GetTrustInfo, h.trustInfo())
+	}
+}
+
+// clearPendingTrust removes a pairing request which the remote device gave up on
+func (h *controlbox) clearPendingTrust(ski string, state shipapi.ConnectionState) {
+	switch state {
+	case shipapi.ConnectionStateReceivedPairingRequest, shipapi.ConnectionStateInProgress, shipapi.ConnectionStatePin:
+		return
+	}
+
+	h.mutex.Lock()
+	_, exists := h.pendingTrust[ski]
+	delete(h.pendingTrust, ski)
+	h.mutex.Unlock()
+
+	if exists {
+		frontend.sendTrustInfo(GetTrustInfo, h.trustInfo())
+	}
+}
+
+// trustService adds a device to the allowlist and pairs it
+func (h *controlbox) trustService(ski string) {
+	if ski == "" {
+		return
+	}
+
+	h.mutex.Lock()
+	delete(h.deniedSkis, ski)
+	delete(h.pendingTrust, ski)
+	h.registeredSkis[ski] = true
+	shipID := h.shipIDs[ski]
+	h.mutex.Unlock()
+
+	// the service reports pairing updates synchronously, so it must not be called while holding the mutex
+	h.myService.RegisterRemoteSKI(ski, shipID)
+
+	h.persist()
+	frontend.sendTrustInfo(GetTrustInfo, h.trustInfo())
+}
+
+// denyService adds a device to the denylist, rejects pending pairing requests
+// and removes an existing pairing
+func (h *controlbox) denyService(ski string) {
+	if ski == "" {
+		return
+	}
+
+	h.mutex.Lock()
+	_, pending := h.pendingTrust[ski]
+	registered := h.registeredSkis[ski]
+	delete(h.pendingTrust, ski)
+	delete(h.registeredSkis, ski)
+	h.deniedSkis[ski] = true
+	h.mutex.Unlock()
+
+	if pending {
+		h.myService.CancelPairingWithSKI(ski)
+	}
+	if registered {
+		h.myService.UnregisterRemoteSKI(ski)
+	}
+
+	h.persist()
+	frontend.sendTrustInfo(GetTrustInfo, h.trustInfo())
+}
+
+// forgetService removes a device from the allow- and denylist and drops its
+// pending pairing request, a new request is queued again
+func (h *controlbox) forgetService(ski string) {
+	if ski == "" {
+		return
+	}
+
+	h.mutex.Lock()
+	registered := h.registeredSkis[ski]
+	delete(h.registeredSkis, ski)
+	delete(h.deniedSkis, ski)
+	delete(h.pendingTrust, ski)
+	h.mutex.Unlock()
+
+	if registered {
+		h.myService.UnregisterRemoteSKI(ski)
+	}
+
+	h.persist()
+	frontend.sendTrustInfo(GetTrustInfo, h.trustInfo())
+}
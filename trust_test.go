@@ -0,0 +1,135 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/enbility/eebus-go/api"
+	"github.com/enbility/eebus-go/service"
+	shipapi "github.com/enbility/ship-go/api"
+	"github.com/enbility/ship-go/cert"
+	"github.com/enbility/spine-go/model"
+)
+
+// newTestControlbox returns a ControlBox with a service which is set up but
+// not started, so pairing calls only change the local state
+func newTestControlbox(t *testing.T) *controlbox {
+	h := &controlbox{
+		registeredSkis: map[string]bool{},
+		deniedSkis:     map[string]bool{},
+		pendingTrust:   map[string]time.Time{},
+		shipIDs:        map[string]string{},
+		pairingStatus:  map[string]PairingStatus{},
+	}
+
+	certificate, err := cert.CreateCertificate("Test", "Test", "DE", "Test-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	configuration, err := api.NewConfiguration("Test", "Test", "Test", "1",
+		[]shipapi.DeviceCategoryType{shipapi.DeviceCategoryTypeGridConnectionHub},
+		model.DeviceTypeTypeElectricitySupplySystem,
+		[]model.EntityTypeType{model.EntityTypeTypeGridGuard},
+		4712, certificate, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.myService = service.NewService(configuration, h)
+	if err := h.myService.Setup(); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// trusted reports whether the service pairs with a device
+func trusted(h *controlbox, ski string) bool {
+	return h.myService.RemoteServiceForSKI(ski).Trusted()
+}
+
+func TestApplyTrustConfig(t *testing.T) {
+	t.Setenv("TRUSTED_SKIS", "a, b")
+	t.Setenv("DENIED_SKIS", "b c")
+
+	h := newTestControlbox(t)
+	h.registeredSkis["c"] = true
+	h.applyTrustConfig()
+
+	info := h.trustInfo()
+	if !slices.Equal(info.Trusted, []string{"a"}) || !slices.Equal(info.Denied, []string{"b", "c"}) {
+		t.Errorf("got trusted %v and denied %v, want [a] and [b c]", info.Trusted, info.Denied)
+	}
+	if !trusted(h, "a") || trusted(h, "b") {
+		t.Error("only a is registered with the service")
+	}
+}
+
+func TestHandlePairingRequest(t *testing.T) {
+	h := newTestControlbox(t)
+	h.registeredSkis["allowed"] = true
+	h.deniedSkis["denied"] = true
+
+	for _, ski := range []string{"allowed", "denied", "unknown", "unknown"} {
+		h.handlePairingRequest(ski)
+	}
+
+	info := h.trustInfo()
+	if len(info.Pending) != 1 || info.Pending[0].SKI != "unknown" {
+		t.Errorf("got pending %+v, want only the unknown device once", info.Pending)
+	}
+
+	// the device gave up
+	h.clearPendingTrust("unknown", shipapi.ConnectionStateInProgress)
+	if len(h.trustInfo().Pending) != 1 {
+		t.Error("pending request removed while the pairing is in progress")
+	}
+	h.clearPendingTrust("unknown", shipapi.ConnectionStateNone)
+	if len(h.trustInfo().Pending) != 0 {
+		t.Error("pending request kept after the pairing ended")
+	}
+}
+
+func TestTrustDecisions(t *testing.T) {
+	h := newTestControlbox(t)
+	h.handlePairingRequest("ski")
+
+	h.trustService("ski")
+	info := h.trustInfo()
+	if !slices.Equal(info.Trusted, []string{"ski"}) || len(info.Pending) != 0 || !trusted(h, "ski") {
+		t.Errorf("trust: got %+v, want the device trusted and paired", info)
+	}
+
+	h.denyService("ski")
+	info = h.trustInfo()
+	if len(info.Trusted) != 0 || !slices.Equal(info.Denied, []string{"ski"}) || trusted(h, "ski") {
+		t.Errorf("deny: got %+v, want the device denied and unpaired", info)
+	}
+	if h.AllowWaitingForTrust("ski") {
+		t.Error("a denied device may wait for trust")
+	}
+
+	h.forgetService("ski")
+	info = h.trustInfo()
+	if len(info.Trusted) != 0 || len(info.Denied) != 0 {
+		t.Errorf("forget: got %+v, want no decision", info)
+	}
+	if !h.AllowWaitingForTrust("ski") {
+		t.Error("a forgotten device may not wait for trust")
+	}
+}
+
+func TestForgetServiceClearsPendingRequest(t *testing.T) {
+	h := newTestControlbox(t)
+	h.handlePairingRequest("ski")
+	h.forgetService("ski")
+
+	if pending := h.trustInfo().Pending; len(pending) != 0 {
+		t.Fatalf("got pending %+v after forgetting the device, want none", pending)
+	}
+
+	// a new request of the device is queued again
+	h.handlePairingRequest("ski")
+	if pending := h.trustInfo().Pending; len(pending) != 1 {
+		t.Errorf("got pending %+v, want the new request", pending)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+)
+
+// Limit validation
+//
+// Limits and failsafe values are checked by the setters before they are
+// sent, whether set via the frontend, the API, MQTT, a schedule, an aggregate
+// limit or the grid controller. The frontend, API and MQTT callers can
+// override the validation to send out of spec values deliberately, e.g. for
+// conformance tests. eebus-go rejects failsafe durations outside of 2h to 24h
+// on its own, these writes fail even with the override.
+
+const (
+	ruleNonNegative      = "non-negative"
+	ruleProductionSign   = "production-sign"
+	ruleNominalMax       = "nominal-max"
+	ruleFailsafeDuration = "failsafe-duration"
+)
+
+const (
+	failsafeDurationMin = 2 * time.Hour
+	failsafeDurationMax = 24 * time.Hour
+)
+
+// ValidationError is a violated rule of a limit or failsafe value
+type ValidationError struct {
+	Field   string
+	Rule    string
+	Value   float64
+	Bound   float64 `json:",omitempty"`
+	SKI     string  `json:",omitempty"`
+	Message string
+}
+
+// ValidationErrors are all violated rules of a request
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, v := range e {
+		messages = append(messages, v.Message)
+	}
+	return strings.Join(messages, ", ")
+}
+
+// validationResult returns nil for no violations, so the result can be compared with nil as an error
+func validationResult(violations ValidationErrors) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	return violations
+}
+
+// checkValue validates a limit or failsafe value in W against the sign convention and the nominal
+// maximum of the devices. An empty ski checks all devices supporting the use case.
+func (h *controlbox) checkValue(useCase, ski, field string, value float64) ValidationErrors {
+	var violations ValidationErrors
+
+	if value < 0 {
+		rule, message := ruleNonNegative, fmt.Sprintf("%s must not be negative", field)
+		if useCase == "LPP" {
+			rule, message = ruleProductionSign, fmt.Sprintf("%s of a production limit must be given as a positive value", field)
+		}
+		return append(violations, ValidationError{Field: field, Rule: rule, Value: value, Message: message})
+	}
+
+	skis := []string{ski}
+	if ski == "" {
+		skis, _ = h.limitDevices(useCase)
+	}
+	for _, ski := range skis {
+		nominalMax := h.limits.nominalMax(ski, useCase)
+		// an unknown nominal maximum is not checked
+		if nominalMax > 0 && value > nominalMax {
+			violations = append(violations, ValidationError{
+				Field:   field,
+				Rule:    ruleNominalMax,
+				Value:   value,
+				Bound:   nominalMax,
+				SKI:     ski,
+				Message: fmt.Sprintf("%s of %.0f W exceeds the nominal maximum of %.0f W", field, value, nominalMax),
+			})
+		}
+	}
+
+	return violations
+}
+
+// validateLimit checks an LPC or LPP limit, the value of an inactive limit is not checked
+// so a limit can always be deactivated
+func (h *controlbox) validateLimit(useCase, ski string, limit ucapi.LoadLimit) error {
+	var violations ValidationErrors
+	if limit.IsActive {
+		violations = h.checkValue(useCase, ski, "Value", limit.Value)
+	}
+	if limit.Duration < 0 {
+		violations = append(violations, ValidationError{
+			Field:   "Duration",
+			Rule:    ruleNonNegative,
+			Value:   limit.Duration.Seconds(),
+			Message: "Duration must not be negative",
+		})
+	}
+	return validationResult(violations)
+}
+
+// validateFailsafeValue checks an LPC or LPP failsafe limit
+func (h *controlbox) validateFailsafeValue(useCase, ski string, value float64) error {
+	return validationResult(h.checkValue(useCase, ski, "FailsafeValue", value))
+}
+
+// validateFailsafeDuration checks a failsafe duration minimum against the range of the use cases
+func validateFailsafeDuration(duration time.Duration) error {
+	if duration >= failsafeDurationMin && duration <= failsafeDurationMax {
+		return nil
+	}
+
+	bound := failsafeDurationMin
+	if duration > failsafeDurationMax {
+		bound = failsafeDurationMax
+	}
+	return ValidationErrors{{
+		Field:   "FailsafeDuration",
+		Rule:    ruleFailsafeDuration,
+		Value:   duration.Seconds(),
+		Bound:   bound.Seconds(),
+		Message: fmt.Sprintf("FailsafeDuration must be between %s and %s", failsafeDurationMin, failsafeDurationMax),
+	}}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+)
+
+// rules returns the violated rules of a validation result
+func rules(err error) []string {
+	var violations ValidationErrors
+	if !errors.As(err, &violations) {
+		return nil
+	}
+	list := make([]string, 0, len(violations))
+	for _, v := range violations {
+		list = append(list, v.Rule)
+	}
+	return list
+}
+
+// newValidationControlbox returns a ControlBox knowing the device ski with a
+// nominal maximum of 5000 W for LPC and LPP, and the device unknown without one
+func newValidationControlbox() *controlbox {
+	h := &controlbox{limits: newLimitStore()}
+	h.limits.update(limitKey{SKI: "ski", Entity: "[1]"}, func(limits *entityLimits) {
+		limits.ConsumptionNominalMax = 5000
+		limits.ProductionNominalMax = 5000
+	})
+	return h
+}
+
+func TestValidateLimit(t *testing.T) {
+	h := newValidationControlbox()
+
+	tests := []struct {
+		name    string
+		useCase string
+		ski     string
+		limit   ucapi.LoadLimit
+		want    []string
+	}{
+		{"valid", "LPC", "ski", ucapi.LoadLimit{IsActive: true, Value: 4000, Duration: time.Hour}, nil},
+		{"at the nominal maximum", "LPC", "ski", ucapi.LoadLimit{IsActive: true, Value: 5000}, nil},
+		{"negative", "LPC", "ski", ucapi.LoadLimit{IsActive: true, Value: -1}, []string{ruleNonNegative}},
+		{"negative production", "LPP", "ski", ucapi.LoadLimit{IsActive: true, Value: -1}, []string{ruleProductionSign}},
+		{"above the nominal maximum", "LPC", "ski", ucapi.LoadLimit{IsActive: true, Value: 6000}, []string{ruleNominalMax}},
+		{"production above the nominal maximum", "LPP", "ski", ucapi.LoadLimit{IsActive: true, Value: 6000}, []string{ruleNominalMax}},
+		{"unknown nominal maximum", "LPC", "unknown", ucapi.LoadLimit{IsActive: true, Value: 6000}, nil},
+		{"negative duration", "LPC", "ski", ucapi.LoadLimit{IsActive: true, Value: 4000, Duration: -time.Second}, []string{ruleNonNegative}},
+		{"all rules", "LPC", "ski", ucapi.LoadLimit{IsActive: true, Value: -1, Duration: -time.Second}, []string{ruleNonNegative, ruleNonNegative}},
+		{"inactive above the nominal maximum", "LPC", "ski", ucapi.LoadLimit{IsActive: false, Value: 6000}, nil},
+		{"inactive negative", "LPP", "ski", ucapi.LoadLimit{IsActive: false, Value: -1}, nil},
+		{"inactive negative duration", "LPC", "ski", ucapi.LoadLimit{IsActive: false, Duration: -time.Second}, []string{ruleNonNegative}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := h.validateLimit(tt.useCase, tt.ski, tt.limit)
+			if got := rules(err); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if tt.want == nil && err != nil {
+				t.Errorf("got error %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestValidateFailsafeValue(t *testing.T) {
+	h := newValidationControlbox()
+
+	tests := []struct {
+		name    string
+		useCase string
+		value   float64
+		want    []string
+	}{
+		{"valid", "LPC", 4000, nil},
+		{"zero", "LPP", 0, nil},
+		{"negative", "LPC", -1, []string{ruleNonNegative}},
+		{"negative production", "LPP", -1, []string{ruleProductionSign}},
+		{"above the nominal maximum", "LPC", 6000, []string{ruleNominalMax}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rules(h.validateFailsafeValue(tt.useCase, "ski", tt.value)); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateFailsafeDuration(t *testing.T) {
+	tests := []struct {
+		duration time.Duration
+		valid    bool
+		bound    time.Duration
+	}{
+		{0, false, failsafeDurationMin},
+		{2*time.Hour - time.Second, false, failsafeDurationMin},
+		{2 * time.Hour, true, 0},
+		{12 * time.Hour, true, 0},
+		{24 * time.Hour, true, 0},
+		{24*time.Hour + time.Second, false, failsafeDurationMax},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.duration.String(), func(t *testing.T) {
+			err := validateFailsafeDuration(tt.duration)
+			if tt.valid {
+				if err != nil {
+					t.Errorf("got %v, want valid", err)
+				}
+				return
+			}
+			var violations ValidationErrors
+			if !errors.As(err, &violations) || len(violations) != 1 {
+				t.Fatalf("got %v, want one violation", err)
+			}
+			if v := violations[0]; v.Rule != ruleFailsafeDuration || v.Bound != tt.bound.Seconds() {
+				t.Errorf("got %+v, want rule %s with bound %v", v, ruleFailsafeDuration, tt.bound)
+			}
+		})
+	}
+}
@@ -2,18 +2,41 @@ package main
 
 import (
 	"errors"
-	"log"
+	"log/slog"
 	"sync"
+	"time"
 
 	ucapi "github.com/enbility/eebus-go/usecases/api"
 	shipapi "github.com/enbility/ship-go/api"
 	"github.com/gorilla/websocket"
 )
 
+// time allowed to write a message before the client is considered dead
+const writeWait = 10 * time.Second
+
 type WebsocketClient struct {
 	websocket *websocket.Conn
 	mutex     sync.Mutex
 	mutex2    sync.Mutex
+
+	// the selected device has its own mutex, so reading it never waits for a slow write
+	ski      string
+	skiMutex sync.Mutex
+}
+
+// selectedSki returns the SKI of the device the client currently displays
+func (websocketClient *WebsocketClient) selectedSki() string {
+	websocketClient.skiMutex.Lock()
+	defer websocketClient.skiMutex.Unlock()
+
+	return websocketClient.ski
+}
+
+func (websocketClient *WebsocketClient) selectSki(ski string) {
+	websocketClient.skiMutex.Lock()
+	defer websocketClient.skiMutex.Unlock()
+
+	websocketClient.ski = ski
 }
 
 func (websocketClient *WebsocketClient) sendMessage(msg interface{}) error {
@@ -24,9 +47,10 @@ func (websocketClient *WebsocketClient) sendMessage(msg interface{}) error {
 	websocketClient.mutex.Lock()
 	defer websocketClient.mutex.Unlock()
 
+	_ = websocketClient.websocket.SetWriteDeadline(time.Now().Add(writeWait))
 	err := websocketClient.websocket.WriteJSON(msg)
 	if err != nil {
-		log.Println(err)
+		slog.Debug("Frontend write failed", "error", err)
 	}
 
 	return err
@@ -91,29 +115,7 @@ func (websocketClient *WebsocketClient) sendEntityInfo(messageType int, remoteIn
 	websocketClient.mutex2.Lock()
 	defer websocketClient.mutex2.Unlock()
 
-	entityInfos := []EntityInfo{}
-
-	for _, remoteInfo := range remoteInfos {
-		device := remoteInfo.Device
-		if device != nil {
-			for _, entity := range device.Entities() {
-				features := []string{}
-
-				for _, f := range entity.Features() {
-					features = append(features, f.String()+", "+string(f.Role()))
-				}
-
-				info := EntityInfo{
-					Address:  entity.Address().String(),
-					Name:     string(entity.EntityType()),
-					SKI:      device.Ski(),
-					Type:     string(*device.DeviceType()),
-					Features: features}
-
-				entityInfos = append(entityInfos, info)
-			}
-		}
-	}
+	entityInfos := buildEntityInfos(remoteInfos)
 
 	answer := Message{
 		Type:        messageType,
@@ -132,3 +134,109 @@ func (websocketClient *WebsocketClient) sendUseCaseInfo(messageType int, useCase
 
 	return websocketClient.sendMessage(answer)
 }
+
+func (websocketClient *WebsocketClient) sendTrustInfo(messageType int, trust TrustInfo) error {
+	answer := Message{
+		Type:  messageType,
+		Trust: &trust}
+
+	return websocketClient.sendMessage(answer)
+}
+
+func (websocketClient *WebsocketClient) sendPairingStatus(messageType int, status PairingStatus) error {
+	answer := Message{
+		Type:    messageType,
+		SKI:     status.SKI,
+		Pairing: &status}
+
+	return websocketClient.sendMessage(answer)
+}
+
+func (websocketClient *WebsocketClient) sendPairingStates(messageType int, states []PairingStatus) error {
+	answer := Message{
+		Type:     messageType,
+		Pairings: states}
+
+	return websocketClient.sendMessage(answer)
+}
+
+func (websocketClient *WebsocketClient) sendHeartbeatInfo(messageType int, heartbeat HeartbeatInfo) error {
+	answer := Message{
+		Type:      messageType,
+		Heartbeat: &heartbeat}
+
+	return websocketClient.sendMessage(answer)
+}
+
+func (websocketClient *WebsocketClient) sendFailsafeStates(messageType int, states []FailsafeStatus) error {
+	answer := Message{
+		Type:     messageType,
+		Failsafe: states}
+
+	return websocketClient.sendMessage(answer)
+}
+
+func (websocketClient *WebsocketClient) sendWriteResult(messageType int, result WriteResult) error {
+	answer := Message{
+		Type:    messageType,
+		ID:      result.ID,
+		SKI:     result.SKI,
+		UseCase: result.UseCase,
+		Result:  &result}
+
+	return websocketClient.sendMessage(answer)
+}
+
+func (websocketClient *WebsocketClient) sendReconcileStates(messageType int, states []ReconcileStatus) error {
+	answer := Message{
+		Type:      messageType,
+		Reconcile: states}
+
+	return websocketClient.sendMessage(answer)
+}
+
+func (websocketClient *WebsocketClient) sendSchedules(messageType int, schedules []Schedule) error {
+	answer := Message{
+		Type:      messageType,
+		Schedules: schedules}
+
+	return websocketClient.sendMessage(answer)
+}
+
+func (websocketClient *WebsocketClient) sendGridControl(messageType int, status GridControlStatus) error {
+	answer := Message{
+		Type:        messageType,
+		GridControl: &status}
+
+	return websocketClient.sendMessage(answer)
+}
+
+func (websocketClient *WebsocketClient) sendAggregateLimits(messageType int, limits []AggregateLimit) error {
+	answer := Message{
+		Type:       messageType,
+		Aggregates: limits}
+
+	return websocketClient.sendMessage(answer)
+}
+
+func (websocketClient *WebsocketClient) sendValidationErrors(messageType int, id, ski, useCase string, violations []ValidationError) error {
+	answer := Message{
+		Type:       messageType,
+		ID:         id,
+		SKI:        ski,
+		UseCase:    useCase,
+		Violations: violations}
+
+	return websocketClient.sendMessage(answer)
+}
+
+func (websocketClient *WebsocketClient) sendHistory(messageType int, series HistorySeries) error {
+	answer := Message{
+		Type:    messageType,
+		SKI:     series.SKI,
+		UseCase: series.UseCase,
+		Text:    series.Metric,
+		History: &series}
+
+	return websocketClient.sendMessage(answer)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	ucapi "github.com/enbility/eebus-go/usecases/api"
+	shipapi "github.com/enbility/ship-go/api"
+	"github.com/gorilla/websocket"
+)
+
+// WebsocketHub keeps track of all connected frontend clients and
+// broadcasts messages to each of them
+type WebsocketHub struct {
+	clients map[*WebsocketClient]bool
+	mutex   sync.Mutex
+}
+
+func newWebsocketHub() *WebsocketHub {
+	return &WebsocketHub{
+		clients: map[*WebsocketClient]bool{},
+	}
+}
+
+func (hub *WebsocketHub) register(ws *websocket.Conn) *WebsocketClient {
+	client := &WebsocketClient{
+		websocket: ws}
+
+	hub.mutex.Lock()
+	hub.clients[client] = true
+	hub.mutex.Unlock()
+
+	return client
+}
+
+func (hub *WebsocketHub) unregister(client *WebsocketClient) {
+	hub.mutex.Lock()
+	_, exists := hub.clients[client]
+	delete(hub.clients, client)
+	hub.mutex.Unlock()
+
+	if exists {
+		_ = client.websocket.Close()
+	}
+}
+
+// closeAll tells all clients that the server is going away and closes their connections
+func (hub *WebsocketHub) closeAll() {
+	hub.mutex.Lock()
+	clients := make([]*WebsocketClient, 0, len(hub.clients))
+	for client := range hub.clients {
+		clients = append(clients, client)
+	}
+	hub.mutex.Unlock()
+
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutdown")
+	for _, client := range clients {
+		_ = client.websocket.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+		hub.unregister(client)
+	}
+}
+
+// broadcast calls send for every connected client and drops clients
+// which can not be written to anymore
+func (hub *WebsocketHub) broadcast(send func(client *WebsocketClient) error) {
+	hub.mutex.Lock()
+	clients := make([]*WebsocketClient, 0, len(hub.clients))
+	for client := range hub.clients {
+		clients = append(clients, client)
+	}
+	hub.mutex.Unlock()
+
+	for _, client := range clients {
+		if err := send(client); err != nil {
+			slog.Debug("Removing frontend client", "error", err)
+			hub.unregister(client)
+		}
+	}
+}
+
+func (hub *WebsocketHub) sendNotification(ski string, messageType int, uc string) {
+	hub.broadcast(func(client *WebsocketClient) error {
+		return client.sendNotification(ski, messageType, uc)
+	})
+}
+
+func (hub *WebsocketHub) sendText(messageType int, text string) {
+	hub.broadcast(func(client *WebsocketClient) error {
+		return client.sendText(messageType, text)
+	})
+}
+
+func (hub *WebsocketHub) sendValue(ski string, messageType int, useCase string, value float64) {
+	hub.broadcast(func(client *WebsocketClient) error {
+		return client.sendValue(ski, messageType, useCase, value)
+	})
+}
+
+func (hub *WebsocketHub) sendValueArr(ski string, messageType int, useCase string, values []float64) {
+	hub.broadcast(func(client *WebsocketClient) error {
+		return client.sendValueArr(ski, messageType, useCase, values)
+	})
+}
+
+func (hub *WebsocketHub) sendLimit(ski string, messageType int, useCase string, limit ucapi.LoadLimit) {
+	hub.broadcast(func(client *WebsocketClient) error {
+		return client.sendLimit(ski, messageType, useCase, limit)
+	})
+}
+
+func (hub *WebsocketHub) sendServiceList(messageType int, services []shipapi.RemoteService) {
+	hub.broadcast(func(client *WebsocketClient) error {
+		return client.sendServiceList(messageType, services)
+	})
+}
+
+func (hub *WebsocketHub) sendEntityInfo(messageType int, remoteInfos map[string]RemoteInfo) {
+	hub.broadcast(func(client *WebsocketClient) error {
+		return client.sendEntityInfo(messageType, remoteInfos)
+	})
+}
+
+func (hub *WebsocketHub) sendUseCaseInfo(messageType int, useCaseInfos map[string][]UseCaseInfo) {
+	hub.broadcast(func(client *WebsocketClient) error {
+		return client.sendUseCaseInfo(messageType, useCaseInfos)
+	})
+}
+
+func (hub *WebsocketHub) sendTrustInfo(messageType int, trust TrustInfo) {
+	hub.broadcast(func(client *WebsocketClient) error {
+		return client.sendTrustInfo(messageType, trust)
+	})
+}
+
+func (hub *WebsocketHub) sendPairingStatus(messageType int, status PairingStatus) {
+	hub.broadcast(func(client *WebsocketClient) error {
+		return client.sendPairingStatus(messageType, status)
+	})
+}
+
+func (hub *WebsocketHub) sendHeartbeatInfo(messageType int, heartbeat HeartbeatInfo) {
+	hub.broadcast(func(client *WebsocketClient) error {
+		return client.sendHeartbeatInfo(messageType, heartbeat)
+	})
+}
+
+func (hub *WebsocketHub) sendFailsafeStates(messageType int, states []FailsafeStatus) {
+	hub.broadcast(func(client *WebsocketClient) error {
+		return client.sendFailsafeStates(messageType, states)
+	})
+}
+
+func (hub *WebsocketHub) sendReconcileStates(messageType int, states []ReconcileStatus) {
+	hub.broadcast(func(client *WebsocketClient) error {
+		return client.sendReconcileStates(messageType, states)
+	})
+}
+
+func (hub *WebsocketHub) sendSchedules(messageType int, schedules []Schedule) {
+	hub.broadcast(func(client *WebsocketClient) error {
+		return client.sendSchedules(messageType, schedules)
+	})
+}
+
+func (hub *WebsocketHub) sendGridControl(messageType int, status GridControlStatus) {
+	hub.broadcast(func(client *WebsocketClient) error {
+		return client.sendGridControl(messageType, status)
+	})
+}
+
+func (hub *WebsocketHub) sendAggregateLimits(messageType int, limits []AggregateLimit) {
+	hub.broadcast(func(client *WebsocketClient) error {
+		return client.sendAggregateLimits(messageType, limits)
+	})
+}
+
+// suggestService proposes a device to all clients which have not selected one yet
+func (hub *WebsocketHub) suggestService(ski string) {
+	hub.broadcast(func(client *WebsocketClient) error {
+		if client.selectedSki() != "" {
+			return nil
+		}
+		return client.sendText(SelectService, ski)
+	})
+}
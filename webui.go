@@ -0,0 +1,44 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// Embedded frontend
+//
+// The frontend built with npm run build in frontend/ is embedded into the
+// binary and served on the HTTP port. Without a build a hint is served
+// instead, npm run dev still works for development.
+
+//go:embed all:frontend/dist
+var frontendDist embed.FS
+
+const frontendMissing = `<!doctype html>
+<html lang="en">
+  <head><meta charset="UTF-8" /><title>ControlBox</title></head>
+  <body>
+    <h1>ControlBox</h1>
+    <p>The frontend is not part of this build. Run <code>npm install &amp;&amp; npm run build</code>
+    in <code>frontend/</code> and build ControlBox again, or start it with <code>npm run dev</code>.</p>
+    <p>The HTTP API is described at <a href="/api/openapi.json">/api/openapi.json</a>.</p>
+  </body>
+</html>
+`
+
+func setupFrontendRoutes(mux *http.ServeMux) {
+	dist, err := fs.Sub(frontendDist, "frontend/dist")
+	if err == nil {
+		_, err = fs.Stat(dist, "index.html")
+	}
+	if err != nil {
+		mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte(frontendMissing))
+		})
+		return
+	}
+
+	mux.Handle("GET /", http.FileServerFS(dist))
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	spineapi "github.com/enbility/spine-go/api"
+	"github.com/enbility/spine-go/model"
+)
+
+// Write results
+//
+// Every limit or failsafe write carries a correlation ID. The msgCounter of
+// the sent datagram and the eventual result are reported back to the origin
+// of the write and kept for a while so they can be queried via the API.
+
+const (
+	writeStatusPending  = "pending"
+	writeStatusAccepted = "accepted"
+	writeStatusRejected = "rejected"
+	writeStatusTimeout  = "timeout"
+	writeStatusFailed   = "failed"
+)
+
+// time to wait for the result of a write
+const writeResultTimeout = 30 * time.Second
+
+// number of correlation IDs whose results are kept
+const writeResultsLength = 200
+
+// WriteResult is the state of a write to a single remote entity
+type WriteResult struct {
+	ID          string
+	SKI         string
+	Entity      string
+	UseCase     string
+	Field       string
+	MsgCounter  uint64 `json:",omitempty"`
+	Status      string
+	ErrorNumber uint   `json:",omitempty"`
+	Description string `json:",omitempty"`
+	Time        time.Time
+}
+
+// writeOrigin identifies who requested a write. The zero value only logs the results.
+type writeOrigin struct {
+	id     string
+	report func(result WriteResult)
+	// sends values violating the validation rules deliberately
+	override bool
+}
+
+func newWriteID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newWriteOrigin creates an origin for the given correlation ID, an empty ID is generated
+func newWriteOrigin(id string, report func(result WriteResult)) writeOrigin {
+	if id == "" {
+		id = newWriteID()
+	}
+	return writeOrigin{id: id, report: report}
+}
+
+// writeResultStore keeps the results of the latest writes by correlation ID
+type writeResultStore struct {
+	results map[string][]WriteResult
+	order   []string
+
+	mutex sync.Mutex
+}
+
+func newWriteResultStore() *writeResultStore {
+	return &writeResultStore{
+		results: map[string][]WriteResult{},
+	}
+}
+
+func (s *writeResultStore) store(result WriteResult) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	results, exists := s.results[result.ID]
+	if !exists {
+		s.order = append(s.order, result.ID)
+		if len(s.order) > writeResultsLength {
+			delete(s.results, s.order[0])
+			s.order = s.order[1:]
+		}
+	}
+
+	index := slices.IndexFunc(results, func(r WriteResult) bool {
+		return r.Entity == result.Entity && r.Field == result.Field
+	})
+	if index == -1 {
+		results = append(results, result)
+	} else {
+		results[index] = result
+	}
+	s.results[result.ID] = results
+}
+
+func (s *writeResultStore) get(id string) ([]WriteResult, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	results, ok := s.results[id]
+	return slices.Clone(results), ok
+}
+
+// trackWrite performs a write and reports its msgCounter and result to the origin.
+// The write function gets a callback for the result response of the remote entity.
+func (h *controlbox) trackWrite(origin writeOrigin, result WriteResult, write func(resultCB func(model.ResultDataType)) (*model.MsgCounterType, error)) {
+	if origin.id == "" {
+		origin.id = newWriteID()
+	}
+	result.ID = origin.id
+
+	var once sync.Once
+	finish := func(result WriteResult) {
+		once.Do(func() {
+			h.reportWrite(origin, result)
+		})
+	}
+
+	sent := make(chan struct{})
+	msgCounter, err := write(func(msg model.ResultDataType) {
+		// the result may arrive before the msgCounter was reported
+		<-sent
+
+		result := result
+		result.Status = writeStatusAccepted
+		if msg.ErrorNumber != nil && *msg.ErrorNumber != model.ErrorNumberTypeNoError {
+			result.Status = writeStatusRejected
+			result.ErrorNumber = uint(*msg.ErrorNumber)
+		}
+		if msg.Description != nil {
+			result.Description = string(*msg.Description)
+		}
+		finish(result)
+	})
+
+	if err != nil {
+		result.Status = writeStatusFailed
+		result.Description = err.Error()
+		finish(result)
+		close(sent)
+		return
+	}
+
+	if msgCounter != nil {
+		result.MsgCounter = uint64(*msgCounter)
+	}
+	result.Status = writeStatusPending
+	h.reportWrite(origin, result)
+	close(sent)
+
+	time.AfterFunc(writeResultTimeout, func() {
+		result := result
+		result.Status = writeStatusTimeout
+		finish(result)
+	})
+}
+
+func (h *controlbox) reportWrite(origin writeOrigin, result WriteResult) {
+	result.Time = time.Now()
+
+	slog.Info("Write", "ski", result.SKI, "usecase", result.UseCase, "id", result.ID, "field", result.Field,
+		"entity", result.Entity, "msgcounter", result.MsgCounter, "status", result.Status, "description", result.Description)
+
+	h.writeResults.store(result)
+	h.writeCounters.count(result)
+	if origin.report != nil {
+		origin.report(result)
+	}
+}
+
+// resultKey identifies the result of a write by the remote device and the msgCounter of the write
+type resultKey struct {
+	ski        string
+	msgCounter model.MsgCounterType
+}
+
+type receivedResult struct {
+	result model.ResultDataType
+	time   time.Time
+}
+
+// resultDispatcher hands the results received by the local DeviceConfiguration
+// client feature to the failsafe writes, the use cases do not offer a result
+// callback for these writes. It is registered before the first write is sent,
+// results arriving before their write is awaited are kept for writeResultTimeout.
+type resultDispatcher struct {
+	pending  map[resultKey]func(model.ResultDataType)
+	received map[resultKey]receivedResult
+
+	mutex sync.Mutex
+}
+
+func newResultDispatcher() *resultDispatcher {
+	return &resultDispatcher{
+		pending:  map[resultKey]func(model.ResultDataType){},
+		received: map[resultKey]receivedResult{},
+	}
+}
+
+// register receives the results of the local feature
+func (d *resultDispatcher) register(feature spineapi.FeatureLocalInterface) {
+	if feature != nil {
+		feature.AddResultCallback(d.deliver)
+	}
+}
+
+func (d *resultDispatcher) deliver(msg spineapi.ResponseMessage) {
+	result, ok := msg.Data.(*model.ResultDataType)
+	if !ok || msg.DeviceRemote == nil {
+		return
+	}
+	key := resultKey{ski: msg.DeviceRemote.Ski(), msgCounter: msg.MsgCounterReference}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if resultCB, ok := d.pending[key]; ok {
+		delete(d.pending, key)
+		go resultCB(*result)
+		return
+	}
+
+	now := time.Now()
+	for key, received := range d.received {
+		if now.Sub(received.time) > writeResultTimeout {
+			delete(d.received, key)
+		}
+	}
+	d.received[key] = receivedResult{result: *result, time: now}
+}
+
+// await calls resultCB with the result of the write sent with msgCounter to the device
+func (d *resultDispatcher) await(ski string, msgCounter *model.MsgCounterType, resultCB func(model.ResultDataType)) {
+	if msgCounter == nil {
+		return
+	}
+	key := resultKey{ski: ski, msgCounter: *msgCounter}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if received, ok := d.received[key]; ok {
+		delete(d.received, key)
+		go resultCB(received.result)
+		return
+	}
+
+	d.pending[key] = resultCB
+	time.AfterFunc(writeResultTimeout, func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		delete(d.pending, key)
+	})
+}
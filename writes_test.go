@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	spineapi "github.com/enbility/spine-go/api"
+	"github.com/enbility/spine-go/model"
+)
+
+type testRemoteDevice struct {
+	spineapi.DeviceRemoteInterface
+	ski string
+}
+
+func (d testRemoteDevice) Ski() string {
+	return d.ski
+}
+
+func TestResultDispatcher(t *testing.T) {
+	tests := []struct {
+		name          string
+		receivedFirst bool
+		ski           string
+		msgCounter    model.MsgCounterType
+		want          bool
+	}{
+		{"result after await", false, "ski", 1, true},
+		{"result before await", true, "ski", 1, true},
+		{"other msgCounter", false, "ski", 2, false},
+		{"other device", true, "other", 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newResultDispatcher()
+			results := make(chan model.ResultDataType, 1)
+			errorNumber := model.ErrorNumberType(7)
+			msg := spineapi.ResponseMessage{
+				MsgCounterReference: tt.msgCounter,
+				Data:                &model.ResultDataType{ErrorNumber: &errorNumber},
+				DeviceRemote:        testRemoteDevice{ski: tt.ski},
+			}
+			msgCounter := model.MsgCounterType(1)
+			await := func() {
+				d.await("ski", &msgCounter, func(result model.ResultDataType) { results <- result })
+			}
+
+			if tt.receivedFirst {
+				d.deliver(msg)
+				await()
+			} else {
+				await()
+				d.deliver(msg)
+			}
+
+			select {
+			case result := <-results:
+				if !tt.want {
+					t.Fatalf("got unexpected result %v", result)
+				}
+				if *result.ErrorNumber != 7 {
+					t.Errorf("got error number %v, want 7", *result.ErrorNumber)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.want {
+					t.Fatal("result not delivered")
+				}
+			}
+		})
+	}
+}